@@ -0,0 +1,95 @@
+package main
+
+import (
+	"cutter/etc"
+	"cutter/lexer"
+	"cutter/parser"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+)
+
+// openSource opens a template, or standard input for "-".
+func openSource(path string, anyExtension bool) (io.ReadCloser, string, error) {
+	if path == etc.StdinFileName {
+		return io.NopCloser(os.Stdin), etc.StdinSourceName, nil
+	}
+	file, err := etc.OpenFile(path, anyExtension)
+	if err != nil {
+		return nil, "", err
+	}
+	return file, path, nil
+}
+
+func runAstCommand(args []string) int {
+	flags := flag.NewFlagSet("ast", flag.ExitOnError)
+	decodeFlag := flags.Bool("decode", false, "Read an AST JSON document instead of a template and print it again")
+	anyExtFlag := flags.Bool("anyext", false, "Accept an input file without the .cm extension")
+	trimLinesFlag := flags.Bool("trimlines", false, "Remove lines that contain only directives and whitespace")
+	delimiters := lexer.DefaultDelimiters()
+	flags.Var(delimitersFlag{&delimiters}, "delims", "Replace the call, open, close and quote delimiters, e.g. '$ [ ] \"'")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "usage: cutter ast [flags] file")
+		fmt.Fprintf(flags.Output(), "Prints the syntax tree of a template as JSON (schema %d); - reads standard input.\n", parser.ASTSchemaVersion)
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	if flags.NArg() != 1 {
+		flags.Usage()
+		return ExitUsage
+	}
+
+	if *decodeFlag {
+		return decodeAst(flags.Arg(0))
+	}
+
+	source, sourceName, err := openSource(flags.Arg(0), *anyExtFlag)
+	if err != nil {
+		return reportError(newCLIError(ExitIO, "i/o error", err))
+	}
+	defer source.Close()
+
+	lex := lexer.NewLexerWithOptions(sourceName, lexer.Options{TrimLines: *trimLinesFlag, Delimiters: delimiters})
+	lex.SetInput(source)
+
+	var ast parser.HeadNode
+	err = catchStage(ExitSyntax, "syntax error", func() {
+		ast = parser.NewParser().ParseStream(lex)
+	})
+	if lex.Err() != nil {
+		return reportError(newCLIError(ExitIO, "i/o error", lex.Err()))
+	}
+	if err != nil {
+		return reportError(err)
+	}
+
+	if err := parser.EncodeJSON(os.Stdout, sourceName, ast); err != nil {
+		return reportError(newCLIError(ExitIO, "i/o error", err))
+	}
+	return ExitOK
+}
+
+// decodeAst rebuilds the syntax tree of an AST JSON document and prints it,
+// which checks the document and normalizes it.
+func decodeAst(path string) int {
+	var source io.ReadCloser = io.NopCloser(os.Stdin)
+	if path != etc.StdinFileName {
+		file, err := os.Open(path)
+		if err != nil {
+			return reportError(newCLIError(ExitIO, "i/o error", err))
+		}
+		source = file
+	}
+	defer source.Close()
+
+	ast, file, err := parser.DecodeJSON(source)
+	if err != nil {
+		return reportError(newCLIError(ExitSyntax, "syntax error", err))
+	}
+	if err := parser.EncodeJSON(os.Stdout, file, ast); err != nil {
+		return reportError(newCLIError(ExitIO, "i/o error", err))
+	}
+	return ExitOK
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"cutter/runtime"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	dataFormatJSON = "json"
+	dataFormatCSV  = "csv"
+)
+
+// dataSource is one -data or -csv option: a file bound under an optional object name prefix.
+type dataSource struct {
+	Prefix string
+	Path   string
+	Format string
+}
+
+// dataFlags collects repeated -data [prefix=]file options.
+type dataFlags []dataSource
+
+func parseDataSource(arg string, format string) dataSource {
+	src := dataSource{Path: arg, Format: format}
+	if prefix, path, ok := strings.Cut(arg, "="); ok {
+		src.Prefix, src.Path = prefix, path
+	}
+	return src
+}
+
+func (d *dataFlags) String() string {
+	paths := make([]string, 0, len(*d))
+	for _, src := range *d {
+		paths = append(paths, src.Path)
+	}
+	return strings.Join(paths, ",")
+}
+
+func (d *dataFlags) Set(arg string) error {
+	*d = append(*d, parseDataSource(arg, dataFormatJSON))
+	return nil
+}
+
+// csvFlags adds -csv [prefix=]file options to the same list, so data files are
+// bound in command line order whatever their format.
+type csvFlags struct {
+	sources *dataFlags
+}
+
+func (c csvFlags) String() string {
+	if c.sources == nil {
+		return ""
+	}
+	return c.sources.String()
+}
+
+func (c csvFlags) Set(arg string) error {
+	*c.sources = append(*c.sources, parseDataSource(arg, dataFormatCSV))
+	return nil
+}
+
+// csvSettings are the -csvdelim, -csvnoheader and -csvnoquote options, shared
+// by every -csv file.
+type csvSettings struct {
+	Delimiter string
+	NoHeader  bool
+	NoQuote   bool
+}
+
+func (s csvSettings) options(path string) (runtime.CSVOptions, error) {
+	opts := runtime.DefaultCSVOptions(path)
+	if s.Delimiter != "" {
+		delim := []rune(s.Delimiter)
+		if s.Delimiter == `\t` {
+			delim = []rune{'\t'}
+		}
+		if len(delim) != 1 {
+			return opts, fmt.Errorf("CSV delimiter must be a single character, got %q", s.Delimiter)
+		}
+		opts.Delimiter = delim[0]
+	}
+	opts.Header = !s.NoHeader
+	opts.Quoted = !s.NoQuote
+	return opts, nil
+}
+
+// load reads every data file into one data set.
+func (d *dataFlags) load(csv csvSettings) (*runtime.DataSet, error) {
+	ds := runtime.NewDataSet()
+	for _, src := range *d {
+		if err := loadDataFile(ds, src, csv); err != nil {
+			return nil, err
+		}
+	}
+	return ds, nil
+}
+
+func loadDataFile(ds *runtime.DataSet, src dataSource, csv csvSettings) error {
+	f, err := os.Open(src.Path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	switch src.Format {
+	case dataFormatCSV:
+		opts, err := csv.options(src.Path)
+		if err != nil {
+			return err
+		}
+		// Rows need a name to live under; default to the file name.
+		prefix := src.Prefix
+		if prefix == "" {
+			prefix = strings.TrimSuffix(filepath.Base(src.Path), filepath.Ext(src.Path))
+		}
+		err = ds.LoadCSV(f, prefix, opts)
+	default:
+		err = ds.LoadJSON(f, src.Prefix)
+	}
+	if err != nil {
+		return fmt.Errorf("%s: %w", src.Path, err)
+	}
+	return nil
+}
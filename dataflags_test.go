@@ -0,0 +1,41 @@
+package main
+
+import (
+	"cutter/runtime"
+	"testing"
+)
+
+func TestCSVSettingsOptions(t *testing.T) {
+	tests := []struct {
+		settings csvSettings
+		path     string
+		want     runtime.CSVOptions
+		err      bool
+	}{
+		{csvSettings{}, "rows.csv", runtime.CSVOptions{Delimiter: ',', Header: true, Quoted: true}, false},
+		{csvSettings{}, "rows.tsv", runtime.CSVOptions{Delimiter: '\t', Header: true, Quoted: true}, false},
+		{csvSettings{NoHeader: true}, "rows.csv", runtime.CSVOptions{Delimiter: ',', Quoted: true}, false},
+		{csvSettings{NoQuote: true}, "rows.csv", runtime.CSVOptions{Delimiter: ',', Header: true}, false},
+		{csvSettings{Delimiter: ";"}, "rows.tsv", runtime.CSVOptions{Delimiter: ';', Header: true, Quoted: true}, false},
+		{csvSettings{Delimiter: `\t`}, "rows.csv", runtime.CSVOptions{Delimiter: '\t', Header: true, Quoted: true}, false},
+		{csvSettings{Delimiter: "·"}, "rows.csv", runtime.CSVOptions{Delimiter: '·', Header: true, Quoted: true}, false},
+		{csvSettings{Delimiter: ";;"}, "rows.csv", runtime.CSVOptions{}, true},
+	}
+
+	for _, test := range tests {
+		got, err := test.settings.options(test.path)
+		if test.err {
+			if err == nil {
+				t.Errorf("%+v: expected an error", test.settings)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%+v: unexpected error %v", test.settings, err)
+			continue
+		}
+		if got != test.want {
+			t.Errorf("%+v on %s = %+v, want %+v", test.settings, test.path, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"cutter/lexer"
+	"cutter/parser"
+	"cutter/runtime"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// defineFlags collects repeated -D name=value options. The value type is inferred
+// like a bare word inside a call (int, real, !t/!f), falling back to a string;
+// name:str=value, name:int=value, name:real=value and name:bool=value force a type.
+type defineFlags struct {
+	names  []string
+	values map[string]parser.ValueObject
+}
+
+func newDefineFlags() *defineFlags {
+	return &defineFlags{values: make(map[string]parser.ValueObject)}
+}
+
+func (d *defineFlags) String() string {
+	return strings.Join(d.names, ",")
+}
+
+func (d *defineFlags) Set(arg string) error {
+	key, raw, ok := strings.Cut(arg, "=")
+	if !ok {
+		return fmt.Errorf("expected name=value, got %q", arg)
+	}
+	name, typeName, typed := strings.Cut(key, ":")
+
+	if name == "" || strings.ContainsAny(name, " \t\n@()`") {
+		return fmt.Errorf("invalid object name %q", name)
+	}
+	if lexer.InferValue(name).Type != lexer.DATA_OBJNAME {
+		return fmt.Errorf("invalid object name %q", name)
+	}
+
+	var value parser.ValueObject
+	var err error
+	if typed {
+		value, err = typedDefineValue(typeName, raw)
+	} else {
+		value = inferDefineValue(raw)
+	}
+	if err != nil {
+		return fmt.Errorf("%s: %w", name, err)
+	}
+
+	if _, exists := d.values[name]; !exists {
+		d.names = append(d.names, name)
+	}
+	d.values[name] = value
+	return nil
+}
+
+func inferDefineValue(raw string) parser.ValueObject {
+	data := lexer.InferValue(raw)
+	switch data.Type {
+	case lexer.DATA_INT:
+		return parser.ValueObject{Type: parser.INTGER, IntData: data.IntData}
+	case lexer.DATA_REAL:
+		return parser.ValueObject{Type: parser.REAL, FloatData: data.RealData}
+	case lexer.DATA_BOOL:
+		return parser.ValueObject{Type: parser.BOOLEAN, BoolData: data.BoolData}
+	}
+	return parser.ValueObject{Type: parser.STRING, StringData: raw}
+}
+
+func typedDefineValue(typeName string, raw string) (parser.ValueObject, error) {
+	switch typeName {
+	case "str":
+		return parser.ValueObject{Type: parser.STRING, StringData: raw}, nil
+	case "int":
+		v, err := strconv.ParseInt(raw, 10, 64)
+		if err != nil {
+			return parser.ValueObject{}, err
+		}
+		return parser.ValueObject{Type: parser.INTGER, IntData: v}, nil
+	case "real":
+		v, err := strconv.ParseFloat(raw, 64)
+		if err != nil {
+			return parser.ValueObject{}, err
+		}
+		return parser.ValueObject{Type: parser.REAL, FloatData: v}, nil
+	case "bool":
+		switch raw {
+		case "!t", "true":
+			return parser.ValueObject{Type: parser.BOOLEAN, BoolData: true}, nil
+		case "!f", "false":
+			return parser.ValueObject{Type: parser.BOOLEAN, BoolData: false}, nil
+		}
+		return parser.ValueObject{}, fmt.Errorf("invalid bool %q, expected !t or !f", raw)
+	}
+	return parser.ValueObject{}, fmt.Errorf("unknown type %q, expected str, int, real or bool", typeName)
+}
+
+// applyToCompiler makes every define known to the compiler as a variable function.
+func (d *defineFlags) applyToCompiler(com *runtime.Compiler) {
+	for _, name := range d.names {
+		com.DefineVariable(name, d.values[name])
+	}
+}
+
+// applyToVM stores every define in the VM memory before it runs.
+func (d *defineFlags) applyToVM(vm *runtime.VM) {
+	for _, name := range d.names {
+		vm.DefineObject(name, d.values[name])
+	}
+}
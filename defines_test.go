@@ -0,0 +1,75 @@
+package main
+
+import (
+	"cutter/parser"
+	"reflect"
+	"testing"
+)
+
+func TestDefineFlagsSet(t *testing.T) {
+	tests := []struct {
+		arg  string
+		name string
+		want parser.ValueObject
+		err  bool
+	}{
+		{"n=42", "n", parser.ValueObject{Type: parser.INTGER, IntData: 42}, false},
+		{"n=-0x10", "n", parser.ValueObject{Type: parser.INTGER, IntData: -16}, false},
+		{"r=2.5", "r", parser.ValueObject{Type: parser.REAL, FloatData: 2.5}, false},
+		{"b=!t", "b", parser.ValueObject{Type: parser.BOOLEAN, BoolData: true}, false},
+		{"s=hello world", "s", parser.ValueObject{Type: parser.STRING, StringData: "hello world"}, false},
+		{"s=", "s", parser.ValueObject{Type: parser.STRING}, false},
+		{"s=a=b", "s", parser.ValueObject{Type: parser.STRING, StringData: "a=b"}, false},
+		{"app.version=1.2.3", "app.version", parser.ValueObject{Type: parser.STRING, StringData: "1.2.3"}, false},
+		{"v:str=42", "v", parser.ValueObject{Type: parser.STRING, StringData: "42"}, false},
+		{"v:int=7", "v", parser.ValueObject{Type: parser.INTGER, IntData: 7}, false},
+		{"v:real=7", "v", parser.ValueObject{Type: parser.REAL, FloatData: 7}, false},
+		{"v:bool=false", "v", parser.ValueObject{Type: parser.BOOLEAN}, false},
+
+		{"novalue", "", parser.ValueObject{}, true},
+		{"=1", "", parser.ValueObject{}, true},
+		{"a b=1", "", parser.ValueObject{}, true},
+		{"@a=1", "", parser.ValueObject{}, true},
+		{"12=1", "", parser.ValueObject{}, true},
+		{"!t=1", "", parser.ValueObject{}, true},
+		{"v:int=x", "", parser.ValueObject{}, true},
+		{"v:bool=yes", "", parser.ValueObject{}, true},
+		{"v:date=1", "", parser.ValueObject{}, true},
+	}
+
+	for _, test := range tests {
+		defines := newDefineFlags()
+		err := defines.Set(test.arg)
+		if test.err {
+			if err == nil {
+				t.Errorf("-D %s: expected an error", test.arg)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("-D %s: unexpected error %v", test.arg, err)
+			continue
+		}
+		if got := defines.values[test.name]; !reflect.DeepEqual(got, test.want) || !reflect.DeepEqual(defines.names, []string{test.name}) {
+			t.Errorf("-D %s: defined %v as %+v, want %s as %+v", test.arg, defines.names, got, test.name, test.want)
+		}
+	}
+}
+
+func TestDefineFlagsRepeated(t *testing.T) {
+	defines := newDefineFlags()
+	for _, arg := range []string{"a=1", "b=2", "a=3"} {
+		if err := defines.Set(arg); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if want := []string{"a", "b"}; !reflect.DeepEqual(defines.names, want) {
+		t.Errorf("names %v, want %v", defines.names, want)
+	}
+	if defines.values["a"].IntData != 3 {
+		t.Errorf("a = %+v, want the last value 3", defines.values["a"])
+	}
+	if defines.String() != "a,b" {
+		t.Errorf("String() = %q", defines.String())
+	}
+}
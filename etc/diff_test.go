@@ -0,0 +1,67 @@
+package etc
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestUnifiedDiff(t *testing.T) {
+	tests := []struct {
+		name string
+		a    string
+		b    string
+		want string
+	}{
+		{"both empty", "", "", ""},
+		{"identical", "a\nb\n", "a\nb\n", ""},
+		{"from empty", "", "a\nb\n", "--- want\n+++ got\n@@ -0,0 +1,2 @@\n+a\n+b\n"},
+		{"to empty", "a\nb\n", "", "--- want\n+++ got\n@@ -1,2 +0,0 @@\n-a\n-b\n"},
+		{"insert only", "a\nc\n", "a\nb\nc\n", "--- want\n+++ got\n@@ -1,2 +1,3 @@\n a\n+b\n c\n"},
+		{"delete only", "a\nb\nc\n", "a\nc\n", "--- want\n+++ got\n@@ -1,3 +1,2 @@\n a\n-b\n c\n"},
+		{"replace", "a\nb\nc\n", "a\nx\nc\n", "--- want\n+++ got\n@@ -1,3 +1,3 @@\n a\n-b\n+x\n c\n"},
+		{"missing newline", "a", "a\n", "--- want\n+++ got\n@@ -1 +1 @@\n-a\n\\ No newline at end of file\n+a\n"},
+		{"context", "1\n2\n3\n4\n5\n6\n7\n8\n9\n", "1\n2\n3\n4\nX\n6\n7\n8\n9\n",
+			"--- want\n+++ got\n@@ -2,7 +2,7 @@\n 2\n 3\n 4\n-5\n+X\n 6\n 7\n 8\n"},
+		{"two hunks", "1\n2\n3\n4\n5\n6\n7\n8\n9\n10\n", "X\n2\n3\n4\n5\n6\n7\n8\n9\nY\n",
+			"--- want\n+++ got\n@@ -1,4 +1,4 @@\n-1\n+X\n 2\n 3\n 4\n@@ -7,4 +7,4 @@\n 7\n 8\n 9\n-10\n+Y\n"},
+	}
+
+	for _, test := range tests {
+		if got := UnifiedDiff("want", "got", test.a, test.b); got != test.want {
+			t.Errorf("%s:\ngot:\n%s\nwant:\n%s", test.name, got, test.want)
+		}
+	}
+}
+
+// numberedLines returns n lines made of prefix and the line number.
+func numberedLines(prefix string, n int) []string {
+	lines := make([]string, n)
+	for i := range lines {
+		lines[i] = fmt.Sprintf("%s%d\n", prefix, i)
+	}
+	return lines
+}
+
+func TestDiffLinesLarge(t *testing.T) {
+	// Two long outputs that differ in one line are diffed around that line.
+	a := numberedLines("line ", 20000)
+	b := append([]string{}, a...)
+	b[10000] = "changed\n"
+	ops := diffLines(a, b)
+	if len(ops) != 20001 || ops[10000].kind != '-' || ops[10001].kind != '+' || ops[10001].text != "changed\n" {
+		t.Errorf("got %d ops, want the changed line replaced among 19999 kept ones", len(ops))
+	}
+
+	// A change too large for the table is shown as a replacement.
+	a = numberedLines("old ", 20000)
+	b = numberedLines("new ", 20000)
+	ops = diffLines(a, b)
+	if len(ops) != 40000 || ops[0].kind != '-' || ops[19999].kind != '-' || ops[20000].kind != '+' {
+		t.Errorf("got %d ops, want every old line removed, then every new one added", len(ops))
+	}
+	diff := UnifiedDiff("want", "got", strings.Join(a, ""), strings.Join(b, ""))
+	if !strings.HasPrefix(diff, "--- want\n+++ got\n@@ -1,20000 +1,20000 @@\n-old 0\n") {
+		t.Errorf("diff starts with %q", diff[:min(len(diff), 60)])
+	}
+}
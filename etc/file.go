@@ -6,11 +6,38 @@ import (
 	"path/filepath"
 )
 
-func ReadFile(filePath string) (string, error) {
+const SourceExtension = ".cm"
+
+// StdinFileName is the input name that selects standard input, and the name
+// given to positions in templates read from it.
+const (
+	StdinFileName   = "-"
+	StdinSourceName = "<stdin>"
+)
+
+func checkExtension(filePath string, anyExtension bool) error {
 	extension := filepath.Ext(filePath)
-	if extension != ".cm" {
-		fmt.Println("not a Cutter(.cm) file: " + filePath)
-		os.Exit(0)
+	if !anyExtension && extension != SourceExtension {
+		return fmt.Errorf("not a Cutter(%s) file: %s", SourceExtension, filePath)
+	}
+	return nil
+}
+
+// IncludePathEnv names the environment variable with the directories that
+// @include searches after the directory of the including file, separated like
+// PATH.
+const IncludePathEnv = "CUTTER_PATH"
+
+// IncludePathFromEnv returns the directories listed in IncludePathEnv.
+func IncludePathFromEnv() []string {
+	return filepath.SplitList(os.Getenv(IncludePathEnv))
+}
+
+// ReadFile reads a Cutter source file. Unless anyExtension is set, the file
+// must have the .cm extension.
+func ReadFile(filePath string, anyExtension bool) (string, error) {
+	if err := checkExtension(filePath, anyExtension); err != nil {
+		return "", err
 	}
 
 	data, err := os.ReadFile(filePath)
@@ -20,6 +47,15 @@ func ReadFile(filePath string) (string, error) {
 	return string(data), nil
 }
 
+// OpenFile opens a Cutter source file for streaming, with the same extension
+// check as ReadFile.
+func OpenFile(filePath string, anyExtension bool) (*os.File, error) {
+	if err := checkExtension(filePath, anyExtension); err != nil {
+		return nil, err
+	}
+	return os.Open(filePath)
+}
+
 func WriteFile(filePath string, content string) error {
 	err := os.WriteFile(filePath, []byte(content), 0644)
 	if err != nil {
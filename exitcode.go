@@ -0,0 +1,72 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	rtdebug "runtime/debug"
+)
+
+// Process exit codes of the cutter CLI. A template that calls @exit(n)
+// terminates with status n instead. That status is not kept apart from the
+// codes below, so @exit(4) looks like a syntax error to the caller; templates
+// that report their own failures should use 1 or a code above ExitRuntime.
+const (
+	ExitOK      = 0
+	ExitFailure = 1 // cutter test: at least one template failed
+	ExitUsage   = 2
+	ExitIO      = 3
+	ExitSyntax  = 4
+	ExitCompile = 5
+	ExitRuntime = 6
+)
+
+// cliError is an error that knows which exit code it should produce.
+type cliError struct {
+	Code int
+	Kind string
+	Err  error
+}
+
+func (e *cliError) Error() string {
+	return e.Kind + ": " + e.Err.Error()
+}
+
+func (e *cliError) Unwrap() error {
+	return e.Err
+}
+
+func newCLIError(code int, kind string, err error) *cliError {
+	return &cliError{Code: code, Kind: kind, Err: err}
+}
+
+// showStacks makes catchStage print the Go stack of a recovered panic (debug mode).
+var showStacks = false
+
+// catchStage runs one stage of the pipeline and turns a panic inside it into a
+// cliError with the given exit code, so users see a message instead of a Go trace.
+func catchStage(code int, kind string, fn func()) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			if showStacks {
+				os.Stderr.Write(rtdebug.Stack())
+			}
+			if e, ok := r.(error); ok {
+				err = newCLIError(code, kind, e)
+			} else {
+				err = newCLIError(code, kind, fmt.Errorf("%v", r))
+			}
+		}
+	}()
+
+	fn()
+	return nil
+}
+
+// reportError prints err to stderr and returns the exit code it maps to.
+func reportError(err error) int {
+	fmt.Fprintln(os.Stderr, "cutter:", err)
+	if e, ok := err.(*cliError); ok {
+		return e.Code
+	}
+	return ExitFailure
+}
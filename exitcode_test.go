@@ -0,0 +1,99 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// runCLI runs the template command with stdin as standard input and returns
+// its exit code and what it wrote to standard output and standard error.
+func runCLI(t *testing.T, stdin string, args ...string) (code int, stdout string, stderr string) {
+	t.Helper()
+	dir := t.TempDir()
+	open := func(name string, content string) *os.File {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		f, err := os.OpenFile(path, os.O_RDWR, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return f
+	}
+	in, out, errOut := open("stdin", stdin), open("stdout", ""), open("stderr", "")
+	defer in.Close()
+	defer out.Close()
+	defer errOut.Close()
+
+	saved := []*os.File{os.Stdin, os.Stdout, os.Stderr}
+	os.Stdin, os.Stdout, os.Stderr = in, out, errOut
+	defer func() { os.Stdin, os.Stdout, os.Stderr = saved[0], saved[1], saved[2] }()
+
+	code = runTemplateCommand(args)
+	return code, readFile(t, out.Name()), readFile(t, errOut.Name())
+}
+
+func TestExitCodes(t *testing.T) {
+	dir := t.TempDir()
+	writeTree(t, dir, map[string]string{
+		"ok.cm":      "hello",
+		"syntax.cm":  "@echo(1",
+		"compile.cm": "@nosuch(1)",
+		"runtime.cm": "@output(`../x`)",
+		"exit4.cm":   "before@exit(4)after",
+		"exit9.cm":   "@exit(9)",
+		"page.txt":   "hello",
+	})
+	path := func(name string) string { return filepath.Join(dir, name) }
+
+	tests := []struct {
+		name   string
+		args   []string
+		code   int
+		stderr string
+	}{
+		{"ok", []string{"-i", path("ok.cm")}, ExitOK, ""},
+		{"no input", []string{}, ExitUsage, "cutter: no input file specified"},
+		{"missing file", []string{"-i", path("none.cm")}, ExitIO, "cutter: i/o error: "},
+		{"extension", []string{"-i", path("page.txt")}, ExitIO, "cutter: i/o error: "},
+		{"missing data", []string{"-i", path("ok.cm"), "-data", path("none.json")}, ExitIO, "cutter: i/o error: "},
+		{"syntax", []string{"-i", path("syntax.cm")}, ExitSyntax, "cutter: syntax error: "},
+		{"compile", []string{"-i", path("compile.cm")}, ExitCompile, "cutter: compile error: "},
+		{"runtime", []string{"-i", path("runtime.cm"), "-out-dir", dir}, ExitRuntime, "cutter: runtime error: "},
+		// A template's own status shares the range of the codes above.
+		{"exit overlapping", []string{"-i", path("exit4.cm")}, ExitSyntax, ""},
+		{"exit", []string{"-i", path("exit9.cm")}, 9, ""},
+	}
+
+	for _, test := range tests {
+		code, _, stderr := runCLI(t, "", test.args...)
+		if code != test.code {
+			t.Errorf("%s: exit code %d, want %d (stderr %q)", test.name, code, test.code, stderr)
+		}
+		if test.stderr == "" && stderr != "" || !strings.HasPrefix(stderr, test.stderr) {
+			t.Errorf("%s: stderr %q, want it to start with %q", test.name, stderr, test.stderr)
+		}
+	}
+}
+
+func TestCatchStage(t *testing.T) {
+	if err := catchStage(ExitRuntime, "runtime error", func() {}); err != nil {
+		t.Errorf("catchStage without a panic = %v", err)
+	}
+
+	cause := errors.New("boom")
+	for _, value := range []any{"boom", cause} {
+		err := catchStage(ExitCompile, "compile error", func() { panic(value) })
+		var cli *cliError
+		if !errors.As(err, &cli) || cli.Code != ExitCompile || err.Error() != "compile error: boom" {
+			t.Errorf("panic(%#v): error %#v", value, err)
+		}
+		if _, ok := value.(error); ok && !errors.Is(err, cause) {
+			t.Errorf("panic(%#v): error does not wrap the panic value", value)
+		}
+	}
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"cutter/etc"
+	"cutter/format"
+	"cutter/lexer"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// findTemplates lists the files named by paths; directories are walked for
+// .cm templates.
+func findTemplates(paths []string) ([]string, error) {
+	files := make([]string, 0)
+
+	for _, path := range paths {
+		info, err := os.Stat(path)
+		if err != nil {
+			return nil, err
+		}
+
+		if !info.IsDir() {
+			files = append(files, path)
+			continue
+		}
+
+		found := make([]string, 0)
+		err = filepath.WalkDir(path, func(p string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			if !d.IsDir() && filepath.Ext(p) == etc.SourceExtension {
+				found = append(found, p)
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+		sort.Strings(found)
+		files = append(files, found...)
+	}
+
+	return files, nil
+}
+
+func runFmtCommand(args []string) int {
+	flags := flag.NewFlagSet("fmt", flag.ExitOnError)
+	writeFlag := flags.Bool("w", false, "Write the result back to the file instead of standard output")
+	listFlag := flags.Bool("l", false, "List the files whose formatting differs instead of printing them")
+	delimiters := lexer.DefaultDelimiters()
+	flags.Var(delimitersFlag{&delimiters}, "delims", "Replace the call, open, close and quote delimiters, e.g. '$ [ ] \"'")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "usage: cutter fmt [flags] [paths...]")
+		fmt.Fprintln(flags.Output(), "Formats templates; directories are searched for .cm files, and no paths reads standard input.")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	options := format.Options{Delimiters: delimiters}
+
+	if flags.NArg() == 0 {
+		if *writeFlag {
+			return reportError(newCLIError(ExitUsage, "usage error", errors.New("cannot use -w with standard input")))
+		}
+		return formatFile(etc.StdinFileName, options, false, *listFlag)
+	}
+
+	files, err := findTemplates(flags.Args())
+	if err != nil {
+		return reportError(newCLIError(ExitIO, "i/o error", err))
+	}
+
+	code := ExitOK
+	for _, file := range files {
+		if fileCode := formatFile(file, options, *writeFlag, *listFlag); fileCode != ExitOK {
+			code = fileCode
+		}
+	}
+	return code
+}
+
+// formatFile formats one template, printing it, listing it or rewriting it.
+func formatFile(path string, options format.Options, write bool, list bool) int {
+	var data []byte
+	var err error
+	sourceName := path
+	if path == etc.StdinFileName {
+		sourceName = etc.StdinSourceName
+		data, err = io.ReadAll(os.Stdin)
+	} else {
+		data, err = os.ReadFile(path)
+	}
+	if err != nil {
+		return reportError(newCLIError(ExitIO, "i/o error", err))
+	}
+
+	source := string(data)
+	result, err := format.Source(source, sourceName, options)
+	if err != nil {
+		return reportError(newCLIError(ExitSyntax, "syntax error", err))
+	}
+
+	if list && result != source {
+		fmt.Println(sourceName)
+	}
+	if write {
+		if result == source {
+			return ExitOK
+		}
+		info, err := os.Stat(path)
+		if err == nil {
+			err = os.WriteFile(path, []byte(result), info.Mode().Perm())
+		}
+		if err != nil {
+			return reportError(newCLIError(ExitIO, "i/o error", err))
+		}
+		return ExitOK
+	}
+	if !list {
+		fmt.Print(result)
+	}
+	return ExitOK
+}
@@ -0,0 +1,509 @@
+// Package format rewrites Cutter templates into their canonical layout.
+//
+// Only directives are rewritten: arguments are separated by single spaces, a
+// directive written on one line stays on one line, and in one that spans
+// lines every argument goes on its own line, indented two spaces deeper
+// than the line the directive starts on. Normal text, comments, strings and
+// verbatim regions are kept exactly as written.
+package format
+
+import (
+	"cutter/lexer"
+	"cutter/parser"
+	"fmt"
+	"reflect"
+	"strings"
+)
+
+// Options configures Source.
+type Options struct {
+	// Delimiters are the delimiters the template starts with; the zero value
+	// means the default ones.
+	Delimiters lexer.Delimiters
+}
+
+type itemKind int
+
+const (
+	itemAtom itemKind = iota + 1 // a word, literal or verbatim region, as written
+	itemCall
+	itemLineComment
+	itemBlockComment
+)
+
+type item struct {
+	kind itemKind
+	text string
+	call *directive
+
+	// trailing is set for a comment written on the line of the item before it.
+	trailing bool
+}
+
+// directive is a call, definition or include as written in the source.
+type directive struct {
+	keyword string // @, @define, @-include, ...; empty for a nested call
+	name    string // the name of a call; empty for definitions and includes
+	open    string
+	close   string
+	trim    bool // closed with -)
+	items   []item
+
+	multiline bool
+}
+
+type formatter struct {
+	tokenizer  *lexer.Tokenizer
+	pending    []lexer.Token
+	delimiters lexer.Delimiters
+	out        strings.Builder
+}
+
+// Source formats the template src. Templates that do not parse are returned
+// as an error, and the result is checked to parse to the same tree as src.
+func Source(src string, fileName string, options Options) (string, error) {
+	delimiters := options.Delimiters
+	if delimiters == (lexer.Delimiters{}) {
+		delimiters = lexer.DefaultDelimiters()
+	}
+
+	before, err := parse(src, fileName, delimiters)
+	if err != nil {
+		return "", err
+	}
+
+	f := &formatter{delimiters: delimiters}
+	f.tokenizer = lexer.NewTokenizerWithKeywords(strings.NewReader(src), delimiters.Keywords(), lexer.Position{File: fileName, Line: 1, Column: 1})
+	if err := f.formatText(); err != nil {
+		return "", err
+	}
+	result := f.out.String()
+
+	if err := checkMeaning(before, result, fileName, delimiters); err != nil {
+		return "", err
+	}
+	return result, nil
+}
+
+// checkMeaning reports an error unless result parses to the same tree as
+// before, the tree of the template it was formatted from.
+func checkMeaning(before parser.HeadNode, result string, fileName string, delimiters lexer.Delimiters) error {
+	after, err := parse(result, fileName, delimiters)
+	if err != nil || !reflect.DeepEqual(stripPositions(before), stripPositions(after)) {
+		return fmt.Errorf("%s: formatting would change the meaning of the template", fileName)
+	}
+	return nil
+}
+
+func parse(src string, fileName string, delimiters lexer.Delimiters) (head parser.HeadNode, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("%v", r)
+		}
+	}()
+
+	lex := lexer.NewLexerWithOptions(fileName, lexer.Options{Delimiters: delimiters})
+	lex.SetInput(strings.NewReader(src))
+	return parser.NewParser().ParseStream(lex), nil
+}
+
+func (f *formatter) next() lexer.Token {
+	if len(f.pending) > 0 {
+		token := f.pending[0]
+		f.pending = f.pending[1:]
+		return token
+	}
+	return f.tokenizer.Next()
+}
+
+// unread puts tokens back in front of the input.
+func (f *formatter) unread(tokens ...lexer.Token) {
+	f.pending = append(append([]lexer.Token{}, tokens...), f.pending...)
+}
+
+func unexpected(token lexer.Token) error {
+	return fmt.Errorf("%s: cannot format %s here", token.GetPos(), token.GetType())
+}
+
+// formatText copies normal text and formats the directives in it.
+func (f *formatter) formatText() error {
+	for {
+		token := f.next()
+
+		switch token.GetType() {
+		case lexer.TERMINATOR:
+			return nil
+
+		case lexer.KEYWORD_CALL, lexer.KEYWORD_CALL_TRIM,
+			lexer.KEYWORD_DEFINE, lexer.KEYWORD_DEFINE_TRIM,
+			lexer.KEYWORD_INCLUDE, lexer.KEYWORD_INCLUDE_TRIM:
+			if err := f.formatDirective(token); err != nil {
+				return err
+			}
+
+		case lexer.COMMENT_BLOCK_CLOSE:
+			// Outside of a comment this is text followed by a call.
+			f.out.WriteString("*")
+			if err := f.formatDirective(lexer.NewDataToken(lexer.KEYWORD_CALL, f.delimiters.Call)); err != nil {
+				return err
+			}
+
+		case lexer.COMMENT_LINE:
+			f.out.WriteString(token.GetData())
+			for {
+				token = f.next()
+				f.out.WriteString(token.GetData())
+				if token.GetType() == lexer.NEWLINE || token.GetType() == lexer.TERMINATOR {
+					break
+				}
+			}
+
+		case lexer.COMMENT_BLOCK_OPEN:
+			text, err := f.readBlockComment(token)
+			if err != nil {
+				return err
+			}
+			f.out.WriteString(text)
+
+		default:
+			f.out.WriteString(token.GetData())
+		}
+	}
+}
+
+func (f *formatter) formatDirective(keyword lexer.Token) error {
+	d, err := f.readDirective(keyword)
+	if err != nil {
+		return err
+	}
+
+	text := f.out.String()
+	line := text[strings.LastIndexByte(text, '\n')+1:]
+	indent := line[:len(line)-len(strings.TrimLeft(line, " \t"))]
+	f.out.WriteString(render(d, indent))
+
+	if d.name == "delimiters" {
+		return f.changeDelimiters(d)
+	}
+	return nil
+}
+
+// changeDelimiters follows an @delimiters directive, so that the rest of the
+// template is read like the lexer reads it.
+func (f *formatter) changeDelimiters(d *directive) error {
+	spellings := make([]string, 0)
+	for _, it := range d.items {
+		if it.kind != itemAtom {
+			continue
+		}
+		text := it.text
+		if len(text) >= 2*len(f.delimiters.Quote) && strings.HasPrefix(text, f.delimiters.Quote) && strings.HasSuffix(text, f.delimiters.Quote) {
+			text = text[len(f.delimiters.Quote) : len(text)-len(f.delimiters.Quote)]
+		}
+		spellings = append(spellings, text)
+	}
+
+	delimiters := lexer.DefaultDelimiters()
+	if len(spellings) > 0 {
+		var err error
+		if delimiters, err = f.delimiters.With(spellings); err != nil {
+			return err
+		}
+	}
+	f.delimiters = delimiters
+	f.tokenizer.SetKeywords(delimiters.Keywords())
+	return nil
+}
+
+// skipSpace reads past whitespace and newlines and returns the tokens it read
+// together with the first other token.
+func (f *formatter) skipSpace() ([]lexer.Token, lexer.Token) {
+	skipped := make([]lexer.Token, 0)
+	for {
+		token := f.next()
+		if token.GetType() != lexer.WHITESPACE && token.GetType() != lexer.NEWLINE {
+			return skipped, token
+		}
+		skipped = append(skipped, token)
+	}
+}
+
+func (f *formatter) readDirective(keyword lexer.Token) (*directive, error) {
+	d := &directive{keyword: keyword.GetData()}
+
+	if keyword.GetType() == lexer.KEYWORD_CALL || keyword.GetType() == lexer.KEYWORD_CALL_TRIM {
+		_, name := f.skipSpace()
+		if name.GetType() != lexer.NORM_STRINGS {
+			return nil, unexpected(name)
+		}
+		d.name = name.GetData()
+	}
+
+	_, open := f.skipSpace()
+	if open.GetType() != lexer.KEYWORD_BRACKET_OPEN {
+		return nil, unexpected(open)
+	}
+	d.open = open.GetData()
+
+	return d, f.readItems(d)
+}
+
+// readItems reads the arguments of d up to and including its closing bracket.
+func (f *formatter) readItems(d *directive) error {
+	newline := false
+	add := func(it item) {
+		if it.kind == itemLineComment || it.kind == itemBlockComment {
+			it.trailing = !newline && len(d.items) > 0
+		}
+		d.items = append(d.items, it)
+		newline = false
+	}
+
+	for {
+		token := f.next()
+
+		switch token.GetType() {
+		case lexer.WHITESPACE:
+
+		case lexer.NEWLINE:
+			d.multiline = true
+			newline = true
+
+		case lexer.KEYWORD_BRACKET_CLOSE, lexer.KEYWORD_BRACKET_CLOSE_TRIM:
+			d.close = token.GetData()
+			d.trim = token.GetType() == lexer.KEYWORD_BRACKET_CLOSE_TRIM
+			return nil
+
+		case lexer.NORM_STRINGS:
+			skipped, next := f.skipSpace()
+			if next.GetType() != lexer.KEYWORD_BRACKET_OPEN {
+				f.unread(append(skipped, next)...)
+				add(item{kind: itemAtom, text: token.GetData()})
+				continue
+			}
+
+			call := &directive{name: token.GetData(), open: next.GetData()}
+			if err := f.readItems(call); err != nil {
+				return err
+			}
+			if call.multiline {
+				d.multiline = true
+			}
+			add(item{kind: itemCall, call: call})
+
+		case lexer.STRING_QUOTEMARK:
+			text, err := f.readString(token)
+			if err != nil {
+				return err
+			}
+			add(item{kind: itemAtom, text: text})
+
+		case lexer.RAW_STRING_MARK:
+			text, err := f.readUntil(token, lexer.RAW_STRING_MARK)
+			if err != nil {
+				return err
+			}
+			add(item{kind: itemAtom, text: text})
+
+		case lexer.VERBATIM_OPEN:
+			text, err := f.readUntil(token, lexer.VERBATIM_CLOSE)
+			if err != nil {
+				return err
+			}
+			add(item{kind: itemAtom, text: text})
+
+		case lexer.BOOLEAN_TRUE, lexer.BOOLEAN_FALSE, lexer.KEYWORD_ESCAPE:
+			add(item{kind: itemAtom, text: token.GetData()})
+
+		case lexer.COMMENT_LINE:
+			var sb strings.Builder
+			sb.WriteString(token.GetData())
+			for {
+				next := f.next()
+				if next.GetType() == lexer.NEWLINE || next.GetType() == lexer.TERMINATOR {
+					f.unread(next)
+					break
+				}
+				sb.WriteString(next.GetData())
+			}
+			add(item{kind: itemLineComment, text: strings.TrimRight(sb.String(), " \t\r")})
+			d.multiline = true
+
+		case lexer.COMMENT_BLOCK_OPEN:
+			text, err := f.readBlockComment(token)
+			if err != nil {
+				return err
+			}
+			add(item{kind: itemBlockComment, text: text})
+			if strings.Contains(text, "\n") {
+				d.multiline = true
+			}
+
+		default:
+			return unexpected(token)
+		}
+	}
+}
+
+// readString reads a backtick string the way the lexer does: a quote after an
+// odd number of backslashes is part of the string, and three quotes inside a
+// string are three separate quotes.
+func (f *formatter) readString(open lexer.Token) (string, error) {
+	var sb, content strings.Builder
+	sb.WriteString(open.GetData())
+
+	for {
+		token := f.next()
+
+		switch token.GetType() {
+		case lexer.TERMINATOR:
+			return "", fmt.Errorf("%s: unterminated string", open.GetPos())
+
+		case lexer.STRING_QUOTEMARK:
+			sb.WriteString(token.GetData())
+			text := content.String()
+			if (len(text)-len(strings.TrimRight(text, "\\")))%2 == 0 {
+				return sb.String(), nil
+			}
+			content.WriteString(token.GetData())
+
+		case lexer.RAW_STRING_MARK:
+			quote := lexer.NewDataToken(lexer.STRING_QUOTEMARK, f.delimiters.Quote)
+			f.unread(quote, quote, quote)
+
+		default:
+			sb.WriteString(token.GetData())
+			content.WriteString(token.GetData())
+		}
+	}
+}
+
+// readUntil reads everything up to and including a token of type end.
+func (f *formatter) readUntil(open lexer.Token, end lexer.TokenType) (string, error) {
+	var sb strings.Builder
+	sb.WriteString(open.GetData())
+
+	for {
+		token := f.next()
+		if token.GetType() == lexer.TERMINATOR {
+			return "", fmt.Errorf("%s: expected %s", open.GetPos(), end)
+		}
+		sb.WriteString(token.GetData())
+		if token.GetType() == end {
+			return sb.String(), nil
+		}
+	}
+}
+
+func (f *formatter) readBlockComment(open lexer.Token) (string, error) {
+	return f.readUntil(open, lexer.COMMENT_BLOCK_CLOSE)
+}
+
+func (d *directive) closing() string {
+	if d.trim {
+		return " " + d.close
+	}
+	return d.close
+}
+
+func (d *directive) isDefinition() bool {
+	return d.keyword != "" && d.name == ""
+}
+
+// inline renders d on one line.
+func inline(d *directive) string {
+	var sb strings.Builder
+	sb.WriteString(d.keyword)
+	sb.WriteString(d.name)
+	sb.WriteString(d.open)
+	for i, it := range d.items {
+		if i > 0 {
+			sb.WriteString(" ")
+		}
+		if it.kind == itemCall {
+			sb.WriteString(inline(it.call))
+		} else {
+			sb.WriteString(it.text)
+		}
+	}
+	sb.WriteString(d.closing())
+	return sb.String()
+}
+
+// render lays out d on a line indented by indent.
+func render(d *directive, indent string) string {
+	if len(d.items) == 0 {
+		return inline(d)
+	}
+	if !d.multiline {
+		return inline(d)
+	}
+
+	inner := indent + "  "
+	var sb strings.Builder
+	sb.WriteString(d.keyword)
+	sb.WriteString(d.name)
+	sb.WriteString(d.open)
+
+	// A definition keeps its name and parameters on the first line.
+	start := 0
+	if d.isDefinition() {
+		for start < len(d.items)-1 && d.items[start].kind == itemAtom {
+			if start > 0 {
+				sb.WriteString(" ")
+			}
+			sb.WriteString(d.items[start].text)
+			start++
+		}
+	}
+
+	for i := start; i < len(d.items); i++ {
+		it := d.items[i]
+		switch {
+		case it.trailing:
+			sb.WriteString(" ")
+			sb.WriteString(it.text)
+		case it.kind == itemCall:
+			sb.WriteString("\n" + inner)
+			sb.WriteString(render(it.call, inner))
+		default:
+			sb.WriteString("\n" + inner)
+			sb.WriteString(it.text)
+		}
+	}
+
+	if d.items[len(d.items)-1].kind == itemLineComment {
+		sb.WriteString("\n" + indent + d.close)
+	} else {
+		sb.WriteString(d.closing())
+	}
+	return sb.String()
+}
+
+// stripPositions returns head without source positions, for comparing trees.
+func stripPositions(head parser.HeadNode) parser.HeadNode {
+	stripped := parser.HeadNode{Bodys: make([]parser.BodyObject, 0, len(head.Bodys))}
+	for _, body := range head.Bodys {
+		body.Call = stripCall(body.Call)
+		body.Func.Body = stripCall(body.Func.Body)
+		body.Func.Pos, body.Func.End = lexer.Position{}, lexer.Position{}
+		if body.Func.Parameters == nil {
+			body.Func.Parameters = []string{}
+		}
+		body.Norm.Pos, body.Norm.End = lexer.Position{}, lexer.Position{}
+		stripped.Bodys = append(stripped.Bodys, body)
+	}
+	return stripped
+}
+
+func stripCall(call parser.CallObject) parser.CallObject {
+	call.Pos, call.End = lexer.Position{}, lexer.Position{}
+	args := make([]parser.Argument, 0, len(call.Arguments))
+	for _, arg := range call.Arguments {
+		arg.Pos = lexer.Position{}
+		arg.Callable = stripCall(arg.Callable)
+		args = append(args, arg)
+	}
+	call.Arguments = args
+	return call
+}
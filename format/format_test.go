@@ -0,0 +1,132 @@
+package format
+
+import (
+	"cutter/lexer"
+	"strings"
+	"testing"
+)
+
+func TestSource(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		want  string
+	}{
+		{"text is kept", "plain  text\n\n  (not a call) `x`\n", "plain  text\n\n  (not a call) `x`\n"},
+		{"spacing", "@ echo ( 1   2\t3 )", "@echo(1 2 3)"},
+		{"nested on one line", "@echo(add( strlen(`ab`)  1 ))", "@echo(add(strlen(`ab`) 1))"},
+		{"multi-line call", "@echo(1\n2 3)", "@echo(\n  1\n  2\n  3)"},
+		{"nested multi-line", "  @echo(a\nb(c\nd))", "  @echo(\n    a\n    b(\n      c\n      d))"},
+		{"nested call spanning lines", "@echo(1 add(2\n3))", "@echo(\n  1\n  add(\n    2\n    3))"},
+		{"definition keeps its head", "@define(f a b\necho(a) )", "@define(f a b\n  echo(a))"},
+		{"one-line definition", "@define( x  1 )\n@x()", "@define(x 1)\n@x()"},
+		{"include", "@include( `lib.cm` )", "@include(`lib.cm`)"},
+
+		{"line comment in text", "a @# comment  \nb", "a @# comment  \nb"},
+		{"trailing line comment", "@echo(1 @# one  \n2)", "@echo(\n  1 @# one\n  2)"},
+		{"line comment before the close", "@echo(1 @# c\n)", "@echo(\n  1 @# c\n)"},
+		{"line comment on its own line", "@echo(1\n@# c\n2)", "@echo(\n  1\n  @# c\n  2)"},
+		{"block comment in text", "a @* x *@ b", "a @* x *@ b"},
+		{"block comment argument", "@echo(a@* c *@b)", "@echo(a @* c *@ b)"},
+		{"multi-line block comment", "@echo(1 @* a\nb *@ 2)", "@echo(\n  1 @* a\nb *@\n  2)"},
+
+		{"trim markers", "a\n@-echo( 1 -)\nb", "a\n@-echo(1 -)\nb"},
+		{"trim close without space", "@echo(1-)", "@echo(1 -)"},
+		{"trim definition", "@-define(x 1-)", "@-define(x 1 -)"},
+		{"trim close on a multi-line call", "@echo(1\n2 -)", "@echo(\n  1\n  2 -)"},
+
+		{"escaped strings", "@echo( `a\\`b`  `\\\\` `\\n` )", "@echo(`a\\`b` `\\\\` `\\n`)"},
+		{"string spanning lines", "@echo( `a\nb`  1)", "@echo(`a\nb` 1)"},
+		{"raw strings", "@echo( ```a `` b```  1)", "@echo(```a `` b``` 1)"},
+		{"verbatim", "@echo( @verbatim  @echo( x ) @endverbatim )", "@echo(@verbatim  @echo( x ) @endverbatim)"},
+		{"verbatim in text", "@verbatim @echo( x ) @endverbatim", "@verbatim @echo( x ) @endverbatim"},
+		{"escape", "a @@echo( 1 ) @echo( @@ )", "a @@echo( 1 ) @echo(@@)"},
+		{"booleans", "@same( !t  !f )", "@same(!t !f)"},
+
+		{"delimiters", "@delimiters( `$` `[` `]` `'` )$echo[ 'a'  1 ] @echo( 1 )", "@delimiters(`$` `[` `]` `'`)$echo['a' 1] @echo( 1 )"},
+		{"delimiters reset", "@delimiters(`$` `[` `]` `'`)$echo[ 1 ]$delimiters[]@echo( 2 )", "@delimiters(`$` `[` `]` `'`)$echo[1]$delimiters[]@echo(2)"},
+		{"comments with delimiters", "@delimiters(`$` `[` `]` `'`)$# c\n$echo[1 $* b *$ 2]", "@delimiters(`$` `[` `]` `'`)$# c\n$echo[1 $* b *$ 2]"},
+	}
+
+	for _, test := range tests {
+		got, err := Source(test.input, "test.cm", Options{})
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		if got != test.want {
+			t.Errorf("%s: Source(%q)\n got %q\nwant %q", test.name, test.input, got, test.want)
+			continue
+		}
+
+		again, err := Source(got, "test.cm", Options{})
+		if err != nil {
+			t.Errorf("%s: formatting the result: %v", test.name, err)
+			continue
+		}
+		if again != got {
+			t.Errorf("%s: not idempotent\nonce  %q\ntwice %q", test.name, got, again)
+		}
+	}
+}
+
+func TestSourceDelimitersOption(t *testing.T) {
+	delimiters, err := lexer.DefaultDelimiters().With([]string{"$", "[", "]", "'"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := Source("$echo[ 'a'  1 ] @echo( 1 )", "test.cm", Options{Delimiters: delimiters})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "$echo['a' 1] @echo( 1 )"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestSourceErrors(t *testing.T) {
+	tests := []struct {
+		input string
+		err   string
+	}{
+		{"@echo(1", "test.cm"},
+		{"@echo(`a)", "test.cm"},
+		{"@echo(1 @* open)", "test.cm"},
+	}
+
+	for _, test := range tests {
+		if got, err := Source(test.input, "test.cm", Options{}); err == nil || !strings.Contains(err.Error(), test.err) {
+			t.Errorf("Source(%q) = %q, %v; want an error mentioning %q", test.input, got, err, test.err)
+		}
+	}
+}
+
+func TestCheckMeaning(t *testing.T) {
+	source := "@echo(1 2)"
+	before, err := parse(source, "test.cm", lexer.DefaultDelimiters())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		result string
+		ok     bool
+	}{
+		{"@echo(1 2)", true},
+		{"@echo(\n  1\n  2)", true},
+		{"@echo(12)", false},
+		{"@echo(1 2) ", false},
+		{"@echo(1 `2`)", false},
+		{"@echo(1 2", false},
+	}
+
+	for _, test := range tests {
+		err := checkMeaning(before, test.result, "test.cm", lexer.DefaultDelimiters())
+		if test.ok && err != nil {
+			t.Errorf("%q: unexpected error %v", test.result, err)
+		}
+		if !test.ok && (err == nil || err.Error() != "test.cm: formatting would change the meaning of the template") {
+			t.Errorf("%q: error %v, want the meaning check to fail", test.result, err)
+		}
+	}
+}
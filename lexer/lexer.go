@@ -1,208 +1,756 @@
 package lexer
 
 import (
+	"fmt"
+	"io"
 	"strconv"
 	"strings"
-	"unicode"
+	"unicode/utf8"
 )
 
-type Lexer struct {
-	state LexerStatus
-	queue *TokenQueue
+// Options configures how a Lexer treats its input.
+type Options struct {
+	// TrimLines removes lines that hold nothing but directives and whitespace,
+	// including their newline, so that directives leave no blank lines behind.
+	TrimLines bool
+	// Delimiters replaces the default @ ( ) ` keywords; the zero value keeps them.
+	Delimiters Delimiters
+}
+
+// trimMode is the whitespace a finished directive removes from the text after it.
+type trimMode int
 
-	buffer  []string
-	results []LexerToken
+const (
+	trimNone    trimMode = iota
+	trimNewline          // only a newline right after the directive (@define, @include)
+	trimAll              // all whitespace and newlines (-))
+)
 
-	inDefine           bool
-	defineBracketLevel int
-	inInclude          bool
-	ignoreNextNewline  bool
+type Lexer struct {
+	state     LexerStatus
+	tokenizer *Tokenizer
+
+	buffer    []string
+	bufferPos Position
+
+	// results holds the tokens that are lexed but not yet returned by Next,
+	// from emitted on. Tokens of the current line can still change, see stable.
+	results  []LexerToken
+	emitted  int
+	finished bool
+
+	fileName string
+	options  Options
+
+	// The @delimiters directive switches the keyword set of the tokenizer
+	// for the rest of the input.
+	delimiters Delimiters
+	keywords   KeywordMatchingItem
+	inverted   InvertedKeywordMatchingItem
+	active     *Delimiters // given to the tokens lexed with delimiters
+
+	// depth counts the open brackets of the current directive; when it drops
+	// back to 0 the lexer returns to normal text.
+	depth          int
+	directive      TokenType
+	directiveStart int // index of the directive keyword in results
+	trimNext       trimMode
+
+	// Line tracking for Options.TrimLines: results from lineStart on belong to
+	// the current line of normal text.
+	lineStart        int
+	lineHasDirective bool
+	lineHasText      bool
+
+	// comment is COMMENT_LINE or COMMENT_BLOCK_OPEN while inside a comment.
+	comment       TokenType
+	commentPos    Position
+	commentOnLine bool // the line comment is the only thing on its line
+
+	rawStart bool // a newline right after an opening ``` is dropped
+	verbatim bool // between VERBATIM_OPEN and VERBATIM_CLOSE
 }
 
 func NewLexer() *Lexer {
 	lex := new(Lexer)
 	lex.state = STATE_NORMSTRINGS
 	lex.results = make([]LexerToken, 0)
-	lex.inDefine = false
-	lex.defineBracketLevel = 0
-	lex.inInclude = false
-	lex.ignoreNextNewline = false
+	lex.depth = 0
+	lex.trimNext = trimNone
+	lex.setDelimiters(DefaultDelimiters())
 
 	return lex
 }
 
-func (l *Lexer) DoLex(input string) []LexerToken {
-	raw_tokens := NewTokenizer().doTokenize(input, uint64(len(input)))
-	l.queue = NewTokenQueue(raw_tokens, int64(len(raw_tokens)))
+// NewLexerWithFile creates a Lexer whose token positions refer to fileName.
+func NewLexerWithFile(fileName string) *Lexer {
+	lex := NewLexer()
+	lex.fileName = fileName
+
+	return lex
+}
+
+// NewLexerWithOptions creates a Lexer for fileName with the given options.
+func NewLexerWithOptions(fileName string, options Options) *Lexer {
+	lex := NewLexerWithFile(fileName)
+	lex.options = options
+	if options.Delimiters != (Delimiters{}) {
+		if err := options.Delimiters.Validate(); err != nil {
+			panic(err.Error())
+		}
+		lex.setDelimiters(options.Delimiters)
+	}
 
+	return lex
+}
+
+func (l *Lexer) setDelimiters(d Delimiters) {
+	l.delimiters = d
+	l.active = &d
+	l.keywords = d.Keywords()
+	l.inverted = l.keywords.Invert()
+}
+
+// SetInput makes r the input of the lexer. Its tokens are read on demand by Next.
+func (l *Lexer) SetInput(r io.Reader) {
+	l.tokenizer = NewTokenizerWithKeywords(r, l.keywords, Position{File: l.fileName, Line: 1, Column: 1})
 	l.buffer = make([]string, 0)
+}
 
-	for !l.queue.IsEmpty() {
-		symbol := l.queue.Pop()
+// Err returns the error that stopped reading the input, if any.
+func (l *Lexer) Err() error {
+	if l.tokenizer == nil {
+		return nil
+	}
+	return l.tokenizer.Err()
+}
+
+// DoLex lexes a whole input at once.
+func (l *Lexer) DoLex(input string) []LexerToken {
+	l.SetInput(strings.NewReader(input))
+
+	tokens := make([]LexerToken, 0)
+	for {
+		token := l.Next()
+		tokens = append(tokens, token)
+		if token.Type == TERMINATOR {
+			return tokens
+		}
+	}
+}
 
-		if l.ignoreNextNewline && symbol.GetType() != NEWLINE {
-			l.ignoreNextNewline = false
+// Next returns the next token of the input set with SetInput, reading only as
+// much input as it needs. After the last token it keeps returning TERMINATOR.
+func (l *Lexer) Next() LexerToken {
+	for l.emitted >= l.stable() {
+		if l.finished {
+			token := NewLexerToken(TERMINATOR, NewData(), l.tokenizer.currentPos())
+			token.Delimiters = l.active
+			return token
 		}
+		l.lexToken(l.tokenizer.Next())
+	}
 
-		switch symbol.GetType() {
-		case KEYWORD_CALL:
-			if l.state == STATE_STRINGVALUE {
-				l.buffer = append(l.buffer, InvertedKeywordMap[symbol.token_type])
-				continue
-			}
-			l.flushBuffer()
-			l.results = append(l.results, NewLexerToken(symbol.token_type, NewData()))
-			l.state = STATE_OBJNAME
+	token := l.results[l.emitted]
+	l.emitted++
+	if l.emitted == len(l.results) {
+		l.discardEmitted()
+	}
+	return token
+}
 
-		case KEYWORD_DEFINE:
-			if l.state == STATE_STRINGVALUE {
-				l.buffer = append(l.buffer, InvertedKeywordMap[symbol.token_type])
-				continue
-			}
-			l.flushBuffer()
-			l.results = append(l.results, NewLexerToken(symbol.token_type, NewData()))
-			l.inDefine = true
+// stable is the number of results that no later token can change: the
+// lines before the current one, except for text a trimming directive could
+// still shorten.
+func (l *Lexer) stable() int {
+	if l.finished {
+		return len(l.results)
+	}
+	n := l.lineStart
+	if n > 0 && l.results[n-1].Type == NORM_STRINGS {
+		n--
+	}
+	return n
+}
+
+// discardEmitted forgets the results that Next returned already.
+func (l *Lexer) discardEmitted() {
+	l.lineStart -= l.emitted
+	l.directiveStart -= l.emitted
+	l.results = l.results[:copy(l.results, l.results[l.emitted:])]
+	l.emitted = 0
+}
 
-		case KEYWORD_INCLUDE:
-			if l.state == STATE_STRINGVALUE {
-				l.buffer = append(l.buffer, InvertedKeywordMap[symbol.token_type])
-				continue
+// lexToken lexes one token of the tokenizer into results.
+func (l *Lexer) lexToken(symbol Token) {
+	defer func() {
+		// Tokens are only added at the end, so the new ones are the last
+		// without delimiters.
+		for i := len(l.results) - 1; i >= 0 && l.results[i].Delimiters == nil; i-- {
+			l.results[i].Delimiters = l.active
+		}
+	}()
+
+	switch {
+	case l.comment != 0:
+		l.lexComment(symbol)
+	case l.state == STATE_RAWSTRING && symbol.GetType() != RAW_STRING_MARK && symbol.GetType() != TERMINATOR:
+		if !(l.rawStart && symbol.GetType() == NEWLINE) {
+			l.pushBuffer(symbol.GetData(), symbol.GetPos())
+		}
+		l.rawStart = false
+	case l.state == STATE_STRINGVALUE && symbol.GetType() != STRING_QUOTEMARK && symbol.GetType() != RAW_STRING_MARK && symbol.GetType() != TERMINATOR:
+		// Inside a backtick string every token is literal text.
+		l.pushBuffer(symbol.GetData(), symbol.GetPos())
+	case l.state == STATE_NORMSTRINGS:
+		l.lexText(symbol)
+	default:
+		l.lexDirective(symbol)
+	}
+
+	if symbol.GetType() == TERMINATOR {
+		l.finished = true
+	}
+}
+
+// lexText handles a token of normal text, outside of any directive.
+func (l *Lexer) lexText(symbol Token) {
+	if l.applyTrim(symbol) {
+		return
+	}
+
+	switch symbol.GetType() {
+	case KEYWORD_CALL, KEYWORD_DEFINE, KEYWORD_INCLUDE,
+		KEYWORD_CALL_TRIM, KEYWORD_DEFINE_TRIM, KEYWORD_INCLUDE_TRIM:
+		l.flushBuffer()
+		if trimBefore(symbol.GetType()) {
+			l.trimPrecedingText()
+		}
+
+		l.directive = plainType(symbol.GetType())
+		l.directiveStart = len(l.results)
+		l.results = append(l.results, NewLexerToken(l.directive, NewData(), symbol.GetPos()))
+		l.state = STATE_OBJNAME
+		l.lineHasDirective = true
+
+	case COMMENT_LINE, COMMENT_BLOCK_OPEN:
+		l.flushBuffer()
+		l.startComment(symbol)
+
+	case COMMENT_BLOCK_CLOSE:
+		// Not in a comment: it is text followed by a call, as in @a()*@b().
+		l.lineHasText = true
+		l.pushBuffer("*", symbol.GetPos())
+		l.lexText(l.splitCommentClose(symbol))
+
+	case KEYWORD_ESCAPE:
+		l.lineHasText = true
+		l.pushBuffer(l.delimiters.Call, symbol.GetPos())
+
+	case VERBATIM_OPEN:
+		l.verbatim = true
+		l.lineHasDirective = true
+
+	case VERBATIM:
+		// Like a raw string, a newline right after the opening keyword is dropped.
+		text := symbol.GetData()
+		opening := true
+		if strings.HasPrefix(text, "\r\n") {
+			text = text[2:]
+		} else if strings.HasPrefix(text, "\n") {
+			text = text[1:]
+		} else {
+			opening = false
+		}
+		if opening && l.lineIsDirectiveOnly() {
+			l.dropLineWhitespace()
+			l.startLine()
+		}
+		l.lexVerbatim(text, symbol.GetPos())
+
+	case VERBATIM_CLOSE:
+		l.closeVerbatim(symbol)
+		l.lineHasDirective = true
+		l.trimNext = trimNewline
+
+	case NEWLINE:
+		l.endLine(symbol)
+
+	case TERMINATOR:
+		if l.lineIsDirectiveOnly() {
+			l.dropLineWhitespace()
+		}
+		l.flushBuffer()
+		l.results = append(l.results, NewLexerToken(TERMINATOR, NewData(), symbol.GetPos()))
+
+	default:
+		// Brackets, backticks and !t/!f are plain text outside of a directive.
+		if strings.TrimSpace(symbol.GetData()) != "" {
+			l.lineHasText = true
+		}
+		l.pushBuffer(symbol.GetData(), symbol.GetPos())
+	}
+}
+
+// lexDirective handles a token between a directive keyword and its closing bracket.
+func (l *Lexer) lexDirective(symbol Token) {
+	switch symbol.GetType() {
+	case KEYWORD_CALL, KEYWORD_DEFINE, KEYWORD_INCLUDE,
+		KEYWORD_CALL_TRIM, KEYWORD_DEFINE_TRIM, KEYWORD_INCLUDE_TRIM:
+		l.flushBuffer()
+		l.results = append(l.results, NewLexerToken(plainType(symbol.GetType()), NewData(), symbol.GetPos()))
+
+	case KEYWORD_BRACKET_OPEN:
+		l.depth++
+		l.results = append(l.results, NewLexerToken(symbol.token_type, NewData(), symbol.GetPos()))
+
+	case KEYWORD_BRACKET_CLOSE, KEYWORD_BRACKET_CLOSE_TRIM:
+		l.results = append(l.results, NewLexerToken(KEYWORD_BRACKET_CLOSE, NewData(), symbol.GetPos()))
+		l.depth--
+		if l.depth > 0 {
+			return
+		}
+
+		// The directive is complete; what follows is normal text again.
+		l.depth = 0
+		l.state = STATE_NORMSTRINGS
+		switch {
+		case symbol.GetType() == KEYWORD_BRACKET_CLOSE_TRIM:
+			l.trimNext = trimAll
+		case l.directive == KEYWORD_DEFINE || l.directive == KEYWORD_INCLUDE:
+			l.trimNext = trimNewline
+		}
+		l.changeDelimiters()
+
+	case STRING_QUOTEMARK:
+		if l.state != STATE_STRINGVALUE {
+			l.flushBuffer()
+			l.state = STATE_STRINGVALUE
+		} else if l.quoteIsEscaped() {
+			l.pushBuffer(symbol.GetData(), symbol.GetPos())
+		} else {
+			if len(l.buffer) == 0 {
+				// `` is an empty string argument, not nothing.
+				l.results = append(l.results, NewLexerToken(VALUE, NewStrData(""), symbol.GetPos()))
 			}
 			l.flushBuffer()
-			l.results = append(l.results, NewLexerToken(symbol.token_type, NewData()))
-			l.inInclude = true
+			l.state = STATE_OBJNAME
+		}
 
-		case KEYWORD_BRACKET_OPEN:
-			if l.state == STATE_STRINGVALUE {
-				l.buffer = append(l.buffer, InvertedKeywordMap[symbol.token_type])
-				continue
+	case RAW_STRING_MARK:
+		switch l.state {
+		case STATE_STRINGVALUE:
+			// Three backticks inside a string are three separate quote marks.
+			for i := 0; i < 3; i++ {
+				pos := symbol.GetPos()
+				pos.Column += i * utf8.RuneCountInString(l.delimiters.Quote)
+				l.lexDirective(Token{token_type: STRING_QUOTEMARK, token_data: l.delimiters.Quote, pos: pos})
 			}
-			if l.inDefine {
-				l.defineBracketLevel++
+		case STATE_RAWSTRING:
+			if len(l.buffer) == 0 {
+				l.results = append(l.results, NewLexerToken(VALUE, NewStrData(""), symbol.GetPos()))
 			}
-			l.results = append(l.results, NewLexerToken(symbol.token_type, NewData()))
+			l.flushBuffer()
 			l.state = STATE_OBJNAME
+		default:
+			l.flushBuffer()
+			l.state = STATE_RAWSTRING
+			l.rawStart = true
+		}
 
-		case KEYWORD_BRACKET_CLOSE:
-			if l.state == STATE_STRINGVALUE {
-				l.buffer = append(l.buffer, InvertedKeywordMap[symbol.token_type])
-				continue
-			}
-			l.results = append(l.results, NewLexerToken(symbol.token_type, NewData()))
-			next := l.queue.Pop()
-			l.queue.Pushback()
-
-			if next.GetType() == WHITESPACE {
-				l.state = STATE_OBJNAME
-			} else {
-				l.state = STATE_NORMSTRINGS
-			}
-			if l.inDefine {
-				l.defineBracketLevel--
-				if l.defineBracketLevel == 0 {
-					l.inDefine = false // End of define block
-					l.ignoreNextNewline = true
-				}
-			}
-			if l.inInclude {
-				l.inInclude = false
-				l.ignoreNextNewline = true
-			}
+	case BOOLEAN_TRUE, BOOLEAN_FALSE:
+		l.results = append(l.results, NewLexerToken(VALUE, NewBoolData(symbol.token_type == BOOLEAN_TRUE), symbol.GetPos()))
 
-		case STRING_QUOTEMARK:
-			if l.state != STATE_STRINGVALUE {
-				l.flushBuffer()
-				l.state = STATE_STRINGVALUE
-			} else {
-				l.flushBuffer()
-				l.state = STATE_OBJNAME
-			}
+	case KEYWORD_ESCAPE:
+		l.flushBuffer()
+		l.results = append(l.results, NewLexerToken(VALUE, NewStrData(l.delimiters.Call), symbol.GetPos()))
 
-		case BOOLEAN_TRUE, BOOLEAN_FALSE:
-			if l.state == STATE_STRINGVALUE {
-				l.buffer = append(l.buffer, InvertedKeywordMap[symbol.token_type])
-				continue
-			}
-			var data bool
-			switch symbol.token_type {
-			case BOOLEAN_TRUE:
-				data = true
+	case VERBATIM_OPEN:
+		l.flushBuffer()
+		l.verbatim = true
 
-			case BOOLEAN_FALSE:
-				data = false
-			}
+	case VERBATIM:
+		l.results = append(l.results, NewLexerToken(VALUE, NewStrData(symbol.GetData()), symbol.GetPos()))
 
-			l.results = append(l.results, NewLexerToken(VALUE, NewBoolData(data)))
+	case VERBATIM_CLOSE:
+		l.closeVerbatim(symbol)
 
-		case WHITESPACE, NEWLINE:
-			if l.ignoreNextNewline && symbol.GetType() == NEWLINE {
-				l.ignoreNextNewline = false
-				continue
-			}
-			if l.state == STATE_STRINGVALUE || l.state == STATE_NORMSTRINGS {
-				l.buffer = append(l.buffer, InvertedKeywordMap[symbol.token_type])
-				continue
-			}
+	case WHITESPACE, NEWLINE:
+		l.flushBuffer()
 
-			//l.results = append(l.results, NewLexerToken(symbol.token_type, NewData()))
+	case COMMENT_LINE, COMMENT_BLOCK_OPEN:
+		// A comment separates arguments like whitespace.
+		l.flushBuffer()
+		l.startComment(symbol)
 
-			l.flushBuffer()
+	case COMMENT_BLOCK_CLOSE:
+		l.results = append(l.results, NewLexerToken(VALUE, l.getValues("*", symbol.GetPos()), symbol.GetPos()))
+		l.lexDirective(l.splitCommentClose(symbol))
 
-		case NORM_STRINGS:
-			if l.state == STATE_STRINGVALUE || l.state == STATE_NORMSTRINGS {
-				l.buffer = append(l.buffer, symbol.GetData())
-				continue
-			}
+	case NORM_STRINGS:
+		l.results = append(l.results, NewLexerToken(VALUE, l.getValues(symbol.GetData(), symbol.GetPos()), symbol.GetPos()))
 
-			//if l.state == STATE_OBJNAME {
-			//	l.results = append(l.results, NewLexerToken(VALUE, NewObjNameData(symbol.GetData())))
-			//	continue
-			//}
+	case TERMINATOR:
+		l.flushBuffer()
+		l.results = append(l.results, NewLexerToken(TERMINATOR, NewData(), symbol.GetPos()))
+	}
+}
 
-			l.results = append(l.results, NewLexerToken(VALUE, l.getValues(symbol.GetData())))
+// changeDelimiters carries out a finished @delimiters(call open close quote)
+// directive: it is removed from the results and the tokenizer reads the rest
+// of the input with the new keyword set. Without arguments the default
+// delimiters come back, like M4's changequote.
+func (l *Lexer) changeDelimiters() {
+	directive := l.results[l.directiveStart:]
+	if l.directive != KEYWORD_CALL || len(directive) < 4 ||
+		directive[1].Type != VALUE || directive[1].Data.Type != DATA_OBJNAME || directive[1].Data.ObjNameData != "delimiters" ||
+		directive[2].Type != KEYWORD_BRACKET_OPEN {
+		return
+	}
 
-		case TERMINATOR:
-			l.flushBuffer()
-			l.results = append(l.results, NewLexerToken(TERMINATOR, NewData()))
+	spellings := make([]string, 0)
+	for _, arg := range directive[3 : len(directive)-1] {
+		switch {
+		case arg.Type == VALUE && arg.Data.Type == DATA_STR:
+			spellings = append(spellings, arg.Data.StrData)
+		case arg.Type == VALUE && arg.Data.Type == DATA_OBJNAME:
+			spellings = append(spellings, arg.Data.ObjNameData)
+		default:
+			panic(fmt.Sprintf("%s: delimiters takes plain words or strings", arg.Pos))
 		}
 	}
 
-	return l.results
+	delimiters := DefaultDelimiters()
+	if len(spellings) > 0 {
+		var err error
+		if delimiters, err = l.delimiters.With(spellings); err != nil {
+			panic(fmt.Sprintf("%s: %s", directive[0].Pos, err))
+		}
+	}
+
+	l.results = l.results[:l.directiveStart]
+	if l.lineStart > len(l.results) {
+		l.lineStart = len(l.results)
+	}
+	l.trimNext = trimNewline
+	l.setDelimiters(delimiters)
+	l.tokenizer.SetKeywords(l.keywords)
 }
 
-func (l *Lexer) getValues(data string) LexerTokenData {
-	isInt := true
-	isReal := true
-	decimalPointCount := 0
+func (l *Lexer) closeVerbatim(symbol Token) {
+	if !l.verbatim {
+		panic(fmt.Sprintf("%s: unexpected '%s' outside of a verbatim region", symbol.GetPos(), symbol.GetData()))
+	}
+	l.verbatim = false
+}
+
+// lexVerbatim adds the body of a verbatim region to the text. For TrimLines
+// the whitespace after its last newline starts the line of the closing
+// keyword, so that a line holding only '@endverbatim' disappears.
+func (l *Lexer) lexVerbatim(text string, pos Position) {
+	tail := ""
+	if end := strings.LastIndex(text, "\n"); l.options.TrimLines && end >= 0 &&
+		strings.TrimLeft(text[end+1:], " \t") == "" {
+		text, tail = text[:end+1], text[end+1:]
+	}
+	if text != "" {
+		l.lineHasText = true
+		l.pushBuffer(text, pos)
+	}
+	if tail != "" || (l.options.TrimLines && strings.HasSuffix(text, "\n")) {
+		l.flushBuffer()
+		l.startLine()
+		l.pushBuffer(tail, pos)
+	}
+}
+
+// splitCommentClose returns the call keyword of a '*@' token found outside of a comment.
+func (l *Lexer) splitCommentClose(symbol Token) Token {
+	pos := symbol.GetPos()
+	pos.Column++
+	return Token{token_type: KEYWORD_CALL, token_data: l.delimiters.Call, pos: pos}
+}
 
-	for _, r := range data {
-		if !unicode.IsDigit(r) {
-			isInt = false
+func (l *Lexer) startComment(symbol Token) {
+	l.comment = symbol.GetType()
+	l.commentPos = symbol.GetPos()
+
+	if l.state != STATE_NORMSTRINGS {
+		return
+	}
+	if l.comment == COMMENT_LINE {
+		l.commentOnLine = !l.lineHasText && !l.lineHasDirective
+	} else {
+		// For TrimLines a block comment counts as a directive.
+		l.lineHasDirective = true
+	}
+}
+
+// lexComment skips a token inside a comment.
+func (l *Lexer) lexComment(symbol Token) {
+	switch {
+	case l.comment == COMMENT_LINE && symbol.GetType() == NEWLINE:
+		l.comment = 0
+		if l.state == STATE_NORMSTRINGS {
+			// The newline goes with the comment; a line that held nothing
+			// else disappears completely.
+			if l.commentOnLine || l.lineIsDirectiveOnly() {
+				l.dropLineIndent()
+			}
+			l.startLine()
+		}
+
+	case l.comment == COMMENT_LINE && symbol.GetType() == TERMINATOR:
+		l.comment = 0
+		if l.state == STATE_NORMSTRINGS && l.commentOnLine {
+			l.dropLineIndent()
+		}
+		if l.state == STATE_NORMSTRINGS {
+			l.lexText(symbol)
+		} else {
+			l.lexDirective(symbol)
+		}
+
+	case l.comment == COMMENT_BLOCK_OPEN && symbol.GetType() == COMMENT_BLOCK_CLOSE:
+		l.comment = 0
+
+	case symbol.GetType() == TERMINATOR:
+		panic(fmt.Sprintf("%s: unterminated comment, expected '%s'", l.commentPos, l.inverted[COMMENT_BLOCK_CLOSE]))
+	}
+}
+
+// dropLineIndent removes the whitespace that precedes a comment on its line.
+func (l *Lexer) dropLineIndent() {
+	l.flushBuffer()
+	if l.options.TrimLines {
+		l.dropLineWhitespace()
+		return
+	}
+
+	last := len(l.results) - 1
+	if last < l.lineStart || last < 0 || l.results[last].Type != NORM_STRINGS {
+		return
+	}
+	text := strings.TrimRight(l.results[last].Data.NormData, " \t\r")
+	if text == "" {
+		l.results = l.results[:last]
+		return
+	}
+	l.results[last].Data.NormData = text
+}
+
+// plainType maps the trim variants of the directive keywords to their plain forms.
+func plainType(t TokenType) TokenType {
+	switch t {
+	case KEYWORD_CALL_TRIM:
+		return KEYWORD_CALL
+	case KEYWORD_DEFINE_TRIM:
+		return KEYWORD_DEFINE
+	case KEYWORD_INCLUDE_TRIM:
+		return KEYWORD_INCLUDE
+	case KEYWORD_BRACKET_CLOSE_TRIM:
+		return KEYWORD_BRACKET_CLOSE
+	}
+	return t
+}
+
+func trimBefore(t TokenType) bool {
+	return t == KEYWORD_CALL_TRIM || t == KEYWORD_DEFINE_TRIM || t == KEYWORD_INCLUDE_TRIM
+}
+
+// applyTrim drops whitespace requested by the directive before symbol and
+// reports whether symbol was consumed entirely.
+func (l *Lexer) applyTrim(symbol Token) bool {
+	mode := l.trimNext
+	if mode == trimNone {
+		return false
+	}
+
+	switch symbol.GetType() {
+	case NEWLINE:
+		if mode == trimNewline {
+			l.trimNext = trimNone
+		}
+		if l.lineIsDirectiveOnly() {
+			l.dropLineWhitespace()
+		}
+		l.startLine()
+		return true
+	case WHITESPACE:
+		if mode == trimAll {
+			return true
+		}
+	case NORM_STRINGS:
+		if mode == trimAll {
+			rest := strings.TrimLeft(symbol.GetData(), " \t\r\n")
+			if rest == "" {
+				return true
+			}
+			l.trimNext = trimNone
+			l.lineHasText = true
+			l.pushBuffer(rest, symbol.GetPos())
+			return true
 		}
-		if r == '.' {
-			decimalPointCount++
-		} else if !unicode.IsDigit(r) {
-			isReal = false
+	}
+
+	l.trimNext = trimNone
+	return false
+}
+
+// trimPrecedingText removes the whitespace at the end of the text before a
+// trimming directive.
+func (l *Lexer) trimPrecedingText() {
+	last := len(l.results) - 1
+	if last < 0 || l.results[last].Type != NORM_STRINGS {
+		return
+	}
+
+	text := strings.TrimRight(l.results[last].Data.NormData, " \t\r\n")
+	if text == "" {
+		l.results = l.results[:last]
+		if l.lineStart > len(l.results) {
+			l.lineStart = len(l.results)
 		}
+		return
 	}
+	l.results[last].Data.NormData = text
+}
 
-	if isInt {
-		d, err := strconv.ParseInt(data, 10, 64)
-		if err == nil {
-			return NewIntData(d)
+func (l *Lexer) startLine() {
+	l.lineStart = len(l.results)
+	l.lineHasDirective = false
+	l.lineHasText = false
+}
+
+func (l *Lexer) lineIsDirectiveOnly() bool {
+	return l.options.TrimLines && l.lineHasDirective && !l.lineHasText
+}
+
+// dropLineWhitespace removes the whitespace-only text of the current line.
+func (l *Lexer) dropLineWhitespace() {
+	l.buffer = l.buffer[:0]
+
+	kept := l.results[:l.lineStart]
+	for _, token := range l.results[l.lineStart:] {
+		if token.Type != NORM_STRINGS {
+			kept = append(kept, token)
 		}
 	}
+	l.results = kept
+}
 
-	if isReal && decimalPointCount == 1 {
-		d, err := strconv.ParseFloat(data, 64)
-		if err == nil {
-			return NewRealData(d)
+// endLine finishes a line of normal text at a newline.
+func (l *Lexer) endLine(newline Token) {
+	if l.lineIsDirectiveOnly() {
+		l.dropLineWhitespace()
+	} else {
+		l.pushBuffer(newline.GetData(), newline.GetPos())
+		if l.options.TrimLines {
+			// Keep every line in its own text token, so a following
+			// directive-only line can be removed without touching this one.
+			l.flushBuffer()
 		}
 	}
+	l.startLine()
+}
 
+// InferValue interprets a bare word the way the lexer does inside a call:
+// numeric literals and !t/!f become typed values, anything else an object name.
+// A number out of range stays a word, since there is no position to report.
+func InferValue(data string) LexerTokenData {
+	switch KeywordMap[data] {
+	case BOOLEAN_TRUE:
+		return NewBoolData(true)
+	case BOOLEAN_FALSE:
+		return NewBoolData(false)
+	}
+	if value, ok, err := parseNumber(data); ok && err == nil {
+		return value
+	}
 	return NewObjNameData(data)
 }
 
+// getValues turns a word inside a call into a number or an object name.
+func (l *Lexer) getValues(data string, pos Position) LexerTokenData {
+	value, ok, err := parseNumber(data)
+	if err != nil {
+		panic(fmt.Sprintf("%s: %s", pos, err))
+	}
+	if ok {
+		return value
+	}
+	return NewObjNameData(data)
+}
+
+// quoteIsEscaped reports whether the string buffer ends in an odd number of
+// backslashes, making the next backtick part of the string.
+func (l *Lexer) quoteIsEscaped() bool {
+	text := strings.Join(l.buffer, "")
+	count := 0
+	for i := len(text) - 1; i >= 0 && text[i] == '\\'; i-- {
+		count++
+	}
+	return count%2 == 1
+}
+
+// unescapeString processes the escape sequences of a backtick string: \n, \t,
+// \r, \\, \u{hex} and a backslash before the quote delimiter. Other
+// backslashes are kept as they are, so that regular expressions such as \d+
+// keep working.
+func unescapeString(s string, quote string) (string, error) {
+	if !strings.Contains(s, "\\") {
+		return s, nil
+	}
+
+	var sb strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] != '\\' || i+1 >= len(s) {
+			sb.WriteByte(s[i])
+			continue
+		}
+
+		i++
+		if strings.HasPrefix(s[i:], quote) {
+			sb.WriteString(quote)
+			i += len(quote) - 1
+			continue
+		}
+		switch s[i] {
+		case 'n':
+			sb.WriteByte('\n')
+		case 't':
+			sb.WriteByte('\t')
+		case 'r':
+			sb.WriteByte('\r')
+		case '\\':
+			sb.WriteByte('\\')
+		case 'u':
+			end := strings.IndexByte(s[i:], '}')
+			if i+1 >= len(s) || s[i+1] != '{' || end < 0 {
+				return "", fmt.Errorf("invalid escape sequence, expected \\u{hex}")
+			}
+			hex := s[i+2 : i+end]
+			code, err := strconv.ParseUint(hex, 16, 32)
+			if err != nil || hex == "" || !utf8.ValidRune(rune(code)) {
+				return "", fmt.Errorf("invalid escape sequence \\u{%s}", hex)
+			}
+			sb.WriteRune(rune(code))
+			i += end
+		default:
+			sb.WriteByte('\\')
+			sb.WriteByte(s[i])
+		}
+	}
+	return sb.String(), nil
+}
+
+func (l *Lexer) pushBuffer(data string, pos Position) {
+	if len(l.buffer) == 0 {
+		l.bufferPos = pos
+	}
+	l.buffer = append(l.buffer, data)
+}
+
 func (l *Lexer) flushBuffer() {
 	buffer_d := strings.Join(l.buffer, "")
 	var data LexerTokenData
@@ -215,6 +763,15 @@ func (l *Lexer) flushBuffer() {
 
 	switch l.state {
 	case STATE_STRINGVALUE:
+		l.buffer = l.buffer[:0]
+		unescaped, err := unescapeString(buffer_d, l.delimiters.Quote)
+		if err != nil {
+			panic(fmt.Sprintf("%s: %s", l.bufferPos, err))
+		}
+		data = NewStrData(unescaped)
+		tokentype = VALUE
+
+	case STATE_RAWSTRING:
 		l.buffer = l.buffer[:0]
 		data = NewStrData(buffer_d)
 		tokentype = VALUE
@@ -225,5 +782,5 @@ func (l *Lexer) flushBuffer() {
 		tokentype = NORM_STRINGS
 	}
 
-	l.results = append(l.results, NewLexerToken(tokentype, data))
+	l.results = append(l.results, NewLexerToken(tokentype, data, l.bufferPos))
 }
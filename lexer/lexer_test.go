@@ -0,0 +1,301 @@
+package lexer
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+	"testing/iotest"
+)
+
+// lexText lexes input and returns its text with every call written as @, so
+// that tests can see what comments and trimming leave of the text around
+// directives.
+func lexText(input string, options Options) (result string, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("%v", r)
+		}
+	}()
+
+	var sb strings.Builder
+	for _, token := range NewLexerWithOptions("test.cm", options).DoLex(input) {
+		switch token.Type {
+		case NORM_STRINGS:
+			sb.WriteString(token.Data.NormData)
+		case KEYWORD_CALL:
+			sb.WriteString("@")
+		}
+	}
+	return sb.String(), nil
+}
+
+func TestComments(t *testing.T) {
+	tests := []struct {
+		input string
+		want  string
+		err   string
+	}{
+		{"a @# line comment\nb", "a b", ""},
+		{"@# whole line\nb", "b", ""},
+		{"a\n  @# indented whole line\nb", "a\nb", ""},
+		{"a @* block *@ b", "a  b", ""},
+		{"a @* multi\nline\nblock *@b", "a b", ""},
+		{"a @* @echo(1) *@b", "a b", ""},
+		{"@echo(1 @# comment\n2)", "@", ""},
+		{"@echo(1 @* comment *@ 2)", "@", ""},
+		{"a @@# not a comment", "a @# not a comment", ""},
+		{"a @* unterminated", "", "test.cm:1:3: unterminated comment, expected '*@'"},
+	}
+
+	for _, test := range tests {
+		got, err := lexText(test.input, Options{})
+		if test.err != "" {
+			if err == nil || err.Error() != test.err {
+				t.Errorf("%q: error %v, want %q", test.input, err, test.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: unexpected error %v", test.input, err)
+			continue
+		}
+		if got != test.want {
+			t.Errorf("%q: got %q, want %q", test.input, got, test.want)
+		}
+	}
+}
+
+func TestTrimMarkers(t *testing.T) {
+	tests := []struct {
+		input     string
+		trimLines bool
+		want      string
+	}{
+		{"a  \n  @-echo(1)", false, "a@"},
+		{"@echo(1 -)  \n  b", false, "@b"},
+		{"a \n @-echo(1 -) \n b", false, "a@b"},
+		{"a @echo(1) b", false, "a @ b"},
+		{"a @echo(1 - 2) b", false, "a @ b"},
+		{"a\n@-define(x 1 -)\nb", false, "ab"},
+
+		{"a\n  @echo(1)  \nb", true, "a\n@b"},
+		{"a\n  @define(x 1)\nb", true, "a\nb"},
+		{"a\n  @echo(1) text\nb", true, "a\n  @ text\nb"},
+		{"a\n\nb", true, "a\n\nb"},
+	}
+
+	for _, test := range tests {
+		got, err := lexText(test.input, Options{TrimLines: test.trimLines})
+		if err != nil {
+			t.Errorf("%q: unexpected error %v", test.input, err)
+			continue
+		}
+		if got != test.want {
+			t.Errorf("%q (trimlines %t): got %q, want %q", test.input, test.trimLines, got, test.want)
+		}
+	}
+}
+
+func TestEscapeAndVerbatim(t *testing.T) {
+	tests := []struct {
+		input     string
+		trimLines bool
+		want      string
+		err       string
+	}{
+		{"@@echo(1)", false, "@echo(1)", ""},
+		{"a @@define(x 1) b", false, "a @define(x 1) b", ""},
+		{"user@@example.com", false, "user@example.com", ""},
+		{"a@@@echo(1)b", false, "a@@b", ""},
+		{"@@verbatim x", false, "@verbatim x", ""},
+
+		{"@verbatim\n@echo(1) @define(x 1) @include(`a.cm`) @# c @* b *@ @@ `q`\n@endverbatim\nafter", false,
+			"@echo(1) @define(x 1) @include(`a.cm`) @# c @* b *@ @@ `q`\nafter", ""},
+		{"a @verbatim x @endverbatim b", false, "a  x  b", ""},
+		{"@verbatim\r\n@x\r\n@endverbatim\r\nb", false, "@x\r\nb", ""},
+		{"@echo(@verbatim ) ( @endverbatim)", false, "@", ""},
+		// The body ends at the first closing keyword, even after @@.
+		{"a @verbatim @@endverbatim b", false, "a  @ b", ""},
+
+		{"a @verbatim oops", false, "", "test.cm:1:3: unterminated verbatim region, expected '@endverbatim'"},
+		{"a @endverbatim", false, "", "test.cm:1:3: unexpected '@endverbatim' outside of a verbatim region"},
+
+		// Lines that hold only the keywords disappear with -trimlines; the
+		// body itself is never trimmed.
+		{"a\n  @verbatim\n  @x\n\n  @endverbatim\nb", false, "a\n    @x\n\n  b", ""},
+		{"a\n  @verbatim\n  @x\n\n  @endverbatim\nb", true, "a\n  @x\n\nb", ""},
+		{"a\n  @verbatim\n  @x\n  @endverbatim", true, "a\n  @x\n", ""},
+		{"a\n  @verbatim\n  @x\n  @endverbatim y\nb", true, "a\n  @x\n   y\nb", ""},
+		{"a\n  @verbatim  @x  @endverbatim  \nb", true, "a\n    @x    \nb", ""},
+		{"a @verbatim\n@x\n@endverbatim\nb", true, "a @x\nb", ""},
+	}
+
+	for _, test := range tests {
+		got, err := lexText(test.input, Options{TrimLines: test.trimLines})
+		if test.err != "" {
+			if err == nil || err.Error() != test.err {
+				t.Errorf("%q: error %v, want %q", test.input, err, test.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: unexpected error %v", test.input, err)
+			continue
+		}
+		if got != test.want {
+			t.Errorf("%q (trimlines %t): got %q, want %q", test.input, test.trimLines, got, test.want)
+		}
+	}
+}
+
+func TestUnescapeString(t *testing.T) {
+	tests := []struct {
+		input string
+		quote string
+		want  string
+		err   string
+	}{
+		{`plain`, "`", "plain", ""},
+		{`a\nb\tc\rd`, "`", "a\nb\tc\rd", ""},
+		{`back\\slash`, "`", `back\slash`, ""},
+		{"a\\`b", "`", "a`b", ""},
+		{`a\"b`, `"`, `a"b`, ""},
+		{"a\\''b", "''", "a''b", ""},
+		{`\u{41}\u{e9}\u{1F600}`, "`", "Aé😀", ""},
+		{`\d+\.\w`, "`", `\d+\.\w`, ""},
+		{`trailing\`, "`", `trailing\`, ""},
+		{`\u41`, "`", "", `invalid escape sequence, expected \u{hex}`},
+		{`\u{}`, "`", "", `invalid escape sequence \u{}`},
+		{`\u{zz}`, "`", "", `invalid escape sequence \u{zz}`},
+		{`\u{D800}`, "`", "", `invalid escape sequence \u{D800}`},
+		{`\u{110000}`, "`", "", `invalid escape sequence \u{110000}`},
+	}
+
+	for _, test := range tests {
+		got, err := unescapeString(test.input, test.quote)
+		if test.err != "" {
+			if err == nil || err.Error() != test.err {
+				t.Errorf("unescapeString(%q): error %v, want %q", test.input, err, test.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("unescapeString(%q): unexpected error %v", test.input, err)
+			continue
+		}
+		if got != test.want {
+			t.Errorf("unescapeString(%q) = %q, want %q", test.input, got, test.want)
+		}
+	}
+}
+
+func TestStringEscapesInLexer(t *testing.T) {
+	tokens := NewLexer().DoLex("@echo(`a\\`b\\n` ```raw \\n `` x```)")
+	strs := make([]string, 0)
+	for _, token := range tokens {
+		if token.Type == VALUE && token.Data.Type == DATA_STR {
+			strs = append(strs, token.Data.StrData)
+		}
+	}
+	want := []string{"a`b\n", "raw \\n `` x"}
+	if fmt.Sprint(strs) != fmt.Sprint(want) {
+		t.Errorf("got strings %q, want %q", strs, want)
+	}
+}
+
+// streamInputs have keywords, strings and regions of several bytes, which a
+// small reader window splits.
+var streamInputs = []string{
+	"plain text without directives",
+	"@define(greet name echo(add(`hi ` name)))\n@greet(`you`) and @-echo(1 -) done",
+	"@include(`lib.cm`) @echo(!t !f 0x1F 2.5e3)",
+	"a @# line comment\n@* block\ncomment *@b",
+	"@echo(```raw `` @echo( \\n```) @echo(`esc\\`aped`)",
+	"@echo(```\nraw on its own line\n```)",
+	"@verbatim @echo( @define @# not a comment @endverbatim after",
+	"a\n  @verbatim\n  @echo(1)\n  @endverbatim\nb",
+	"@echo(@verbatim ) ( @endverbatim x)",
+	"@@echo(1) @@@echo(2) user@@example.com",
+	"héllo 😀 @echo(`ünïcode 😀`) ✓",
+	"crlf\r\n@echo(1)\r\n  @define(x 1)\r\nend",
+	"@delimiters(`<%` `{{` `}}` `'`)\n<%echo{{'a' }} <%<% <%verbatim <%x <%endverbatim",
+	"  @echo(1)  \\n  @define(y 2)\\n text @echo(2)\\n",
+}
+
+func TestStreamingMatchesWholeInput(t *testing.T) {
+	readers := map[string]func(io.Reader) io.Reader{
+		"one byte": iotest.OneByteReader,
+		"half":     iotest.HalfReader,
+		"data+EOF": iotest.DataErrReader,
+	}
+
+	for _, trimLines := range []bool{false, true} {
+		options := Options{TrimLines: trimLines}
+		for _, input := range streamInputs {
+			want := NewLexerWithOptions("test.cm", options).DoLex(input)
+
+			for name, reader := range readers {
+				lex := NewLexerWithOptions("test.cm", options)
+				lex.SetInput(reader(strings.NewReader(input)))
+				got := make([]LexerToken, 0)
+				for {
+					token := lex.Next()
+					got = append(got, token)
+					if token.Type == TERMINATOR {
+						break
+					}
+				}
+
+				if lex.Err() != nil {
+					t.Errorf("%s reader, %q: %v", name, input, lex.Err())
+				}
+				if !reflect.DeepEqual(got, want) {
+					t.Errorf("%s reader, trimlines %t, %q:\\n got %+v\\nwant %+v", name, trimLines, input, got, want)
+				}
+			}
+		}
+	}
+}
+
+func TestStreamingReadError(t *testing.T) {
+	failure := errors.New("disk on fire")
+	tests := []struct {
+		name   string
+		reader io.Reader
+		err    error
+		prefix string // the input read before the error
+	}{
+		{"at once", iotest.ErrReader(failure), failure, ""},
+		{"after a call", io.MultiReader(strings.NewReader("a @echo(1) b"), iotest.ErrReader(failure)), failure, "a @echo(1) b"},
+		{"in a keyword", io.MultiReader(strings.NewReader("a @verb"), iotest.ErrReader(failure)), failure, "a @verb"},
+		{"timeout", iotest.TimeoutReader(iotest.OneByteReader(strings.NewReader("abc"))), iotest.ErrTimeout, "a"},
+	}
+
+	for _, test := range tests {
+		lex := NewLexerWithFile("test.cm")
+		lex.SetInput(test.reader)
+
+		got := make([]LexerToken, 0)
+		for i := 0; ; i++ {
+			if i > 100 {
+				t.Fatalf("%s: no end of input after a read error", test.name)
+			}
+			token := lex.Next()
+			got = append(got, token)
+			if token.Type == TERMINATOR {
+				break
+			}
+		}
+
+		if !errors.Is(lex.Err(), test.err) {
+			t.Errorf("%s: Err() = %v, want %v", test.name, lex.Err(), test.err)
+		}
+		want := NewLexerWithFile("test.cm").DoLex(test.prefix)
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: tokens before the error\n got %+v\nwant %+v", test.name, got, want)
+		}
+	}
+}
@@ -1,27 +1,155 @@
 package lexer
 
+import (
+	"fmt"
+	"strings"
+)
+
 type KeywordMatchingItem map[string]TokenType
 type InvertedKeywordMatchingItem map[TokenType]string
 
-var KeywordMap KeywordMatchingItem = KeywordMatchingItem{
-	"@":       KEYWORD_CALL,
-	"@define": KEYWORD_DEFINE,
-	"@include": KEYWORD_INCLUDE,
-	"(":       KEYWORD_BRACKET_OPEN,
-	")":       KEYWORD_BRACKET_CLOSE,
+// Delimiters are the spellings a template uses for calls, brackets and
+// strings. The other keywords derive from them: with Call "$" a definition is
+// $define, a line comment $# and a literal dollar $$.
+type Delimiters struct {
+	Call  string
+	Open  string
+	Close string
+	Quote string
+}
+
+func DefaultDelimiters() Delimiters {
+	return Delimiters{Call: "@", Open: "(", Close: ")", Quote: "`"}
+}
+
+// With replaces the delimiters in the order call, open, close, quote by the
+// given spellings, keeping the rest.
+func (d Delimiters) With(spellings []string) (Delimiters, error) {
+	if len(spellings) > 4 {
+		return d, fmt.Errorf("expected at most 4 delimiters (call, open, close, quote), got %d", len(spellings))
+	}
+	fields := []*string{&d.Call, &d.Open, &d.Close, &d.Quote}
+	for i, s := range spellings {
+		*fields[i] = s
+	}
+	return d, d.Validate()
+}
+
+// Validate checks that the delimiters and the keywords made from them can be
+// told apart. The tokenizer takes the longest keyword it finds, so a keyword
+// that is another keyword, or that starts with another delimiter, would hide
+// it: with call - and close ), -) is always a trimming close bracket.
+func (d Delimiters) Validate() error {
+	delimiters := []struct{ name, spelling string }{
+		{"call", d.Call}, {"open", d.Open}, {"close", d.Close}, {"quote", d.Quote},
+	}
+	seen := make(map[string]string)
+	for _, item := range delimiters {
+		if item.spelling == "" {
+			return fmt.Errorf("the %s delimiter is empty", item.name)
+		}
+		if strings.ContainsAny(item.spelling, " \t\r\n") {
+			return fmt.Errorf("the %s delimiter %q contains whitespace", item.name, item.spelling)
+		}
+		if other, ok := seen[item.spelling]; ok {
+			return fmt.Errorf("the %s and %s delimiters are both %q", other, item.name, item.spelling)
+		}
+		seen[item.spelling] = item.name
+	}
+
+	keywords := d.keywords()
+	kinds := make(map[string]string)
+	for _, k := range keywords {
+		if other, ok := kinds[k.spelling]; ok {
+			return fmt.Errorf("%q would be both the %s and the %s keyword", k.spelling, other, k.kind)
+		}
+		kinds[k.spelling] = k.kind
+	}
+	for _, k := range keywords {
+		for _, item := range delimiters {
+			if item.name != k.delimiter && strings.HasPrefix(k.spelling, item.spelling) {
+				return fmt.Errorf("the %s keyword %q starts with the %s delimiter %q", k.kind, k.spelling, item.name, item.spelling)
+			}
+		}
+	}
+	return nil
+}
+
+// keyword is a keyword spelled with a set of delimiters.
+type keyword struct {
+	spelling  string
+	tokenType TokenType
+	kind      string // what the keyword is, for error messages
+	delimiter string // the delimiter it is made from; empty for !t and !f
+}
+
+// keywords lists the keywords made from the delimiters, without whitespace.
+func (d Delimiters) keywords() []keyword {
+	return []keyword{
+		{d.Call, KEYWORD_CALL, "call", "call"},
+		{d.Call + "define", KEYWORD_DEFINE, "define", "call"},
+		{d.Call + "include", KEYWORD_INCLUDE, "include", "call"},
+		{d.Open, KEYWORD_BRACKET_OPEN, "open bracket", "open"},
+		{d.Close, KEYWORD_BRACKET_CLOSE, "close bracket", "close"},
+		{d.Call + "-", KEYWORD_CALL_TRIM, "trimming call", "call"},
+		{d.Call + "-define", KEYWORD_DEFINE_TRIM, "trimming define", "call"},
+		{d.Call + "-include", KEYWORD_INCLUDE_TRIM, "trimming include", "call"},
+		{"-" + d.Close, KEYWORD_BRACKET_CLOSE_TRIM, "trimming close bracket", "close"},
 
-	"`":  STRING_QUOTEMARK,
-	"!t": BOOLEAN_TRUE,
-	"!f": BOOLEAN_FALSE,
+		{d.Call + "#", COMMENT_LINE, "line comment", "call"},
+		{d.Call + "*", COMMENT_BLOCK_OPEN, "comment start", "call"},
+		{"*" + d.Call, COMMENT_BLOCK_CLOSE, "comment end", "call"},
+
+		{d.Call + d.Call, KEYWORD_ESCAPE, "escape", "call"},
+		{d.Call + "verbatim", VERBATIM_OPEN, "verbatim", "call"},
+		{d.Call + "endverbatim", VERBATIM_CLOSE, "endverbatim", "call"},
+
+		{d.Quote, STRING_QUOTEMARK, "quote", "quote"},
+		{strings.Repeat(d.Quote, 3), RAW_STRING_MARK, "raw string", "quote"},
+		{"!t", BOOLEAN_TRUE, "true", ""},
+		{"!f", BOOLEAN_FALSE, "false", ""},
+	}
+}
 
-	" ":  WHITESPACE,
-	"\n": NEWLINE,
+// Keywords returns the keyword set of the delimiters.
+func (d Delimiters) Keywords() KeywordMatchingItem {
+	km := KeywordMatchingItem{
+		" ":    WHITESPACE,
+		"\t":   WHITESPACE,
+		"\r":   WHITESPACE,
+		"\n":   NEWLINE,
+		"\r\n": NEWLINE,
+	}
+	for _, k := range d.keywords() {
+		km[k.spelling] = k.tokenType
+	}
+	return km
 }
 
-var InvertedKeywordMap = make(InvertedKeywordMatchingItem)
+// Name returns how a token of type t is written with the delimiters, for
+// error messages; types that are not keywords keep their generic names.
+func (d Delimiters) Name(t TokenType) string {
+	for _, k := range d.keywords() {
+		if k.tokenType == t {
+			return "'" + k.spelling + "'"
+		}
+	}
+	return t.String()
+}
 
-func init() {
-	for key, val := range KeywordMap {
-		InvertedKeywordMap[val] = key
+// Invert maps every keyword type back to a spelling of it.
+func (km KeywordMatchingItem) Invert() InvertedKeywordMatchingItem {
+	inverted := make(InvertedKeywordMatchingItem)
+	for key, val := range km {
+		inverted[val] = key
 	}
+	// Whitespace has several spellings; keep the canonical ones.
+	inverted[WHITESPACE] = " "
+	inverted[NEWLINE] = "\n"
+	return inverted
 }
+
+// KeywordMap is the keyword set of the default delimiters.
+var KeywordMap = DefaultDelimiters().Keywords()
+
+var InvertedKeywordMap = KeywordMap.Invert()
@@ -0,0 +1,147 @@
+package lexer
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestDelimitersValidate(t *testing.T) {
+	tests := []struct {
+		delimiters Delimiters
+		err        string // empty when the delimiters are valid
+	}{
+		{DefaultDelimiters(), ""},
+		{Delimiters{"$", "[", "]", "'"}, ""},
+		{Delimiters{"<%", "{", "}", `"`}, ""},
+		{Delimiters{"@", "<<", ">>", "``"}, ""},
+		{Delimiters{"@", "(", "-", "`"}, ""},
+
+		{Delimiters{"", "(", ")", "`"}, "the call delimiter is empty"},
+		{Delimiters{"@", "( ", ")", "`"}, `the open delimiter "( " contains whitespace`},
+		{Delimiters{"@", "(", "(", "`"}, `the open and close delimiters are both "("`},
+		{Delimiters{"-", "(", ")", "`"}, `"--" would be both the trimming call and the escape keyword`},
+		{Delimiters{"*", "(", ")", "`"}, `"**" would be both the comment start and the comment end keyword`},
+		{Delimiters{"@", "(", ")", "@define"}, `"@define" would be both the define and the quote keyword`},
+		{Delimiters{"@", "*", ")", "`"}, `the comment end keyword "*@" starts with the open delimiter "*"`},
+		{Delimiters{"$", "$[", "]", "`"}, `the open bracket keyword "$[" starts with the call delimiter "$"`},
+		{Delimiters{"@", "(", ")", "@x"}, `the quote keyword "@x" starts with the call delimiter "@"`},
+		{Delimiters{"@", "((", "(", "`"}, `the open bracket keyword "((" starts with the close delimiter "("`},
+		{Delimiters{"!", "(", ")", "`"}, `the true keyword "!t" starts with the call delimiter "!"`},
+		{Delimiters{"@", "(", ")", "-"}, `the trimming close bracket keyword "-)" starts with the quote delimiter "-"`},
+	}
+
+	for _, test := range tests {
+		err := test.delimiters.Validate()
+		if test.err == "" {
+			if err != nil {
+				t.Errorf("%+v: unexpected error %v", test.delimiters, err)
+			}
+			continue
+		}
+		if err == nil || err.Error() != test.err {
+			t.Errorf("%+v: error %v, want %q", test.delimiters, err, test.err)
+		}
+	}
+}
+
+func TestDelimitersWith(t *testing.T) {
+	d, err := DefaultDelimiters().With([]string{"$", "["})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (Delimiters{"$", "[", ")", "`"}); d != want {
+		t.Errorf("got %+v, want %+v", d, want)
+	}
+	if _, err := DefaultDelimiters().With([]string{"a", "b", "c", "d", "e"}); err == nil {
+		t.Errorf("five delimiters were accepted")
+	}
+	if _, err := DefaultDelimiters().With([]string{"-"}); err == nil {
+		t.Errorf("a colliding call delimiter was accepted")
+	}
+}
+
+func TestDelimitersName(t *testing.T) {
+	d := Delimiters{"$", "[", "]", "'"}
+	tests := map[TokenType]string{
+		KEYWORD_CALL:               "'$'",
+		KEYWORD_DEFINE:             "'$define'",
+		KEYWORD_BRACKET_OPEN:       "'['",
+		KEYWORD_BRACKET_CLOSE:      "']'",
+		KEYWORD_BRACKET_CLOSE_TRIM: "'-]'",
+		COMMENT_BLOCK_CLOSE:        "'*$'",
+		RAW_STRING_MARK:            "'''''",
+		KEYWORD_ESCAPE:             "'$$'",
+		BOOLEAN_TRUE:               "'!t'",
+		NEWLINE:                    "newline",
+		VALUE:                      "value",
+		TERMINATOR:                 "end of input",
+	}
+	for tokenType, want := range tests {
+		if got := d.Name(tokenType); got != want {
+			t.Errorf("Name(%s) = %s, want %s", tokenType, got, want)
+		}
+	}
+
+	// The default names are those of the default delimiters.
+	for tokenType, name := range tokenTypeNames {
+		if got := DefaultDelimiters().Name(tokenType); got != name {
+			t.Errorf("default Name(%d) = %s, want %s", tokenType, got, name)
+		}
+	}
+}
+
+func TestDelimitersDirective(t *testing.T) {
+	tests := []struct {
+		input   string
+		options Options
+		want    string
+		err     string
+	}{
+		{"@delimiters(`$` `[` `]`)\n$echo[1] @echo(1)", Options{}, "@ @echo(1)", ""},
+		{"@delimiters($ [ ])$echo[1]", Options{}, "@", ""},
+		{"@delimiters(`$` `[` `]`)$delimiters[]@echo(1) $x", Options{}, "@ $x", ""},
+		{"@delimiters(`$`)$echo(1) $$ $# gone\n$* gone *$@@", Options{}, "@ $ @@", ""},
+		{"@delimiters(`<%` `{` `}` `'`)<%echo{'a' '''raw'''} <%<%", Options{}, "@ <%", ""},
+		{"$echo[1] @echo(1)", Options{Delimiters: Delimiters{"$", "[", "]", "'"}}, "@ @echo(1)", ""},
+		{"$delimiters[]@echo(1)", Options{Delimiters: Delimiters{"$", "[", "]", "'"}}, "@", ""},
+
+		{"@delimiters(`-`)", Options{}, "", `test.cm:1:1: "--" would be both the trimming call and the escape keyword`},
+		{"@delimiters(`@` `*`)", Options{}, "", `test.cm:1:1: the comment end keyword "*@" starts with the open delimiter "*"`},
+		{"@delimiters(a b c d e)", Options{}, "", "test.cm:1:1: expected at most 4 delimiters (call, open, close, quote), got 5"},
+		{"@delimiters(echo(1))", Options{}, "", "delimiters takes plain words or strings"},
+		{"@delimiters(`$`)$* open", Options{}, "", "test.cm:1:17: unterminated comment, expected '*$'"},
+	}
+
+	for _, test := range tests {
+		got, err := lexText(test.input, test.options)
+		if test.err != "" {
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("%q: error %v, want %q", test.input, err, test.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: unexpected error %v", test.input, err)
+			continue
+		}
+		if got != test.want {
+			t.Errorf("%q: got %q, want %q", test.input, got, test.want)
+		}
+	}
+}
+
+func TestTokenDelimiters(t *testing.T) {
+	tokens := NewLexer().DoLex("@echo(1)@delimiters(`$` `[` `]`)$echo[")
+	first, last := tokens[0], tokens[len(tokens)-1]
+	if first.Type != KEYWORD_CALL || first.Describe() != "'@'" || first.Name(KEYWORD_BRACKET_CLOSE) != "')'" {
+		t.Errorf("first token %s names a close bracket %s", first.Describe(), first.Name(KEYWORD_BRACKET_CLOSE))
+	}
+	if last.Type != TERMINATOR || last.Name(KEYWORD_BRACKET_CLOSE) != "']'" {
+		t.Errorf("last token %s names a close bracket %s", last.Describe(), last.Name(KEYWORD_BRACKET_CLOSE))
+	}
+	for _, token := range tokens {
+		if token.Delimiters == nil {
+			t.Errorf("%s at %s has no delimiters", token.Describe(), token.Pos)
+		}
+	}
+}
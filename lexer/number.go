@@ -0,0 +1,135 @@
+package lexer
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Numeric literals follow Go's spelling, with two differences: a sign may be
+// part of the literal, and a leading zero does not make an integer octal.
+//
+//	42  -7  +3  1_000_000      decimal integers
+//	0xFF  0o17  0b1010  0x_ff  hexadecimal, octal and binary integers
+//	3.14  .5  1.  1e6  -2.5E-3 reals
+//
+// Underscores may only separate digits. A word that does not match any of
+// these forms is an object name.
+
+func isDecimalDigit(c byte) bool { return '0' <= c && c <= '9' }
+func isHexDigit(c byte) bool {
+	return isDecimalDigit(c) || ('a' <= c && c <= 'f') || ('A' <= c && c <= 'F')
+}
+func isOctalDigit(c byte) bool  { return '0' <= c && c <= '7' }
+func isBinaryDigit(c byte) bool { return c == '0' || c == '1' }
+
+// scanDigits consumes digits and separating underscores from s[i:]. It returns
+// the index after them, the number of digits seen and whether every underscore
+// sat between two digits. leading allows an underscore before the first digit,
+// as after a base prefix.
+func scanDigits(s string, i int, isDigit func(byte) bool, leading bool) (int, int, bool) {
+	digits := 0
+	valid := true
+	prevUnderscore := false
+	for ; i < len(s); i++ {
+		switch {
+		case isDigit(s[i]):
+			digits++
+			prevUnderscore = false
+		case s[i] == '_':
+			if prevUnderscore || (digits == 0 && !leading) {
+				valid = false
+			}
+			prevUnderscore = true
+		default:
+			return i, digits, valid && !prevUnderscore
+		}
+	}
+	return i, digits, valid && !prevUnderscore
+}
+
+// parseNumber reports whether data is spelled as a numeric literal and, if so,
+// returns its value. A literal that does not fit its type is an error.
+func parseNumber(data string) (LexerTokenData, bool, error) {
+	i := 0
+	if i < len(data) && (data[i] == '+' || data[i] == '-') {
+		i++
+	}
+
+	if len(data) > i+1 && data[i] == '0' {
+		var isDigit func(byte) bool
+		switch data[i+1] {
+		case 'x', 'X':
+			isDigit = isHexDigit
+		case 'o', 'O':
+			isDigit = isOctalDigit
+		case 'b', 'B':
+			isDigit = isBinaryDigit
+		}
+		if isDigit != nil {
+			end, digits, valid := scanDigits(data, i+2, isDigit, true)
+			if end != len(data) || digits == 0 || !valid {
+				return LexerTokenData{}, false, nil
+			}
+			d, err := strconv.ParseInt(data, 0, 64)
+			if err != nil {
+				return LexerTokenData{}, true, numberError("integer", data, err)
+			}
+			return NewIntData(d), true, nil
+		}
+	}
+
+	i, intDigits, valid := scanDigits(data, i, isDecimalDigit, false)
+	fracDigits := 0
+	isReal := false
+
+	if i < len(data) && data[i] == '.' {
+		isReal = true
+		var fracValid bool
+		i, fracDigits, fracValid = scanDigits(data, i+1, isDecimalDigit, false)
+		valid = valid && fracValid
+	}
+	if intDigits+fracDigits == 0 || !valid {
+		return LexerTokenData{}, false, nil
+	}
+
+	if i < len(data) && (data[i] == 'e' || data[i] == 'E') {
+		isReal = true
+		i++
+		if i < len(data) && (data[i] == '+' || data[i] == '-') {
+			i++
+		}
+		var expDigits int
+		var expValid bool
+		i, expDigits, expValid = scanDigits(data, i, isDecimalDigit, false)
+		if expDigits == 0 || !expValid {
+			return LexerTokenData{}, false, nil
+		}
+	}
+	if i != len(data) {
+		return LexerTokenData{}, false, nil
+	}
+
+	plain := strings.ReplaceAll(data, "_", "")
+	if isReal {
+		d, err := strconv.ParseFloat(plain, 64)
+		if err != nil {
+			return LexerTokenData{}, true, numberError("real", data, err)
+		}
+		return NewRealData(d), true, nil
+	}
+
+	d, err := strconv.ParseInt(plain, 10, 64)
+	if err != nil {
+		return LexerTokenData{}, true, numberError("integer", data, err)
+	}
+	return NewIntData(d), true, nil
+}
+
+func numberError(kind string, data string, err error) error {
+	if errors.Is(err, strconv.ErrRange) {
+		return fmt.Errorf("%s literal %s is out of range", kind, data)
+	}
+	return fmt.Errorf("invalid %s literal %s", kind, data)
+}
@@ -0,0 +1,76 @@
+package lexer
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseNumber(t *testing.T) {
+	tests := []struct {
+		input    string
+		isNumber bool
+		want     LexerTokenData
+		err      string
+	}{
+		{"42", true, NewIntData(42), ""},
+		{"-7", true, NewIntData(-7), ""},
+		{"+3", true, NewIntData(3), ""},
+		{"007", true, NewIntData(7), ""},
+		{"1_000_000", true, NewIntData(1000000), ""},
+		{"0xFF", true, NewIntData(255), ""},
+		{"-0x10", true, NewIntData(-16), ""},
+		{"0X_ff", true, NewIntData(255), ""},
+		{"0o17", true, NewIntData(15), ""},
+		{"0b1010", true, NewIntData(10), ""},
+		{"3.14", true, NewRealData(3.14), ""},
+		{".5", true, NewRealData(0.5), ""},
+		{"1.", true, NewRealData(1), ""},
+		{"1e6", true, NewRealData(1e6), ""},
+		{"-2.5E-3", true, NewRealData(-2.5e-3), ""},
+		{"1_0.2_5e+1_0", true, NewRealData(10.25e10), ""},
+
+		{"9223372036854775807", true, NewIntData(9223372036854775807), ""},
+		{"9223372036854775808", true, LexerTokenData{}, "integer literal 9223372036854775808 is out of range"},
+		{"0x1_0000_0000_0000_0000", true, LexerTokenData{}, "out of range"},
+		{"1e400", true, LexerTokenData{}, "real literal 1e400 is out of range"},
+
+		{"", false, LexerTokenData{}, ""},
+		{"-", false, LexerTokenData{}, ""},
+		{".", false, LexerTokenData{}, ""},
+		{"abc", false, LexerTokenData{}, ""},
+		{"12abc", false, LexerTokenData{}, ""},
+		{"_1", false, LexerTokenData{}, ""},
+		{"1_", false, LexerTokenData{}, ""},
+		{"1__0", false, LexerTokenData{}, ""},
+		{"1._5", false, LexerTokenData{}, ""},
+		{"0x", false, LexerTokenData{}, ""},
+		{"0xG", false, LexerTokenData{}, ""},
+		{"0o8", false, LexerTokenData{}, ""},
+		{"0b2", false, LexerTokenData{}, ""},
+		{"1e", false, LexerTokenData{}, ""},
+		{"1e+", false, LexerTokenData{}, ""},
+		{"1.2.3", false, LexerTokenData{}, ""},
+		{"--1", false, LexerTokenData{}, ""},
+	}
+
+	for _, test := range tests {
+		got, isNumber, err := parseNumber(test.input)
+		if isNumber != test.isNumber {
+			t.Errorf("parseNumber(%q): number %t, want %t", test.input, isNumber, test.isNumber)
+			continue
+		}
+		if test.err != "" {
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("parseNumber(%q): error %v, want %q", test.input, err, test.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("parseNumber(%q): unexpected error %v", test.input, err)
+			continue
+		}
+		if got != test.want {
+			t.Errorf("parseNumber(%q) = %+v, want %+v", test.input, got, test.want)
+		}
+	}
+}
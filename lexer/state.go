@@ -7,4 +7,5 @@ const (
 	STATE_NORMSTRINGS
 	STATE_STRINGVALUE
 	STATE_OBJNAME
+	STATE_RAWSTRING
 )
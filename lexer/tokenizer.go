@@ -1,99 +1,303 @@
 package lexer
 
 import (
-	"sort"
+	"bytes"
+	"fmt"
+	"io"
 )
 
-type Tokenizer struct {
-	pointer uint64
-	maxsize uint64
+// keywordTrie finds the longest keyword at a position of the input. Its nodes
+// live in one slice; the root is indexed by the first byte, so text that can
+// not start a keyword is rejected with a single lookup.
+type keywordTrie struct {
+	root  [256]int32
+	nodes []trieNode
+}
 
-	targets   []rune
-	tokenized []Token
+type trieNode struct {
+	token    TokenType // 0 when no keyword ends here
+	spelling string
+	edges    []trieEdge
 }
 
-func NewTokenizer() *Tokenizer {
-	tokenizer := new(Tokenizer)
+type trieEdge struct {
+	b    byte
+	next int32
+}
 
-	tokenizer.pointer = 0
-	tokenizer.maxsize = 0
+func newKeywordTrie(keywords KeywordMatchingItem) *keywordTrie {
+	// Node 0 is unused, so that 0 means "no node" in root.
+	trie := &keywordTrie{nodes: make([]trieNode, 1)}
 
-	return tokenizer
-}
+	for key, value := range keywords {
+		node := trie.root[key[0]]
+		if node == 0 {
+			node = trie.newNode()
+			trie.root[key[0]] = node
+		}
+		for i := 1; i < len(key); i++ {
+			node = trie.child(node, key[i])
+		}
+		trie.nodes[node].token = value
+		trie.nodes[node].spelling = key
+	}
 
-func (tk *Tokenizer) doTokenize(input string, size uint64) []Token {
-	tk.tokenized = make([]Token, 0)
+	return trie
+}
 
-	tk.targets = []rune(input)
-	tk.maxsize = uint64(len(tk.targets))
+func (t *keywordTrie) newNode() int32 {
+	t.nodes = append(t.nodes, trieNode{})
+	return int32(len(t.nodes) - 1)
+}
 
-	buffer := make([]rune, 0)
+func (t *keywordTrie) child(node int32, b byte) int32 {
+	for _, edge := range t.nodes[node].edges {
+		if edge.b == b {
+			return edge.next
+		}
+	}
+	next := t.newNode()
+	t.nodes[node].edges = append(t.nodes[node].edges, trieEdge{b: b, next: next})
+	return next
+}
 
-	for {
-		if tk.pointer >= tk.maxsize {
-			if len(buffer) > 0 {
-				tk.tokenized = append(tk.tokenized, NewDataToken(NORM_STRINGS, string(buffer)))
-			}
+// match returns the trie node of the longest keyword at the start of s, or 0.
+func (t *keywordTrie) match(s []byte) int32 {
+	node := t.root[s[0]]
+	if node == 0 {
+		return 0
+	}
 
-			tk.tokenized = append(tk.tokenized, NewToken(TERMINATOR))
+	found := int32(0)
+	for i := 1; ; i++ {
+		if t.nodes[node].token != 0 {
+			found = node
+		}
+		if i >= len(s) {
 			break
 		}
 
-		token_type, token_size := tk.matchToken()
-
-		if token_type != NORM_STRINGS {
-			if len(buffer) > 0 {
-				tk.tokenized = append(tk.tokenized, NewDataToken(NORM_STRINGS, string(buffer)))
+		next := int32(0)
+		for _, edge := range t.nodes[node].edges {
+			if edge.b == s[i] {
+				next = edge.next
+				break
 			}
+		}
+		if next == 0 {
+			break
+		}
+		node = next
+	}
 
-			buffer = buffer[:0]
+	return found
+}
 
-			tk.tokenized = append(tk.tokenized, NewToken(token_type))
-			tk.pointer += uint64(token_size)
-		} else {
-			buffer = append(buffer, tk.targets[tk.pointer])
-			tk.pointer++
+// maxLength is the length in bytes of the longest keyword.
+func (t *keywordTrie) maxLength() int {
+	longest := 0
+	for _, node := range t.nodes {
+		if len(node.spelling) > longest {
+			longest = len(node.spelling)
 		}
 	}
+	return longest
+}
+
+// Tokenizer splits input read from an io.Reader into keywords and runs of
+// text, one token at a time. It keeps a window of the input that only has to
+// hold the current run of text plus the longest keyword.
+type Tokenizer struct {
+	reader io.Reader
+	buf    []byte
+	start  int // first byte of buf still needed
+	eof    bool
+	err    error
+
+	pointer int // read position in buf
+	pending []Token
+
+	file   string
+	line   int
+	column int
 
-	return tk.tokenized
+	trie       *keywordTrie
+	inverted   InvertedKeywordMatchingItem
+	lookahead  int
+	terminated bool
 }
 
-type tokenHead struct {
-	token TokenType
-	len   int
+// readSize is how much input the tokenizer asks its reader for at once.
+const readSize = 32 * 1024
+
+func NewTokenizer(r io.Reader) *Tokenizer {
+	return NewTokenizerWithKeywords(r, KeywordMap, Position{Line: 1, Column: 1})
 }
 
-func (tk *Tokenizer) matchToken() (TokenType, int) {
-	keyword_tokens := make([]tokenHead, 0)
+// NewTokenizerWithKeywords creates a Tokenizer for the given keyword set whose
+// positions start at pos.
+func NewTokenizerWithKeywords(r io.Reader, keywords KeywordMatchingItem, pos Position) *Tokenizer {
+	tokenizer := new(Tokenizer)
 
-	for key, value := range KeywordMap {
-		keywordRunes := []rune(key)
-		if int(tk.pointer)+len(keywordRunes) > len(tk.targets) {
-			continue
+	tokenizer.reader = r
+	tokenizer.buf = make([]byte, 0, readSize)
+	tokenizer.file = pos.File
+	tokenizer.line = pos.Line
+	tokenizer.column = pos.Column
+	tokenizer.SetKeywords(keywords)
+
+	return tokenizer
+}
+
+// SetKeywords switches the keyword set for the input that has not been
+// tokenized yet.
+func (tk *Tokenizer) SetKeywords(keywords KeywordMatchingItem) {
+	tk.trie = newKeywordTrie(keywords)
+	tk.inverted = keywords.Invert()
+	tk.lookahead = tk.trie.maxLength()
+}
+
+// Err returns the error that stopped reading the input, if any. The input
+// ends at that point, as if it had been shorter.
+func (tk *Tokenizer) Err() error {
+	return tk.err
+}
+
+func (tk *Tokenizer) currentPos() Position {
+	return Position{File: tk.file, Line: tk.line, Column: tk.column}
+}
+
+// fill reads until n bytes are available from the pointer or the input ends,
+// and reports whether there are n bytes.
+func (tk *Tokenizer) fill(n int) bool {
+	for len(tk.buf)-tk.pointer < n && !tk.eof {
+		if tk.start > 0 {
+			// Drop the consumed input before growing the window.
+			kept := copy(tk.buf, tk.buf[tk.start:])
+			tk.buf = tk.buf[:kept]
+			tk.pointer -= tk.start
+			tk.start = 0
+		}
+		if cap(tk.buf)-len(tk.buf) < readSize {
+			grown := make([]byte, len(tk.buf), 2*cap(tk.buf)+readSize)
+			copy(grown, tk.buf)
+			tk.buf = grown
 		}
 
-		match := true
-		for i, r := range keywordRunes {
-			if tk.targets[tk.pointer+uint64(i)] != r {
-				match = false
-				break
-			}
+		read, err := tk.reader.Read(tk.buf[len(tk.buf):cap(tk.buf)])
+		tk.buf = tk.buf[:len(tk.buf)+read]
+		if err == io.EOF {
+			tk.eof = true
+		} else if err != nil {
+			tk.err = err
+			tk.eof = true
 		}
+	}
+	return len(tk.buf)-tk.pointer >= n
+}
 
-		if match {
-			keyword_tokens = append(keyword_tokens, tokenHead{token: value, len: len(keywordRunes)})
+// advance moves the pointer forward by n bytes, keeping line and column in
+// sync. Columns count runes, so continuation bytes of UTF-8 are skipped.
+func (tk *Tokenizer) advance(n int) {
+	end := tk.pointer + n
+	if end > len(tk.buf) {
+		end = len(tk.buf)
+	}
+	for ; tk.pointer < end; tk.pointer++ {
+		switch c := tk.buf[tk.pointer]; {
+		case c == '\n':
+			tk.line++
+			tk.column = 1
+		case c&0xC0 != 0x80:
+			tk.column++
 		}
 	}
+}
+
+// Next returns the next token. At the end of the input it returns TERMINATOR,
+// and keeps doing so.
+func (tk *Tokenizer) Next() Token {
+	if len(tk.pending) > 0 {
+		token := tk.pending[0]
+		tk.pending = tk.pending[1:]
+		return token
+	}
+	if tk.terminated {
+		return Token{token_type: TERMINATOR, pos: tk.currentPos()}
+	}
+
+	tk.start = tk.pointer
+	textPos := tk.currentPos()
 
-	if len(keyword_tokens) <= 0 {
-		return NORM_STRINGS, 1
-	} else {
-		sort.Slice(keyword_tokens, func(i, j int) bool {
-			return keyword_tokens[i].len > keyword_tokens[j].len
-		})
+	for {
+		tk.fill(tk.lookahead)
+		if tk.pointer >= len(tk.buf) {
+			break
+		}
 
-		return keyword_tokens[0].token, keyword_tokens[0].len
+		node := tk.trie.match(tk.buf[tk.pointer:])
+		if node == 0 {
+			tk.advance(1)
+			continue
+		}
+		if tk.pointer > tk.start {
+			// The keyword is tokenized by the next call.
+			break
+		}
+
+		keyword := &tk.trie.nodes[node]
+		token := Token{token_type: keyword.token, token_data: keyword.spelling, pos: tk.currentPos()}
+		tk.advance(len(keyword.spelling))
+		tk.start = tk.pointer
+
+		if token.token_type == VERBATIM_OPEN {
+			tk.readVerbatim(token.pos)
+		}
+		return token
+	}
+
+	if tk.pointer > tk.start {
+		token := Token{token_type: NORM_STRINGS, token_data: string(tk.buf[tk.start:tk.pointer]), pos: textPos}
+		tk.start = tk.pointer
+		return token
+	}
+
+	tk.terminated = true
+	return Token{token_type: TERMINATOR, pos: tk.currentPos()}
+}
+
+// readVerbatim queues everything up to the closing keyword of a verbatim
+// region as one VERBATIM token, followed by the VERBATIM_CLOSE token.
+func (tk *Tokenizer) readVerbatim(openPos Position) {
+	closing := tk.inverted[VERBATIM_CLOSE]
+	startPos := tk.currentPos()
+
+	searched := 0
+	length := -1
+	for {
+		if i := bytes.Index(tk.buf[tk.pointer+searched:], []byte(closing)); i >= 0 {
+			length = searched + i
+			break
+		}
+		if tk.eof {
+			break
+		}
+		// Search the new input again from where the closing keyword could start.
+		searched = len(tk.buf) - tk.pointer - len(closing) + 1
+		if searched < 0 {
+			searched = 0
+		}
+		tk.fill(len(tk.buf) - tk.pointer + readSize)
+	}
+	if length < 0 {
+		panic(fmt.Sprintf("%s: unterminated verbatim region, expected '%s'", openPos, closing))
 	}
 
+	text := string(tk.buf[tk.pointer : tk.pointer+length])
+	tk.advance(length)
+	tk.pending = append(tk.pending,
+		Token{token_type: VERBATIM, token_data: text, pos: startPos},
+		Token{token_type: VERBATIM_CLOSE, token_data: closing, pos: tk.currentPos()})
+	tk.advance(len(closing))
+	tk.start = tk.pointer
 }
@@ -0,0 +1,121 @@
+package lexer
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// benchTemplate generates a template of about size bytes that mixes text,
+// definitions, calls, strings, comments and escapes like a real one.
+func benchTemplate(size int) string {
+	var sb strings.Builder
+	for i := 0; sb.Len() < size; i++ {
+		fmt.Fprintf(&sb, "@define(item%d name count add(`Item ` name `: ` count))\n", i)
+		fmt.Fprintf(&sb, "<li class=\"row-%d\">@item%d(`first` %d) and @-item%d(`second` 0x%x -)</li>\n", i, i, i, i, i)
+		fmt.Fprintf(&sb, "@# a line comment about row %d\n", i)
+		fmt.Fprintf(&sb, "Plain text with an escaped @@ sign, !t and !f, costs %d.%d\n", i, i%100)
+		fmt.Fprintf(&sb, "@* a block\ncomment *@\t@ifel(@same(%d 0) ```raw``` `str`)\r\n", i%3)
+	}
+	return sb.String()
+}
+
+// mapScanMatch is the keyword matching the tokenizer used before the trie:
+// every keyword of the set is compared at the position and the longest match
+// wins.
+func mapScanMatch(keywords KeywordMatchingItem, s []byte) (TokenType, int) {
+	token, length := NORM_STRINGS, 0
+	for key, value := range keywords {
+		if len(key) > len(s) || string(s[:len(key)]) != key {
+			continue
+		}
+		if len(key) > length {
+			token, length = value, len(key)
+		}
+	}
+	return token, length
+}
+
+func TestKeywordTrieMatchesMapScan(t *testing.T) {
+	for _, delimiters := range []Delimiters{
+		DefaultDelimiters(),
+		{Call: "$", Open: "[", Close: "]", Quote: "\""},
+		{Call: "{%", Open: "<<", Close: ">>", Quote: "'"},
+	} {
+		keywords := delimiters.Keywords()
+		trie := newKeywordTrie(keywords)
+		input := []byte(benchTemplate(4096))
+		input = append(input, []byte(delimiters.Call+"define"+delimiters.Open+"x"+delimiters.Close+"-"+delimiters.Close)...)
+
+		for i := range input {
+			wantToken, wantLength := mapScanMatch(keywords, input[i:])
+			node := trie.match(input[i:])
+			gotToken, gotLength := NORM_STRINGS, 0
+			if node != 0 {
+				gotToken, gotLength = trie.nodes[node].token, len(trie.nodes[node].spelling)
+			}
+			if gotToken != wantToken || gotLength != wantLength {
+				t.Fatalf("%+v: at offset %d (%q): trie matched %v/%d, map scan %v/%d",
+					delimiters, i, input[i:min(i+12, len(input))], gotToken, gotLength, wantToken, wantLength)
+			}
+		}
+	}
+}
+
+// BenchmarkKeywordMatch compares the trie against the old map scan, trying a
+// match at every byte of the input as the tokenizer does outside keywords.
+func BenchmarkKeywordMatch(b *testing.B) {
+	keywords := KeywordMap
+	input := []byte(benchTemplate(1 << 20))
+
+	b.Run("trie", func(b *testing.B) {
+		trie := newKeywordTrie(keywords)
+		b.ResetTimer()
+		b.SetBytes(int64(len(input)))
+		b.ReportAllocs()
+		for n := 0; n < b.N; n++ {
+			for i := 0; i < len(input); {
+				node := trie.match(input[i:])
+				if node == 0 {
+					i++
+				} else {
+					i += len(trie.nodes[node].spelling)
+				}
+			}
+		}
+	})
+
+	b.Run("mapscan", func(b *testing.B) {
+		b.SetBytes(int64(len(input)))
+		b.ReportAllocs()
+		for n := 0; n < b.N; n++ {
+			for i := 0; i < len(input); {
+				if _, length := mapScanMatch(keywords, input[i:]); length == 0 {
+					i++
+				} else {
+					i += length
+				}
+			}
+		}
+	})
+}
+
+func BenchmarkTokenizer(b *testing.B) {
+	input := benchTemplate(1 << 20)
+	b.SetBytes(int64(len(input)))
+	b.ReportAllocs()
+	for n := 0; n < b.N; n++ {
+		tk := NewTokenizer(strings.NewReader(input))
+		for tk.Next().token_type != TERMINATOR {
+		}
+	}
+}
+
+func BenchmarkDoLex(b *testing.B) {
+	input := benchTemplate(1 << 20)
+	b.SetBytes(int64(len(input)))
+	b.ReportAllocs()
+	for n := 0; n < b.N; n++ {
+		NewLexer().DoLex(input)
+	}
+}
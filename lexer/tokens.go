@@ -1,5 +1,7 @@
 package lexer
 
+import "fmt"
+
 type TokenType int
 
 const (
@@ -20,11 +22,94 @@ const (
 	VALUE
 
 	TERMINATOR
+
+	// Trim variants: @-name( removes the whitespace before a directive and -)
+	// the whitespace after it. The lexer reports them as their plain forms.
+	KEYWORD_CALL_TRIM
+	KEYWORD_DEFINE_TRIM
+	KEYWORD_INCLUDE_TRIM
+	KEYWORD_BRACKET_CLOSE_TRIM
+
+	// Comments are dropped by the lexer: @# runs to the end of the line and
+	// eats the newline (like M4's dnl), @* ... *@ may span lines.
+	COMMENT_LINE
+	COMMENT_BLOCK_OPEN
+	COMMENT_BLOCK_CLOSE
+
+	// RAW_STRING_MARK opens and closes a raw string: ```text``` takes text
+	// literally, without escape sequences.
+	RAW_STRING_MARK
+
+	// KEYWORD_ESCAPE (@@) is a literal '@' in normal text. Everything between
+	// VERBATIM_OPEN and VERBATIM_CLOSE is passed through by the tokenizer as a
+	// single VERBATIM token, without looking for keywords.
+	KEYWORD_ESCAPE
+	VERBATIM_OPEN
+	VERBATIM_CLOSE
+	VERBATIM
 )
 
+// Position locates a token in its source file. Line and Column are 1-based.
+type Position struct {
+	File   string
+	Line   int
+	Column int
+}
+
+func (p Position) IsValid() bool {
+	return p.Line > 0
+}
+
+func (p Position) String() string {
+	if p.File == "" {
+		return fmt.Sprintf("%d:%d", p.Line, p.Column)
+	}
+	return fmt.Sprintf("%s:%d:%d", p.File, p.Line, p.Column)
+}
+
+var tokenTypeNames = map[TokenType]string{
+	KEYWORD_CALL:          "'@'",
+	KEYWORD_DEFINE:        "'@define'",
+	KEYWORD_INCLUDE:       "'@include'",
+	KEYWORD_BRACKET_OPEN:  "'('",
+	KEYWORD_BRACKET_CLOSE: "')'",
+	STRING_QUOTEMARK:      "'`'",
+	BOOLEAN_TRUE:          "'!t'",
+	BOOLEAN_FALSE:         "'!f'",
+	WHITESPACE:            "whitespace",
+	NEWLINE:               "newline",
+	NORM_STRINGS:          "text",
+	VALUE:                 "value",
+	TERMINATOR:            "end of input",
+
+	KEYWORD_CALL_TRIM:          "'@-'",
+	KEYWORD_DEFINE_TRIM:        "'@-define'",
+	KEYWORD_INCLUDE_TRIM:       "'@-include'",
+	KEYWORD_BRACKET_CLOSE_TRIM: "'-)'",
+
+	COMMENT_LINE:        "'@#'",
+	COMMENT_BLOCK_OPEN:  "'@*'",
+	COMMENT_BLOCK_CLOSE: "'*@'",
+
+	RAW_STRING_MARK: "'```'",
+
+	KEYWORD_ESCAPE: "'@@'",
+	VERBATIM_OPEN:  "'@verbatim'",
+	VERBATIM_CLOSE: "'@endverbatim'",
+	VERBATIM:       "verbatim text",
+}
+
+func (t TokenType) String() string {
+	if name, ok := tokenTypeNames[t]; ok {
+		return name
+	}
+	return fmt.Sprintf("token(%d)", int(t))
+}
+
 type Token struct {
 	token_type TokenType
 	token_data string
+	pos        Position
 }
 
 func NewToken(t_type TokenType) Token {
@@ -43,6 +128,10 @@ func (t *Token) GetData() string {
 	return t.token_data
 }
 
+func (t *Token) GetPos() Position {
+	return t.pos
+}
+
 const (
 	DATA_INT LexerTokenDataType = iota + 1
 	DATA_REAL
@@ -56,15 +145,67 @@ const (
 
 type LexerTokenDataType int
 
+var dataTypeNames = map[LexerTokenDataType]string{
+	DATA_INT:        "integer",
+	DATA_REAL:       "real",
+	DATA_STR:        "string",
+	DATA_BOOL:       "boolean",
+	DATA_NORMSTRING: "text",
+	DATA_OBJNAME:    "object name",
+	NODEF:           "nothing",
+}
+
+func (t LexerTokenDataType) String() string {
+	if name, ok := dataTypeNames[t]; ok {
+		return name
+	}
+	return fmt.Sprintf("data(%d)", int(t))
+}
+
 type LexerToken struct {
 	Type TokenType
 	Data LexerTokenData
+	Pos  Position
+
+	// Delimiters are the delimiters in effect where the token was read; nil
+	// stands for the default ones.
+	Delimiters *Delimiters
+}
+
+// Name returns how a token of type t is written where the token was read, so
+// that error messages show the delimiters the template uses.
+func (t LexerToken) Name(tokenType TokenType) string {
+	if t.Delimiters == nil {
+		return tokenType.String()
+	}
+	return t.Delimiters.Name(tokenType)
+}
+
+// Describe returns a short human readable form of the token for error messages.
+func (t LexerToken) Describe() string {
+	if t.Type != VALUE {
+		return t.Name(t.Type)
+	}
+	switch t.Data.Type {
+	case DATA_INT:
+		return fmt.Sprintf("integer %d", t.Data.IntData)
+	case DATA_REAL:
+		return fmt.Sprintf("real %v", t.Data.RealData)
+	case DATA_STR:
+		return fmt.Sprintf("string %q", t.Data.StrData)
+	case DATA_BOOL:
+		return fmt.Sprintf("boolean %t", t.Data.BoolData)
+	case DATA_OBJNAME:
+		return fmt.Sprintf("object name '%s'", t.Data.ObjNameData)
+	}
+	return t.Data.Type.String()
 }
 
-func NewLexerToken(t_type TokenType, t_data LexerTokenData) LexerToken {
+func NewLexerToken(t_type TokenType, t_data LexerTokenData, pos Position) LexerToken {
 	return LexerToken{
 		Type: t_type,
 		Data: t_data,
+		Pos:  pos,
 	}
 }
 
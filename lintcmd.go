@@ -0,0 +1,163 @@
+package main
+
+import (
+	"cutter/etc"
+	"cutter/lexer"
+	"cutter/parser"
+	"cutter/runtime"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// lintRuleSet parses the comma-separated rule IDs of -enable and -disable.
+func lintRuleSet(list string) (map[string]bool, error) {
+	known := make(map[string]bool)
+	for _, rule := range runtime.LintRules {
+		known[rule.ID] = true
+	}
+
+	rules := make(map[string]bool)
+	for _, id := range strings.Split(list, ",") {
+		id = strings.TrimSpace(id)
+		if id == "" {
+			continue
+		}
+		if !known[id] {
+			return nil, fmt.Errorf("unknown lint rule %q", id)
+		}
+		rules[id] = true
+	}
+	return rules, nil
+}
+
+// lintEnabledRules returns the rules to run: those in enable, or every rule
+// when it is empty, less those in disable.
+func lintEnabledRules(enable string, disable string) (map[string]bool, error) {
+	var enabled map[string]bool
+	if enable != "" {
+		rules, err := lintRuleSet(enable)
+		if err != nil {
+			return nil, err
+		}
+		enabled = rules
+	} else {
+		enabled = make(map[string]bool)
+		for _, rule := range runtime.LintRules {
+			enabled[rule.ID] = true
+		}
+	}
+	disabled, err := lintRuleSet(disable)
+	if err != nil {
+		return nil, err
+	}
+	for id := range disabled {
+		delete(enabled, id)
+	}
+	return enabled, nil
+}
+
+// printLintRules writes the list printed by -rules.
+func printLintRules(w io.Writer) {
+	for _, rule := range runtime.LintRules {
+		fmt.Fprintf(w, "%-18s %s\n", rule.ID, rule.Description)
+	}
+}
+
+func runLintCommand(args []string) int {
+	flags := flag.NewFlagSet("lint", flag.ExitOnError)
+	enableFlag := flags.String("enable", "", "Run only these rules (comma-separated IDs)")
+	disableFlag := flags.String("disable", "", "Skip these rules (comma-separated IDs)")
+	listFlag := flags.Bool("rules", false, "List the rules and exit")
+	anyExtFlag := flags.Bool("anyext", false, "Accept an input file without the .cm extension")
+	includeAnyExtFlag := flags.Bool("includeanyext", false, "Allow @include of files without the .cm extension")
+	var includeDirs pathListFlag
+	flags.Var(&includeDirs, "I", "Search dir for included files after the including file's directory (repeatable)")
+	trimLinesFlag := flags.Bool("trimlines", false, "Remove lines that contain only directives and whitespace")
+	delimiters := lexer.DefaultDelimiters()
+	flags.Var(delimitersFlag{&delimiters}, "delims", "Replace the call, open, close and quote delimiters, e.g. '$ [ ] \"'")
+	defines := newDefineFlags()
+	flags.Var(defines, "D", "Define an object as name=value or name:type=value (repeatable)")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "usage: cutter lint [flags] paths...")
+		fmt.Fprintln(flags.Output(), "Reports code that compiles but is likely a mistake; directories are searched for .cm files.")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	if *listFlag {
+		printLintRules(os.Stdout)
+		return ExitOK
+	}
+
+	if flags.NArg() == 0 {
+		flags.Usage()
+		return ExitUsage
+	}
+
+	enabled, err := lintEnabledRules(*enableFlag, *disableFlag)
+	if err != nil {
+		return reportError(newCLIError(ExitUsage, "usage error", err))
+	}
+
+	files, err := findTemplates(flags.Args())
+	if err != nil {
+		return reportError(newCLIError(ExitIO, "i/o error", err))
+	}
+
+	options := lexer.Options{TrimLines: *trimLinesFlag, Delimiters: delimiters}
+	code := ExitOK
+	for _, file := range files {
+		com := runtime.NewCompiler()
+		com.SetIncludeAnyExtension(*includeAnyExtFlag)
+		com.SetIncludePath(includePath(includeDirs))
+		com.SetLexerOptions(options)
+		defines.applyToCompiler(com)
+
+		if fileCode := lintFile(file, *anyExtFlag, com, options, enabled); fileCode != ExitOK {
+			code = fileCode
+		}
+	}
+	return code
+}
+
+// lintFile prints the findings for one template.
+func lintFile(path string, anyExtension bool, com *runtime.Compiler, options lexer.Options, enabled map[string]bool) int {
+	source, err := etc.OpenFile(path, anyExtension)
+	if err != nil {
+		return reportError(newCLIError(ExitIO, "i/o error", err))
+	}
+	defer source.Close()
+
+	lex := lexer.NewLexerWithOptions(path, options)
+	lex.SetInput(source)
+
+	var ast parser.HeadNode
+	err = catchStage(ExitSyntax, "syntax error", func() {
+		ast = parser.NewParser().ParseStream(lex)
+	})
+	if lex.Err() != nil {
+		return reportError(newCLIError(ExitIO, "i/o error", lex.Err()))
+	}
+	if err != nil {
+		return reportError(err)
+	}
+
+	var found []runtime.LintDiagnostic
+	err = catchStage(ExitCompile, "compile error", func() {
+		found = com.Lint(ast, enabled)
+	})
+	if err != nil {
+		return reportError(err)
+	}
+
+	for _, diagnostic := range found {
+		fmt.Fprintln(os.Stdout, diagnostic)
+	}
+	if len(found) > 0 {
+		return ExitFailure
+	}
+	return ExitOK
+}
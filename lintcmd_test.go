@@ -0,0 +1,74 @@
+package main
+
+import (
+	"bytes"
+	"cutter/runtime"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestLintEnabledRules(t *testing.T) {
+	all := make(map[string]bool)
+	for _, rule := range runtime.LintRules {
+		all[rule.ID] = true
+	}
+	without := func(ids ...string) map[string]bool {
+		rules := make(map[string]bool)
+		for id := range all {
+			rules[id] = true
+		}
+		for _, id := range ids {
+			delete(rules, id)
+		}
+		return rules
+	}
+
+	tests := []struct {
+		enable  string
+		disable string
+		want    map[string]bool
+		err     string
+	}{
+		{"", "", all, ""},
+		{"unused-define", "", map[string]bool{"unused-define": true}, ""},
+		{" undefined-set , loop-condition ,", "", map[string]bool{"undefined-set": true, "loop-condition": true}, ""},
+		{"", "unused-define", without("unused-define"), ""},
+		{"", "unused-define,include-redefine", without("unused-define", "include-redefine"), ""},
+		{"undefined-set,loop-condition", "loop-condition", map[string]bool{"undefined-set": true}, ""},
+		{"unused-define", "unused-define", map[string]bool{}, ""},
+		{"bogus", "", nil, `unknown lint rule "bogus"`},
+		{"", "unused-define,bogus", nil, `unknown lint rule "bogus"`},
+	}
+
+	for _, test := range tests {
+		got, err := lintEnabledRules(test.enable, test.disable)
+		if test.err != "" {
+			if err == nil || err.Error() != test.err {
+				t.Errorf("-enable %q -disable %q: error %v, want %q", test.enable, test.disable, err, test.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("-enable %q -disable %q: unexpected error %v", test.enable, test.disable, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("-enable %q -disable %q = %v, want %v", test.enable, test.disable, got, test.want)
+		}
+	}
+}
+
+func TestPrintLintRules(t *testing.T) {
+	var out bytes.Buffer
+	printLintRules(&out)
+	lines := strings.Split(strings.TrimSuffix(out.String(), "\n"), "\n")
+	if len(lines) != len(runtime.LintRules) {
+		t.Fatalf("got %d lines, want one per rule:\n%s", len(lines), out.String())
+	}
+	for i, rule := range runtime.LintRules {
+		if fields := strings.Fields(lines[i]); len(fields) < 2 || fields[0] != rule.ID || !strings.HasSuffix(lines[i], rule.Description) {
+			t.Errorf("line %d is %q, want %s and its description", i+1, lines[i], rule.ID)
+		}
+	}
+}
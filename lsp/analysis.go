@@ -0,0 +1,232 @@
+package lsp
+
+import (
+	"cutter/lexer"
+	"cutter/parser"
+	"cutter/runtime"
+	"fmt"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf16"
+	"unicode/utf8"
+)
+
+// definition is an @define of the document or of a file it includes.
+type definition struct {
+	fnc  parser.FunctionObject
+	path string // absolute path of the file the definition is in
+}
+
+// analysis is what the server knows about a document after its last change.
+type analysis struct {
+	diagnostics []diagnostic
+	definitions []definition
+}
+
+// analyze parses, compiles and lints the document at path.
+func (s *Server) analyze(path string, text string) analysis {
+	result := analysis{diagnostics: make([]diagnostic, 0), definitions: make([]definition, 0)}
+
+	var head parser.HeadNode
+	if msg := catch(func() {
+		lex := lexer.NewLexerWithOptions(path, s.options.Lexer)
+		lex.SetInput(strings.NewReader(text))
+		head = parser.NewParser().ParseStream(lex)
+	}); msg != "" {
+		result.diagnostics = append(result.diagnostics, s.diagnosticFor(path, text, msg, severityError, ""))
+		return result
+	}
+
+	// The definitions of the whole include tree; when an include is broken
+	// only the document's own, and the compiler below reports the error.
+	bodys := head.Bodys
+	catch(func() { bodys = s.newCompiler().ExpandIncludes(head).Bodys })
+	for _, body := range bodys {
+		if body.Type == parser.FUCNTION_DEFINITION {
+			result.definitions = append(result.definitions, definition{fnc: body.Func, path: absPath(body.Func.Pos.File)})
+		}
+	}
+
+	if msg := catch(func() { s.newCompiler().CompileASTToVMInstr(head) }); msg != "" {
+		result.diagnostics = append(result.diagnostics, s.diagnosticFor(path, text, msg, severityError, ""))
+		return result
+	}
+
+	var found []runtime.LintDiagnostic
+	catch(func() { found = s.newCompiler().Lint(head, nil) })
+	for _, lint := range found {
+		if absPath(lint.Pos.File) != path {
+			continue
+		}
+		start := toPosition(text, lint.Pos)
+		result.diagnostics = append(result.diagnostics, diagnostic{
+			Range:    textRange{Start: start, End: start},
+			Severity: severityWarning,
+			Code:     lint.Rule,
+			Source:   "cutter",
+			Message:  lint.Message,
+		})
+	}
+
+	return result
+}
+
+func (s *Server) newCompiler() *runtime.Compiler {
+	com := runtime.NewCompiler()
+	com.SetIncludeAnyExtension(s.options.IncludeAnyExtension)
+	com.SetIncludePath(s.options.IncludePath)
+	com.SetLexerOptions(s.options.Lexer)
+	return com
+}
+
+// catch runs fn and returns the message of a panic inside it, or "".
+func catch(fn func()) (msg string) {
+	defer func() {
+		if r := recover(); r != nil {
+			msg = fmt.Sprint(r)
+		}
+	}()
+
+	fn()
+	return ""
+}
+
+// diagnosticFor turns an error message of the lexer, parser or compiler into
+// a diagnostic. Messages start with "path:line:column: " when they know where
+// the error is; others are reported at the start of the document.
+func (s *Server) diagnosticFor(path string, text string, msg string, severity int, code string) diagnostic {
+	d := diagnostic{Severity: severity, Code: code, Source: "cutter", Message: msg}
+
+	if rest := strings.TrimPrefix(msg, path+":"); rest != msg {
+		parts := strings.SplitN(rest, ":", 3)
+		if len(parts) == 3 {
+			line, lineErr := strconv.Atoi(parts[0])
+			column, columnErr := strconv.Atoi(parts[1])
+			if lineErr == nil && columnErr == nil {
+				start := toPosition(text, lexer.Position{Line: line, Column: column})
+				d.Range = textRange{Start: start, End: start}
+				d.Message = strings.TrimSpace(parts[2])
+			}
+		}
+	}
+	return d
+}
+
+func absPath(path string) string {
+	if abs, err := filepath.Abs(path); err == nil {
+		return abs
+	}
+	return path
+}
+
+// lineAt returns line (0-based) of text, without its line break.
+func lineAt(text string, line int) string {
+	for ; line > 0; line-- {
+		i := strings.IndexByte(text, '\n')
+		if i < 0 {
+			return ""
+		}
+		text = text[i+1:]
+	}
+	if i := strings.IndexByte(text, '\n'); i >= 0 {
+		text = text[:i]
+	}
+	return strings.TrimSuffix(text, "\r")
+}
+
+// toPosition converts a lexer position, whose columns count runes, to a
+// protocol position in text.
+func toPosition(text string, pos lexer.Position) position {
+	if !pos.IsValid() {
+		return position{}
+	}
+	line := lineAt(text, pos.Line-1)
+	character := 0
+	for i, r := range []rune(line) {
+		if i >= pos.Column-1 {
+			break
+		}
+		character += len(utf16.Encode([]rune{r}))
+	}
+	return position{Line: pos.Line - 1, Character: character}
+}
+
+// runeOffset returns the rune index in line of the protocol character offset.
+func runeOffset(line string, character int) int {
+	units := 0
+	for i, r := range []rune(line) {
+		if units >= character {
+			return i
+		}
+		units += len(utf16.Encode([]rune{r}))
+	}
+	return utf8.RuneCountInString(line)
+}
+
+func isNameRune(r rune) bool {
+	return unicode.IsLetter(r) || unicode.IsDigit(r) || r == '_' || r == '.'
+}
+
+// wordAt returns the object name at pos in text.
+func wordAt(text string, pos position) string {
+	line := []rune(lineAt(text, pos.Line))
+	start := runeOffset(string(line), pos.Character)
+	end := start
+	for start > 0 && isNameRune(line[start-1]) {
+		start--
+	}
+	for end < len(line) && isNameRune(line[end]) {
+		end++
+	}
+	return string(line[start:end])
+}
+
+// definitionRange is the range of fnc in text, from the @define to its
+// closing bracket.
+func definitionRange(text string, fnc parser.FunctionObject) textRange {
+	start := toPosition(text, fnc.Pos)
+	if !fnc.End.IsValid() {
+		return textRange{Start: start, End: start}
+	}
+	end := fnc.End
+	end.Column++
+	return textRange{Start: start, End: toPosition(text, end)}
+}
+
+// definitionSource returns the text of fnc as written in text.
+func definitionSource(text string, fnc parser.FunctionObject) string {
+	if !fnc.Pos.IsValid() || !fnc.End.IsValid() {
+		return signature(fnc)
+	}
+
+	lines := strings.Split(text, "\n")
+	if fnc.End.Line > len(lines) {
+		return signature(fnc)
+	}
+	var sb strings.Builder
+	for line := fnc.Pos.Line; line <= fnc.End.Line; line++ {
+		runes := []rune(strings.TrimSuffix(lines[line-1], "\r"))
+		from, to := 0, len(runes)
+		if line == fnc.Pos.Line {
+			from = fnc.Pos.Column - 1
+		}
+		if line == fnc.End.Line && fnc.End.Column < to {
+			to = fnc.End.Column
+		}
+		if from > to {
+			return signature(fnc)
+		}
+		if line > fnc.Pos.Line {
+			sb.WriteString("\n")
+		}
+		sb.WriteString(string(runes[from:to]))
+	}
+	return sb.String()
+}
+
+// signature is the name and parameters of fnc.
+func signature(fnc parser.FunctionObject) string {
+	return strings.Join(append([]string{fnc.Name}, fnc.Parameters...), " ")
+}
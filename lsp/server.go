@@ -0,0 +1,427 @@
+// Package lsp implements a Language Server Protocol server for Cutter
+// templates over a pair of streams, usually standard input and output.
+package lsp
+
+import (
+	"bufio"
+	"cutter/etc"
+	"cutter/lexer"
+	"cutter/parser"
+	"cutter/runtime"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Options configures how the server reads templates, like the flags of the
+// template command.
+type Options struct {
+	Lexer               lexer.Options
+	IncludeAnyExtension bool
+	IncludePath         []string
+}
+
+// ErrNoShutdown is returned by Run when the client sent exit without asking
+// the server to shut down first.
+var ErrNoShutdown = errors.New("exit without shutdown")
+
+type document struct {
+	path     string
+	text     string
+	analysis analysis
+}
+
+// Server answers the requests of one client.
+type Server struct {
+	in      *bufio.Reader
+	out     io.Writer
+	options Options
+
+	documents map[string]*document
+	shutdown  bool
+}
+
+func NewServer(in io.Reader, out io.Writer, options Options) *Server {
+	if options.Lexer.Delimiters == (lexer.Delimiters{}) {
+		options.Lexer.Delimiters = lexer.DefaultDelimiters()
+	}
+	return &Server{
+		in:        bufio.NewReader(in),
+		out:       out,
+		options:   options,
+		documents: make(map[string]*document),
+	}
+}
+
+// Run serves requests until the client sends exit or closes the input.
+func (s *Server) Run() error {
+	for {
+		msg, err := s.read()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		if msg.Method == "exit" {
+			if !s.shutdown {
+				return ErrNoShutdown
+			}
+			return nil
+		}
+
+		result, rpcErr := s.handle(msg)
+		if len(msg.ID) == 0 {
+			// Notifications get no response.
+			continue
+		}
+		if err := s.respond(msg.ID, result, rpcErr); err != nil {
+			return err
+		}
+	}
+}
+
+// read reads one message, framed by a Content-Length header.
+func (s *Server) read() (message, error) {
+	length := -1
+	for {
+		line, err := s.in.ReadString('\n')
+		if err != nil {
+			if err == io.EOF && line == "" && length < 0 {
+				return message{}, io.EOF
+			}
+			return message{}, err
+		}
+		line = strings.TrimRight(line, "\r\n")
+		if line == "" {
+			break
+		}
+		name, value, _ := strings.Cut(line, ":")
+		if strings.EqualFold(strings.TrimSpace(name), "Content-Length") {
+			if length, err = strconv.Atoi(strings.TrimSpace(value)); err != nil {
+				return message{}, fmt.Errorf("invalid Content-Length %q", value)
+			}
+		}
+	}
+	if length < 0 {
+		return message{}, errors.New("message without Content-Length header")
+	}
+
+	body := make([]byte, length)
+	if _, err := io.ReadFull(s.in, body); err != nil {
+		return message{}, err
+	}
+
+	var msg message
+	if err := json.Unmarshal(body, &msg); err != nil {
+		// Answer with a parse error instead of giving up on the client.
+		return message{ID: json.RawMessage("null"), Method: "$/invalid"}, nil
+	}
+	return msg, nil
+}
+
+func (s *Server) write(v interface{}) error {
+	body, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	if _, err := fmt.Fprintf(s.out, "Content-Length: %d\r\n\r\n", len(body)); err != nil {
+		return err
+	}
+	_, err = s.out.Write(body)
+	return err
+}
+
+func (s *Server) respond(id json.RawMessage, result interface{}, rpcErr *responseError) error {
+	resp := response{JSONRPC: "2.0", ID: id, Error: rpcErr}
+	if rpcErr == nil {
+		raw, err := json.Marshal(result)
+		if err != nil {
+			return err
+		}
+		resp.Result = raw
+	}
+	return s.write(resp)
+}
+
+func (s *Server) notify(method string, params interface{}) error {
+	return s.write(notification{JSONRPC: "2.0", Method: method, Params: params})
+}
+
+func invalidParams(err error) *responseError {
+	return &responseError{Code: codeInvalidParams, Message: err.Error()}
+}
+
+// handle dispatches a request or notification and returns its result.
+func (s *Server) handle(msg message) (interface{}, *responseError) {
+	switch msg.Method {
+	case "$/invalid":
+		return nil, &responseError{Code: codeParseError, Message: "invalid JSON message"}
+
+	case "initialize":
+		return map[string]interface{}{
+			"capabilities": map[string]interface{}{
+				"textDocumentSync":       1, // full documents on every change
+				"definitionProvider":     true,
+				"hoverProvider":          true,
+				"documentSymbolProvider": true,
+				"completionProvider": map[string]interface{}{
+					"triggerCharacters": []string{s.options.Lexer.Delimiters.Call},
+				},
+			},
+			"serverInfo": map[string]string{"name": "cutter", "version": etc.RUNTIMEVERSION},
+		}, nil
+
+	case "initialized":
+		return nil, nil
+
+	case "shutdown":
+		s.shutdown = true
+		return nil, nil
+
+	case "textDocument/didOpen":
+		var params didOpenParams
+		if err := json.Unmarshal(msg.Params, &params); err != nil {
+			return nil, invalidParams(err)
+		}
+		return nil, s.update(params.TextDocument.URI, params.TextDocument.Text)
+
+	case "textDocument/didChange":
+		var params didChangeParams
+		if err := json.Unmarshal(msg.Params, &params); err != nil {
+			return nil, invalidParams(err)
+		}
+		if len(params.ContentChanges) == 0 {
+			return nil, nil
+		}
+		return nil, s.update(params.TextDocument.URI, params.ContentChanges[len(params.ContentChanges)-1].Text)
+
+	case "textDocument/didClose":
+		var params didCloseParams
+		if err := json.Unmarshal(msg.Params, &params); err != nil {
+			return nil, invalidParams(err)
+		}
+		delete(s.documents, params.TextDocument.URI)
+		s.notify("textDocument/publishDiagnostics", publishDiagnosticsParams{URI: params.TextDocument.URI, Diagnostics: []diagnostic{}})
+		return nil, nil
+
+	case "textDocument/definition":
+		var params textDocumentPositionParams
+		if err := json.Unmarshal(msg.Params, &params); err != nil {
+			return nil, invalidParams(err)
+		}
+		return s.definition(params), nil
+
+	case "textDocument/hover":
+		var params textDocumentPositionParams
+		if err := json.Unmarshal(msg.Params, &params); err != nil {
+			return nil, invalidParams(err)
+		}
+		return s.hover(params), nil
+
+	case "textDocument/completion":
+		var params textDocumentPositionParams
+		if err := json.Unmarshal(msg.Params, &params); err != nil {
+			return nil, invalidParams(err)
+		}
+		return s.completion(params), nil
+
+	case "textDocument/documentSymbol":
+		var params documentSymbolParams
+		if err := json.Unmarshal(msg.Params, &params); err != nil {
+			return nil, invalidParams(err)
+		}
+		return s.documentSymbols(params), nil
+	}
+
+	if strings.HasPrefix(msg.Method, "$/") {
+		// Optional notifications such as $/cancelRequest are ignored.
+		return nil, nil
+	}
+	return nil, &responseError{Code: codeMethodNotFound, Message: "method not supported: " + msg.Method}
+}
+
+// update analyzes the new text of a document and publishes its diagnostics.
+func (s *Server) update(uri string, text string) *responseError {
+	path, err := uriToPath(uri)
+	if err != nil {
+		return invalidParams(err)
+	}
+
+	doc := &document{path: path, text: text}
+	doc.analysis = s.analyze(path, text)
+	s.documents[uri] = doc
+
+	if err := s.notify("textDocument/publishDiagnostics", publishDiagnosticsParams{URI: uri, Diagnostics: doc.analysis.diagnostics}); err != nil {
+		return &responseError{Code: codeInternalError, Message: err.Error()}
+	}
+	return nil
+}
+
+func uriToPath(uri string) (string, error) {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return "", err
+	}
+	if u.Scheme != "file" {
+		return "", fmt.Errorf("unsupported document URI %q", uri)
+	}
+	return filepath.FromSlash(u.Path), nil
+}
+
+func pathToURI(path string) string {
+	return (&url.URL{Scheme: "file", Path: filepath.ToSlash(path)}).String()
+}
+
+// fileText returns the text of the file at path, preferring an open document.
+func (s *Server) fileText(path string) string {
+	for _, doc := range s.documents {
+		if doc.path == path {
+			return doc.text
+		}
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return ""
+	}
+	return string(data)
+}
+
+// lookup returns the definitions of the name at the position, the last one
+// (the one the compiler keeps) first.
+func (s *Server) lookup(params textDocumentPositionParams) (string, []definition) {
+	doc, ok := s.documents[params.TextDocument.URI]
+	if !ok {
+		return "", nil
+	}
+	name := wordAt(doc.text, params.Position)
+	if name == "" {
+		return "", nil
+	}
+
+	found := make([]definition, 0)
+	for i := len(doc.analysis.definitions) - 1; i >= 0; i-- {
+		if def := doc.analysis.definitions[i]; def.fnc.Name == name {
+			found = append(found, def)
+		}
+	}
+	return name, found
+}
+
+func (s *Server) definition(params textDocumentPositionParams) []location {
+	_, found := s.lookup(params)
+	locations := make([]location, 0, len(found))
+	for _, def := range found {
+		locations = append(locations, location{URI: pathToURI(def.path), Range: definitionRange(s.fileText(def.path), def.fnc)})
+	}
+	return locations
+}
+
+func (s *Server) hover(params textDocumentPositionParams) *hover {
+	name, found := s.lookup(params)
+	if name == "" {
+		return nil
+	}
+
+	if len(found) == 0 {
+		if _, isStandard := runtime.GetStandardFuncs()[name]; !isStandard {
+			return nil
+		}
+		return &hover{Contents: markupContent{Kind: "markdown", Value: fmt.Sprintf("`%s`: standard function", name)}}
+	}
+
+	def := found[0]
+	var sb strings.Builder
+	if len(def.fnc.Parameters) > 0 {
+		fmt.Fprintf(&sb, "**%s**(%s)\n\n", def.fnc.Name, strings.Join(def.fnc.Parameters, " "))
+	} else {
+		fmt.Fprintf(&sb, "**%s**\n\n", def.fnc.Name)
+	}
+	fmt.Fprintf(&sb, "```cutter\n%s\n```\n", definitionSource(s.fileText(def.path), def.fnc))
+	fmt.Fprintf(&sb, "\n%s", filepath.Base(def.path))
+	if def.fnc.Pos.IsValid() {
+		fmt.Fprintf(&sb, ":%d", def.fnc.Pos.Line)
+	}
+	return &hover{Contents: markupContent{Kind: "markdown", Value: sb.String()}}
+}
+
+// builtins are the calls the compiler handles itself rather than through the
+// standard function table.
+var builtins = []string{"for", "capture", "chain"}
+
+func (s *Server) completion(params textDocumentPositionParams) []completionItem {
+	items := make([]completionItem, 0)
+	seen := make(map[string]bool)
+
+	if doc, ok := s.documents[params.TextDocument.URI]; ok {
+		for i := len(doc.analysis.definitions) - 1; i >= 0; i-- {
+			fnc := doc.analysis.definitions[i].fnc
+			if seen[fnc.Name] {
+				continue
+			}
+			seen[fnc.Name] = true
+			item := completionItem{Label: fnc.Name, Kind: completionKindFunction, Detail: signature(fnc)}
+			if isVariable(fnc) {
+				item.Kind = completionKindVariable
+			}
+			items = append(items, item)
+		}
+	}
+
+	for name := range runtime.GetStandardFuncs() {
+		if !seen[name] {
+			seen[name] = true
+			items = append(items, completionItem{Label: name, Kind: completionKindFunction, Detail: "standard function"})
+		}
+	}
+	for _, name := range builtins {
+		if !seen[name] {
+			seen[name] = true
+			items = append(items, completionItem{Label: name, Kind: completionKindFunction, Detail: "built-in"})
+		}
+	}
+
+	sort.Slice(items, func(i, j int) bool { return items[i].Label < items[j].Label })
+	return items
+}
+
+func (s *Server) documentSymbols(params documentSymbolParams) []documentSymbol {
+	symbols := make([]documentSymbol, 0)
+	doc, ok := s.documents[params.TextDocument.URI]
+	if !ok {
+		return symbols
+	}
+
+	for _, def := range doc.analysis.definitions {
+		if def.path != doc.path {
+			continue
+		}
+		kind := symbolKindFunction
+		if isVariable(def.fnc) {
+			kind = symbolKindVariable
+		}
+		r := definitionRange(doc.text, def.fnc)
+		symbols = append(symbols, documentSymbol{
+			Name:           def.fnc.Name,
+			Detail:         strings.Join(def.fnc.Parameters, " "),
+			Kind:           kind,
+			Range:          r,
+			SelectionRange: textRange{Start: r.Start, End: r.Start},
+		})
+	}
+	return symbols
+}
+
+// isVariable reports whether fnc defines a variable function, as the compiler
+// decides it.
+func isVariable(fnc parser.FunctionObject) bool {
+	return fnc.StaticData.Type != 0 && len(fnc.Parameters) == 0
+}
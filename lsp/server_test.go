@@ -0,0 +1,226 @@
+package lsp
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// client drives a Server over in-memory pipes as an editor would.
+type client struct {
+	t      *testing.T
+	in     *io.PipeWriter
+	out    *bufio.Reader
+	nextID int
+	done   chan error
+}
+
+func newClient(t *testing.T, options Options) *client {
+	serverIn, clientOut := io.Pipe()
+	clientIn, serverOut := io.Pipe()
+
+	c := &client{t: t, in: clientOut, out: bufio.NewReader(clientIn), done: make(chan error, 1)}
+	go func() {
+		err := NewServer(serverIn, serverOut, options).Run()
+		serverOut.Close()
+		c.done <- err
+	}()
+	return c
+}
+
+func (c *client) send(v interface{}) {
+	c.t.Helper()
+	body, err := json.Marshal(v)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	if _, err := fmt.Fprintf(c.in, "Content-Length: %d\r\n\r\n%s", len(body), body); err != nil {
+		c.t.Fatal(err)
+	}
+}
+
+// receive reads the next message the server wrote.
+func (c *client) receive() map[string]json.RawMessage {
+	c.t.Helper()
+	length := -1
+	for {
+		line, err := c.out.ReadString('\n')
+		if err != nil {
+			c.t.Fatalf("reading header: %v", err)
+		}
+		line = strings.TrimRight(line, "\r\n")
+		if line == "" {
+			break
+		}
+		if value, ok := strings.CutPrefix(line, "Content-Length: "); ok {
+			length, _ = strconv.Atoi(value)
+		}
+	}
+	body := make([]byte, length)
+	if _, err := io.ReadFull(c.out, body); err != nil {
+		c.t.Fatalf("reading body: %v", err)
+	}
+	var msg map[string]json.RawMessage
+	if err := json.Unmarshal(body, &msg); err != nil {
+		c.t.Fatalf("invalid message %s: %v", body, err)
+	}
+	return msg
+}
+
+func (c *client) notify(method string, params interface{}) {
+	c.t.Helper()
+	c.send(map[string]interface{}{"jsonrpc": "2.0", "method": method, "params": params})
+}
+
+// request sends a request and decodes the result of its response into result.
+func (c *client) request(method string, params interface{}, result interface{}) {
+	c.t.Helper()
+	c.nextID++
+	c.send(map[string]interface{}{"jsonrpc": "2.0", "id": c.nextID, "method": method, "params": params})
+
+	msg := c.receive()
+	if string(msg["id"]) != strconv.Itoa(c.nextID) {
+		c.t.Fatalf("%s: response has id %s, want %d", method, msg["id"], c.nextID)
+	}
+	if rpcErr, ok := msg["error"]; ok {
+		c.t.Fatalf("%s: %s", method, rpcErr)
+	}
+	if result != nil {
+		if err := json.Unmarshal(msg["result"], result); err != nil {
+			c.t.Fatalf("%s: %v", method, err)
+		}
+	}
+}
+
+func positionParams(uri string, line int, character int) textDocumentPositionParams {
+	return textDocumentPositionParams{
+		TextDocument: textDocumentIdentifier{URI: uri},
+		Position:     position{Line: line, Character: character},
+	}
+}
+
+func writeFile(t *testing.T, path string, text string) {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, []byte(text), 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestServerSession(t *testing.T) {
+	dir := t.TempDir()
+	writeFile(t, filepath.Join(dir, "lib.cm"), "@define(shout text add(text `!`))@include(`sub/deep.cm`)")
+	writeFile(t, filepath.Join(dir, "sub", "deep.cm"), "@define(deep `D`)")
+
+	mainPath := filepath.Join(dir, "main.cm")
+	uri := pathToURI(mainPath)
+	text := "@define(greet name add(`Hi ` name))\n" +
+		"@include(`lib.cm`)\n" +
+		"@greet(`a`) @shout(`b`) @deep() @set(missing 1)\n"
+
+	c := newClient(t, Options{})
+
+	var initResult struct {
+		Capabilities map[string]json.RawMessage `json:"capabilities"`
+	}
+	c.request("initialize", map[string]interface{}{}, &initResult)
+	for _, capability := range []string{"definitionProvider", "hoverProvider", "completionProvider", "documentSymbolProvider"} {
+		if _, ok := initResult.Capabilities[capability]; !ok {
+			t.Errorf("initialize: missing capability %s", capability)
+		}
+	}
+	c.notify("initialized", map[string]interface{}{})
+
+	c.notify("textDocument/didOpen", didOpenParams{TextDocument: textDocumentItem{URI: uri, LanguageID: "cutter", Version: 1, Text: text}})
+	var published struct {
+		Method string                   `json:"method"`
+		Params publishDiagnosticsParams `json:"params"`
+	}
+	msg := c.receive()
+	raw, _ := json.Marshal(msg)
+	if err := json.Unmarshal(raw, &published); err != nil {
+		t.Fatal(err)
+	}
+	if published.Method != "textDocument/publishDiagnostics" || published.Params.URI != uri {
+		t.Fatalf("didOpen: got %s", raw)
+	}
+	if len(published.Params.Diagnostics) != 1 || published.Params.Diagnostics[0].Code != "undefined-set" {
+		t.Errorf("didOpen: diagnostics %+v, want one undefined-set", published.Params.Diagnostics)
+	}
+
+	definitionTests := []struct {
+		name      string
+		character int
+		path      string
+		line      int
+	}{
+		{"greet", 2, mainPath, 0},
+		{"shout", 15, filepath.Join(dir, "lib.cm"), 0},
+		{"deep", 26, filepath.Join(dir, "sub", "deep.cm"), 0},
+	}
+	for _, test := range definitionTests {
+		var locations []location
+		c.request("textDocument/definition", positionParams(uri, 2, test.character), &locations)
+		if len(locations) != 1 || locations[0].URI != pathToURI(test.path) || locations[0].Range.Start.Line != test.line {
+			t.Errorf("definition of %s: got %+v, want %s:%d", test.name, locations, test.path, test.line)
+		}
+	}
+
+	var hoverResult hover
+	c.request("textDocument/hover", positionParams(uri, 2, 26), &hoverResult)
+	if !strings.Contains(hoverResult.Contents.Value, "@define(deep `D`)") || !strings.Contains(hoverResult.Contents.Value, "deep.cm:1") {
+		t.Errorf("hover of deep: got %q", hoverResult.Contents.Value)
+	}
+	c.request("textDocument/hover", positionParams(uri, 2, 34), &hoverResult)
+	if !strings.Contains(hoverResult.Contents.Value, "standard function") {
+		t.Errorf("hover of set: got %q", hoverResult.Contents.Value)
+	}
+
+	var items []completionItem
+	c.request("textDocument/completion", positionParams(uri, 2, 1), &items)
+	kinds := make(map[string]int)
+	for _, item := range items {
+		kinds[item.Label] = item.Kind
+	}
+	wantKinds := map[string]int{
+		"greet": completionKindFunction,
+		"shout": completionKindFunction,
+		"deep":  completionKindVariable,
+		"echo":  completionKindFunction,
+		"for":   completionKindFunction,
+	}
+	for label, kind := range wantKinds {
+		if kinds[label] != kind {
+			t.Errorf("completion: %s has kind %d, want %d", label, kinds[label], kind)
+		}
+	}
+
+	var symbols []documentSymbol
+	c.request("textDocument/documentSymbol", documentSymbolParams{TextDocument: textDocumentIdentifier{URI: uri}}, &symbols)
+	if len(symbols) != 1 || symbols[0].Name != "greet" || symbols[0].Detail != "name" {
+		t.Errorf("documentSymbol: got %+v, want only greet", symbols)
+	}
+
+	c.request("shutdown", nil, nil)
+	c.notify("exit", nil)
+	if err := <-c.done; err != nil {
+		t.Errorf("Run: %v", err)
+	}
+}
+
+func TestServerExitWithoutShutdown(t *testing.T) {
+	c := newClient(t, Options{})
+	c.request("initialize", map[string]interface{}{}, nil)
+	c.notify("exit", nil)
+	if err := <-c.done; err != ErrNoShutdown {
+		t.Errorf("Run: got %v, want ErrNoShutdown", err)
+	}
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"cutter/lexer"
+	"cutter/lsp"
+	"flag"
+	"fmt"
+	"os"
+)
+
+func runLspCommand(args []string) int {
+	flags := flag.NewFlagSet("lsp", flag.ExitOnError)
+	includeAnyExtFlag := flags.Bool("includeanyext", false, "Allow @include of files without the .cm extension")
+	var includeDirs pathListFlag
+	flags.Var(&includeDirs, "I", "Search dir for included files after the including file's directory (repeatable)")
+	trimLinesFlag := flags.Bool("trimlines", false, "Remove lines that contain only directives and whitespace")
+	delimiters := lexer.DefaultDelimiters()
+	flags.Var(delimitersFlag{&delimiters}, "delims", "Replace the call, open, close and quote delimiters, e.g. '$ [ ] \"'")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "usage: cutter lsp [flags]")
+		fmt.Fprintln(flags.Output(), "Runs a Language Server Protocol server on standard input and output.")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	if flags.NArg() != 0 {
+		flags.Usage()
+		return ExitUsage
+	}
+
+	server := lsp.NewServer(os.Stdin, os.Stdout, lsp.Options{
+		Lexer:               lexer.Options{TrimLines: *trimLinesFlag, Delimiters: delimiters},
+		IncludeAnyExtension: *includeAnyExtFlag,
+		IncludePath:         includePath(includeDirs),
+	})
+	if err := server.Run(); err != nil {
+		return reportError(err)
+	}
+	return ExitOK
+}
@@ -7,42 +7,144 @@ import (
 	"cutter/runtime"
 	"flag"
 	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
 )
 
 func main() {
-	versionFlag := flag.Bool("v", false, "Show Version")
-	debugFlag := flag.Bool("d", false, "Debug Mode")
-	writeToFileFlag := flag.String("w", "", "Write excution result to file")
-	input := flag.String("i", "", "Input file")
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "test":
+			os.Exit(runTestCommand(os.Args[2:]))
+		case "repl":
+			os.Exit(runReplCommand(os.Args[2:]))
+		case "ast":
+			os.Exit(runAstCommand(os.Args[2:]))
+		case "fmt":
+			os.Exit(runFmtCommand(os.Args[2:]))
+		case "lint":
+			os.Exit(runLintCommand(os.Args[2:]))
+		case "lsp":
+			os.Exit(runLspCommand(os.Args[2:]))
+		}
+	}
+
+	os.Exit(runTemplateCommand(os.Args[1:]))
+}
+
+func runTemplateCommand(args []string) int {
+	flags := flag.NewFlagSet("cutter", flag.ExitOnError)
+	versionFlag := flags.Bool("v", false, "Show Version")
+	debugFlag := flags.Bool("d", false, "Debug Mode")
+	writeToFileFlag := flags.String("w", "", "Write excution result to file")
+	input := flags.String("i", "", "Input file (- reads standard input)")
+	anyExtFlag := flags.Bool("anyext", false, "Accept an input file without the .cm extension")
+	includeAnyExtFlag := flags.Bool("includeanyext", false, "Allow @include of files without the .cm extension")
+	var includeDirs pathListFlag
+	flags.Var(&includeDirs, "I", "Search dir for included files after the including file's directory (repeatable)")
+	coverFlag := flags.String("cover", "", "Write an LCOV coverage profile to file")
+	coverHTMLFlag := flags.String("coverhtml", "", "Write an HTML coverage report to file")
+	coverAppendFlag := flags.Bool("coverappend", false, "Merge coverage into the existing -cover profile")
+	defines := newDefineFlags()
+	flags.Var(defines, "D", "Define an object as name=value or name:type=value (repeatable)")
+	var dataFiles dataFlags
+	flags.Var(&dataFiles, "data", "Bind a JSON file as objects, optionally under a prefix: [prefix=]file.json (repeatable)")
+	flags.Var(csvFlags{&dataFiles}, "csv", "Bind the rows of a CSV/TSV file as records under a prefix (default: file name): [prefix=]file.csv (repeatable)")
+	var csv csvSettings
+	flags.StringVar(&csv.Delimiter, "csvdelim", "", "Field delimiter of -csv files (default: tab for .tsv, comma otherwise)")
+	flags.BoolVar(&csv.NoHeader, "csvnoheader", false, "-csv files have no header row; columns are numbered from 0")
+	flags.BoolVar(&csv.NoQuote, "csvnoquote", false, "Treat double quotes in -csv files as ordinary characters")
+	trimLinesFlag := flags.Bool("trimlines", false, "Remove lines that contain only directives and whitespace")
+	outDirFlag := flags.String("out-dir", ".", "Directory for the files selected with @output")
+	var roots pathListFlag
+	flags.Var(&roots, "root", "Allow the file functions to access dir (repeatable; default: the template's directory)")
+	delimiters := lexer.DefaultDelimiters()
+	flags.Var(delimitersFlag{&delimiters}, "delims", "Replace the call, open, close and quote delimiters, e.g. '$ [ ] \"'")
 
-	flag.Parse()
+	flags.Parse(args)
 
 	if *versionFlag {
 		fmt.Println("Cutter Runtime Version: " + etc.RUNTIMEVERSION)
-		return
+		return ExitOK
 	}
 
 	if *input == "" {
-		fmt.Println("No input file specified")
-		return
+		fmt.Fprintln(os.Stderr, "cutter: no input file specified")
+		flags.Usage()
+		return ExitUsage
 	}
 
-	source, err := etc.ReadFile(*input)
+	showStacks = *debugFlag
+
+	// The template is lexed and parsed while it is read.
+	var source io.Reader = os.Stdin
+	sourceName := *input
+	if *input == etc.StdinFileName {
+		sourceName = etc.StdinSourceName
+	} else {
+		file, err := etc.OpenFile(*input, *anyExtFlag)
+		if err != nil {
+			return reportError(newCLIError(ExitIO, "i/o error", err))
+		}
+		defer file.Close()
+		source = file
+	}
+
+	data, err := dataFiles.load(csv)
 	if err != nil {
-		panic(err)
+		return reportError(newCLIError(ExitIO, "i/o error", err))
 	}
 
-	lex := lexer.NewLexer()
-	pas := parser.NewParser()
-	com := runtime.NewCompiler()
+	lexOptions := lexer.Options{TrimLines: *trimLinesFlag, Delimiters: delimiters}
+
+	lex := lexer.NewLexerWithOptions(sourceName, lexOptions)
+	lex.SetInput(source)
+
+	var ast parser.HeadNode
+	err = catchStage(ExitSyntax, "syntax error", func() {
+		ast = parser.NewParser().ParseStream(lex)
+	})
+	if lex.Err() != nil {
+		return reportError(newCLIError(ExitIO, "i/o error", lex.Err()))
+	}
+	if err != nil {
+		return reportError(err)
+	}
 
-	tokens := lex.DoLex(source)
-	ast := pas.DoParse(tokens)
+	com := runtime.NewCompiler()
+	com.SetIncludeAnyExtension(*includeAnyExtFlag)
+	com.SetIncludePath(includePath(includeDirs))
+	com.SetLexerOptions(lexOptions)
+	data.DefineIn(com)
+	defines.applyToCompiler(com)
 
-	vmInstr := com.CompileASTToVMInstr(ast)
+	var vmInstr []runtime.VMInstr
+	err = catchStage(ExitCompile, "compile error", func() {
+		vmInstr = com.CompileASTToVMInstr(ast)
+	})
+	if err != nil {
+		return reportError(err)
+	}
 
 	vm := runtime.NewVM(vmInstr)
-	vm.Run()
+	vm.Files = runtime.NewFileSandbox(templateDir(*input), roots)
+	data.BindTo(vm)
+	defines.applyToVM(vm)
+	if *coverFlag != "" || *coverHTMLFlag != "" {
+		vm.EnableCoverage()
+	}
+	runErr := catchStage(ExitRuntime, "runtime error", vm.Run)
+
+	if vm.Coverage != nil {
+		profile := runtime.NewCoverageProfile()
+		profile.AddRun(vm)
+		err := writeCoverage(profile, *coverFlag, *coverHTMLFlag, *coverAppendFlag)
+		if err != nil {
+			return reportError(newCLIError(ExitIO, "i/o error", err))
+		}
+	}
 
 	if *debugFlag {
 		runtime.DumpRegisters(vm)
@@ -58,12 +160,128 @@ func main() {
 		}
 	}
 
+	if runErr != nil {
+		return reportError(runErr)
+	}
+
 	result := vm.IO.ReadBuffer()
 
 	if *writeToFileFlag != "" {
-		etc.WriteFile(*writeToFileFlag, result)
+		if err := etc.WriteFile(*writeToFileFlag, result); err != nil {
+			return reportError(newCLIError(ExitIO, "i/o error", err))
+		}
 	} else {
 		fmt.Println(result)
 	}
 
+	written, err := vm.IO.WriteFiles(*outDirFlag)
+	for _, path := range written {
+		fmt.Fprintln(os.Stderr, "cutter: wrote", path)
+	}
+	if err != nil {
+		return reportError(newCLIError(ExitIO, "i/o error", err))
+	}
+
+	return vm.ExitCode
+}
+
+// pathListFlag collects a repeated path option.
+type pathListFlag []string
+
+func (p *pathListFlag) String() string {
+	return strings.Join(*p, ",")
+}
+
+func (p *pathListFlag) Set(arg string) error {
+	*p = append(*p, arg)
+	return nil
+}
+
+// includePath is the search path of @include: the -I directories, then the
+// ones listed in the environment.
+func includePath(dirs pathListFlag) []string {
+	return append(append([]string{}, dirs...), etc.IncludePathFromEnv()...)
+}
+
+// delimitersFlag parses up to four space separated delimiters, in the order
+// call, open, close, quote.
+type delimitersFlag struct {
+	delimiters *lexer.Delimiters
+}
+
+func (d delimitersFlag) String() string {
+	if d.delimiters == nil {
+		return ""
+	}
+	return strings.Join([]string{d.delimiters.Call, d.delimiters.Open, d.delimiters.Close, d.delimiters.Quote}, " ")
+}
+
+func (d delimitersFlag) Set(arg string) error {
+	delimiters, err := lexer.DefaultDelimiters().With(strings.Fields(arg))
+	if err != nil {
+		return err
+	}
+	*d.delimiters = delimiters
+	return nil
+}
+
+// templateDir is the directory that relative paths of a template resolve against.
+func templateDir(fileName string) string {
+	if fileName == etc.StdinFileName || fileName == etc.StdinSourceName {
+		return "."
+	}
+	return filepath.Dir(fileName)
+}
+
+// parseTemplate runs the lexer and parser over a template source.
+func parseTemplate(source string, fileName string, options lexer.Options) parser.HeadNode {
+	lex := lexer.NewLexerWithOptions(fileName, options)
+	lex.SetInput(strings.NewReader(source))
+
+	return parser.NewParser().ParseStream(lex)
+}
+
+// compileTemplate runs the lexer, parser and compiler over a template source.
+func compileTemplate(com *runtime.Compiler, source string, fileName string) []runtime.VMInstr {
+	return com.CompileASTToVMInstr(parseTemplate(source, fileName, com.LexerOptions()))
+}
+
+func writeCoverage(profile *runtime.CoverageProfile, lcovPath string, htmlPath string, appendProfile bool) error {
+	if appendProfile && lcovPath != "" {
+		f, err := os.Open(lcovPath)
+		if err == nil {
+			previous, err := runtime.ReadLCOV(f)
+			f.Close()
+			if err != nil {
+				return err
+			}
+			profile.Merge(previous)
+		} else if !os.IsNotExist(err) {
+			return err
+		}
+	}
+
+	if lcovPath != "" {
+		f, err := os.Create(lcovPath)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		if err := profile.WriteLCOV(f); err != nil {
+			return err
+		}
+	}
+
+	if htmlPath != "" {
+		f, err := os.Create(htmlPath)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		if err := profile.WriteHTML(f); err != nil {
+			return err
+		}
+	}
+
+	return nil
 }
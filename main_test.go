@@ -0,0 +1,136 @@
+package main
+
+import (
+	"cutter/etc"
+	"cutter/lexer"
+	"cutter/runtime"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestIncludePath(t *testing.T) {
+	dir := t.TempDir()
+	env := []string{filepath.Join(dir, "env1"), filepath.Join(dir, "env2")}
+	t.Setenv(etc.IncludePathEnv, env[0]+string(os.PathListSeparator)+env[1])
+
+	flags := pathListFlag{filepath.Join(dir, "i1"), filepath.Join(dir, "i2")}
+	want := []string{flags[0], flags[1], env[0], env[1]}
+	if got := includePath(flags); !reflect.DeepEqual(got, want) {
+		t.Errorf("includePath = %q, want %q", got, want)
+	}
+
+	// The -I directory is searched before CUTTER_PATH.
+	writeTree(t, dir, map[string]string{"i1/lib.cm": "from -I", "env1/lib.cm": "from CUTTER_PATH", "env2/other.cm": "other"})
+	for name, want := range map[string]string{"lib.cm": "from -I\n", "other.cm": "other\n"} {
+		result, err := renderTemplate("@include(`"+name+"`)", filepath.Join(dir, "page.cm"), goldenOptions, includePath(flags), runtime.NewDataSet(), nil)
+		if err != nil {
+			t.Errorf("%s: %v", name, err)
+			continue
+		}
+		if result.Output != want {
+			t.Errorf("%s: output %q, want %q", name, result.Output, want)
+		}
+	}
+
+	t.Setenv(etc.IncludePathEnv, "")
+	if got := includePath(nil); len(got) != 0 {
+		t.Errorf("includePath without -I or CUTTER_PATH = %q", got)
+	}
+}
+
+func TestDelimitersFlag(t *testing.T) {
+	tests := []struct {
+		arg  string
+		want lexer.Delimiters
+		err  string
+	}{
+		{`$ [ ] "`, lexer.Delimiters{Call: "$", Open: "[", Close: "]", Quote: `"`}, ""},
+		{"  <%  {{  }}  ", lexer.Delimiters{Call: "<%", Open: "{{", Close: "}}", Quote: "`"}, ""},
+		{"$", lexer.Delimiters{Call: "$", Open: "(", Close: ")", Quote: "`"}, ""},
+		{"", lexer.DefaultDelimiters(), ""},
+		{"a b c d e", lexer.Delimiters{}, "expected at most 4 delimiters"},
+		{"$ $", lexer.Delimiters{}, `the call and open delimiters are both "$"`},
+		{"- ( )", lexer.Delimiters{}, `"--" would be both the trimming call and the escape keyword`},
+	}
+
+	for _, test := range tests {
+		delimiters := lexer.DefaultDelimiters()
+		err := delimitersFlag{&delimiters}.Set(test.arg)
+		if test.err != "" {
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("-delims %q: error %v, want %q", test.arg, err, test.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("-delims %q: unexpected error %v", test.arg, err)
+			continue
+		}
+		if delimiters != test.want {
+			t.Errorf("-delims %q = %+v, want %+v", test.arg, delimiters, test.want)
+		}
+		if got := (delimitersFlag{&delimiters}).String(); got != strings.Join([]string{test.want.Call, test.want.Open, test.want.Close, test.want.Quote}, " ") {
+			t.Errorf("-delims %q prints as %q", test.arg, got)
+		}
+	}
+}
+
+func TestStdinInput(t *testing.T) {
+	tests := []struct {
+		stdin  string
+		code   int
+		stdout string
+		stderr string
+	}{
+		{"hi @add(1 2)", ExitOK, "hi 3\n", ""},
+		{"a\n@echo(1", ExitSyntax, "", "cutter: syntax error: <stdin>:2:8: unexpected end of input, expected ')'\n"},
+		{"a\n@nosuch(1)", ExitCompile, "", "cutter: compile error: <stdin>:2:2: undefined object 'nosuch'\n"},
+	}
+
+	for _, test := range tests {
+		code, stdout, stderr := runCLI(t, test.stdin, "-i", "-")
+		if code != test.code || stdout != test.stdout || stderr != test.stderr {
+			t.Errorf("%q: exit code %d, stdout %q, stderr %q; want %d, %q, %q",
+				test.stdin, code, stdout, stderr, test.code, test.stdout, test.stderr)
+		}
+	}
+}
+
+func TestExtensionFlags(t *testing.T) {
+	dir := t.TempDir()
+	writeTree(t, dir, map[string]string{
+		"page.txt": "page",
+		"main.cm":  "@include(`lib.txt`)",
+		"lib.txt":  "lib",
+	})
+	page := filepath.Join(dir, "page.txt")
+	main := filepath.Join(dir, "main.cm")
+	notCutter := "not a Cutter(.cm) file: " + filepath.Join(dir, "lib.txt")
+
+	tests := []struct {
+		args   []string
+		code   int
+		stdout string
+		stderr string
+	}{
+		{[]string{"-i", page}, ExitIO, "", "not a Cutter(.cm) file"},
+		{[]string{"-anyext", "-i", page}, ExitOK, "page\n", ""},
+		{[]string{"-i", main}, ExitCompile, "", notCutter},
+		{[]string{"-anyext", "-i", main}, ExitCompile, "", notCutter},
+		{[]string{"-includeanyext", "-i", main}, ExitOK, "lib\n", ""},
+		{[]string{"-includeanyext", "-i", page}, ExitIO, "", "not a Cutter(.cm) file"},
+	}
+
+	for _, test := range tests {
+		code, stdout, stderr := runCLI(t, "", test.args...)
+		if code != test.code || stdout != test.stdout {
+			t.Errorf("%q: exit code %d, stdout %q; want %d, %q (stderr %q)", test.args, code, stdout, test.code, test.stdout, stderr)
+		}
+		if test.stderr == "" && stderr != "" || !strings.Contains(stderr, test.stderr) {
+			t.Errorf("%q: stderr %q, want it to contain %q", test.args, stderr, test.stderr)
+		}
+	}
+}
@@ -1,5 +1,7 @@
 package parser
 
+import "cutter/lexer"
+
 type ValueType int
 type FunctionType int
 
@@ -28,6 +30,8 @@ type Argument struct {
 	Literal  ValueObject
 	Callable CallObject
 	VarName  string
+
+	Pos lexer.Position
 }
 
 type FunctionObject struct {
@@ -37,11 +41,17 @@ type FunctionObject struct {
 	Parameters []string
 	Body       CallObject
 	StaticData ValueObject
+
+	Pos lexer.Position
+	End lexer.Position // the closing bracket
 }
 
 type CallObject struct {
 	Name      string
 	Arguments []Argument
+
+	Pos lexer.Position
+	End lexer.Position // the closing bracket; unset for a bare name
 }
 
 type ValueObject struct {
@@ -55,6 +65,9 @@ type ValueObject struct {
 
 type NormStringObject struct {
 	Data string
+
+	Pos lexer.Position
+	End lexer.Position // the last character
 }
 
 func makeIntValueObj(input int64) ValueObject {
@@ -0,0 +1,300 @@
+package parser
+
+import (
+	"cutter/lexer"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+)
+
+// ASTSchemaVersion is the version of the JSON form of the AST written by
+// EncodeJSON. It changes only when existing fields change meaning.
+const ASTSchemaVersion = 1
+
+// jsonDocument is the JSON form of a HeadNode:
+//
+//	{"schema": 1, "file": "page.cm", "body": [node...]}
+//
+// Every node has a "kind" and a "span" whose "start" is the position of the
+// node and whose "end", when present, is the position of its last character
+// (the closing bracket of calls and definitions). Lines and columns are 1-based.
+//
+//	text      "text"
+//	call      "name", "args": [node...]   (include is a call named include)
+//	define    "name", "params": [string...], "body": call, "static": literal
+//	literal   "type": int|real|string|bool, "value"
+//	variable  "name"
+type jsonDocument struct {
+	Schema int        `json:"schema"`
+	File   string     `json:"file"`
+	Body   []jsonNode `json:"body"`
+}
+
+type jsonPosition struct {
+	Line   int `json:"line"`
+	Column int `json:"column"`
+}
+
+type jsonSpan struct {
+	Start jsonPosition  `json:"start"`
+	End   *jsonPosition `json:"end,omitempty"`
+}
+
+type jsonNode struct {
+	Kind string    `json:"kind"`
+	Span *jsonSpan `json:"span,omitempty"`
+
+	Text   string          `json:"text,omitempty"`
+	Name   string          `json:"name,omitempty"`
+	Args   []jsonNode      `json:"args,omitempty"`
+	Params []string        `json:"params,omitempty"`
+	Body   *jsonNode       `json:"body,omitempty"`
+	Static *jsonNode       `json:"static,omitempty"`
+	Type   string          `json:"type,omitempty"`
+	Value  json.RawMessage `json:"value,omitempty"`
+}
+
+const (
+	jsonKindText     = "text"
+	jsonKindCall     = "call"
+	jsonKindDefine   = "define"
+	jsonKindLiteral  = "literal"
+	jsonKindVariable = "variable"
+)
+
+var jsonLiteralTypes = map[ValueType]string{
+	INTGER:  "int",
+	REAL:    "real",
+	STRING:  "string",
+	BOOLEAN: "bool",
+}
+
+// EncodeJSON writes head as an indented JSON document for file.
+func EncodeJSON(w io.Writer, file string, head HeadNode) error {
+	doc := jsonDocument{Schema: ASTSchemaVersion, File: file, Body: make([]jsonNode, 0, len(head.Bodys))}
+	for _, body := range head.Bodys {
+		switch body.Type {
+		case NORM_STRINGS:
+			doc.Body = append(doc.Body, jsonNode{Kind: jsonKindText, Span: spanToJSON(body.Norm.Pos, body.Norm.End), Text: body.Norm.Data})
+		case FUNCTION_CALL:
+			doc.Body = append(doc.Body, callToJSON(body.Call))
+		case FUCNTION_DEFINITION:
+			doc.Body = append(doc.Body, defineToJSON(body.Func))
+		}
+	}
+
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(doc)
+}
+
+func positionToJSON(pos lexer.Position) *jsonPosition {
+	if !pos.IsValid() {
+		return nil
+	}
+	return &jsonPosition{Line: pos.Line, Column: pos.Column}
+}
+
+func spanToJSON(start lexer.Position, end lexer.Position) *jsonSpan {
+	if !start.IsValid() {
+		return nil
+	}
+	return &jsonSpan{Start: *positionToJSON(start), End: positionToJSON(end)}
+}
+
+func callToJSON(call CallObject) jsonNode {
+	node := jsonNode{Kind: jsonKindCall, Span: spanToJSON(call.Pos, call.End), Name: call.Name}
+	for _, arg := range call.Arguments {
+		switch arg.Type {
+		case ARG_LITERAL:
+			node.Args = append(node.Args, literalToJSON(arg.Literal, arg.Pos))
+		case ARG_VARIABLE:
+			node.Args = append(node.Args, jsonNode{Kind: jsonKindVariable, Span: spanToJSON(arg.Pos, lexer.Position{}), Name: arg.VarName})
+		case ARG_CALLABLE:
+			node.Args = append(node.Args, callToJSON(arg.Callable))
+		}
+	}
+	return node
+}
+
+func defineToJSON(fun FunctionObject) jsonNode {
+	node := jsonNode{Kind: jsonKindDefine, Span: spanToJSON(fun.Pos, fun.End), Name: fun.Name, Params: fun.Parameters}
+	if fun.Body.Name != "" {
+		body := callToJSON(fun.Body)
+		node.Body = &body
+	}
+	if fun.StaticData.Type != 0 {
+		static := literalToJSON(fun.StaticData, lexer.Position{})
+		node.Static = &static
+	}
+	return node
+}
+
+func literalToJSON(value ValueObject, pos lexer.Position) jsonNode {
+	node := jsonNode{Kind: jsonKindLiteral, Span: spanToJSON(pos, lexer.Position{}), Type: jsonLiteralTypes[value.Type]}
+	switch value.Type {
+	case INTGER:
+		node.Value = json.RawMessage(strconv.FormatInt(value.IntData, 10))
+	case REAL:
+		node.Value = json.RawMessage(strconv.FormatFloat(value.FloatData, 'g', -1, 64))
+	case STRING:
+		node.Value, _ = json.Marshal(value.StringData)
+	case BOOLEAN:
+		node.Value = json.RawMessage(strconv.FormatBool(value.BoolData))
+	}
+	return node
+}
+
+// DecodeJSON rebuilds a HeadNode from a document written by EncodeJSON and
+// returns it with the file name of the document.
+func DecodeJSON(r io.Reader) (HeadNode, string, error) {
+	var doc jsonDocument
+	dec := json.NewDecoder(r)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&doc); err != nil {
+		return HeadNode{}, "", err
+	}
+	if doc.Schema != ASTSchemaVersion {
+		return HeadNode{}, "", fmt.Errorf("unsupported AST schema %d, expected %d", doc.Schema, ASTSchemaVersion)
+	}
+
+	d := jsonDecoder{file: doc.File}
+	head := HeadNode{Bodys: make([]BodyObject, 0, len(doc.Body))}
+	for i, node := range doc.Body {
+		path := fmt.Sprintf("body[%d]", i)
+		switch node.Kind {
+		case jsonKindText:
+			start, end := d.span(node.Span)
+			head.Bodys = append(head.Bodys, BodyObject{Type: NORM_STRINGS, Norm: NormStringObject{Data: node.Text, Pos: start, End: end}})
+		case jsonKindCall:
+			call, err := d.call(node, path)
+			if err != nil {
+				return HeadNode{}, "", err
+			}
+			head.Bodys = append(head.Bodys, NewCallBodyObject(call))
+		case jsonKindDefine:
+			fun, err := d.define(node, path)
+			if err != nil {
+				return HeadNode{}, "", err
+			}
+			head.Bodys = append(head.Bodys, NewFunctionBodyObject(fun))
+		default:
+			return HeadNode{}, "", fmt.Errorf("%s: unexpected node kind %q", path, node.Kind)
+		}
+	}
+	return head, doc.File, nil
+}
+
+type jsonDecoder struct {
+	file string
+}
+
+func (d jsonDecoder) position(pos *jsonPosition) lexer.Position {
+	if pos == nil {
+		return lexer.Position{}
+	}
+	return lexer.Position{File: d.file, Line: pos.Line, Column: pos.Column}
+}
+
+func (d jsonDecoder) span(span *jsonSpan) (lexer.Position, lexer.Position) {
+	if span == nil {
+		return lexer.Position{}, lexer.Position{}
+	}
+	return d.position(&span.Start), d.position(span.End)
+}
+
+func (d jsonDecoder) call(node jsonNode, path string) (CallObject, error) {
+	if node.Kind != jsonKindCall {
+		return CallObject{}, fmt.Errorf("%s: expected a call, got %q", path, node.Kind)
+	}
+	if node.Name == "" {
+		return CallObject{}, fmt.Errorf("%s: call without a name", path)
+	}
+
+	call := CallObject{Name: node.Name, Arguments: make([]Argument, 0, len(node.Args))}
+	call.Pos, call.End = d.span(node.Span)
+
+	for i, argNode := range node.Args {
+		argPath := fmt.Sprintf("%s.args[%d]", path, i)
+		pos, _ := d.span(argNode.Span)
+
+		switch argNode.Kind {
+		case jsonKindLiteral:
+			value, err := d.literal(argNode, argPath)
+			if err != nil {
+				return CallObject{}, err
+			}
+			call.Arguments = append(call.Arguments, Argument{Type: ARG_LITERAL, Literal: value, Pos: pos})
+		case jsonKindVariable:
+			if argNode.Name == "" {
+				return CallObject{}, fmt.Errorf("%s: variable without a name", argPath)
+			}
+			call.Arguments = append(call.Arguments, Argument{Type: ARG_VARIABLE, VarName: argNode.Name, Pos: pos})
+		case jsonKindCall:
+			sub, err := d.call(argNode, argPath)
+			if err != nil {
+				return CallObject{}, err
+			}
+			call.Arguments = append(call.Arguments, Argument{Type: ARG_CALLABLE, Callable: sub, Pos: pos})
+		default:
+			return CallObject{}, fmt.Errorf("%s: unexpected argument kind %q", argPath, argNode.Kind)
+		}
+	}
+	return call, nil
+}
+
+func (d jsonDecoder) define(node jsonNode, path string) (FunctionObject, error) {
+	if node.Name == "" {
+		return FunctionObject{}, fmt.Errorf("%s: define without a name", path)
+	}
+
+	fun := FunctionObject{Name: node.Name, Parameters: make([]string, 0, len(node.Params))}
+	fun.Pos, fun.End = d.span(node.Span)
+	fun.Parameters = append(fun.Parameters, node.Params...)
+
+	if node.Body != nil {
+		body, err := d.call(*node.Body, path+".body")
+		if err != nil {
+			return FunctionObject{}, err
+		}
+		fun.Body = body
+	}
+	if node.Static != nil {
+		value, err := d.literal(*node.Static, path+".static")
+		if err != nil {
+			return FunctionObject{}, err
+		}
+		fun.StaticData = value
+	}
+	return fun, nil
+}
+
+func (d jsonDecoder) literal(node jsonNode, path string) (ValueObject, error) {
+	if node.Kind != jsonKindLiteral {
+		return ValueObject{}, fmt.Errorf("%s: expected a literal, got %q", path, node.Kind)
+	}
+
+	var err error
+	value := ValueObject{}
+	switch node.Type {
+	case "int":
+		value.Type = INTGER
+		value.IntData, err = strconv.ParseInt(string(node.Value), 10, 64)
+	case "real":
+		value.Type = REAL
+		value.FloatData, err = strconv.ParseFloat(string(node.Value), 64)
+	case "string":
+		value.Type = STRING
+		err = json.Unmarshal(node.Value, &value.StringData)
+	case "bool":
+		value.Type = BOOLEAN
+		err = json.Unmarshal(node.Value, &value.BoolData)
+	default:
+		return ValueObject{}, fmt.Errorf("%s: unknown literal type %q", path, node.Type)
+	}
+	if err != nil {
+		return ValueObject{}, fmt.Errorf("%s: invalid %s value %s", path, node.Type, node.Value)
+	}
+	return value, nil
+}
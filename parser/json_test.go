@@ -0,0 +1,98 @@
+package parser
+
+import (
+	"bytes"
+	"cutter/lexer"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestJSONRoundTrip(t *testing.T) {
+	tests := []struct {
+		name   string
+		source string
+	}{
+		{"text", "plain text\nover two lines"},
+		{"empty", ""},
+		{"call", "@echo(`hi`)"},
+		{"call without arguments", "a @exit() b"},
+		{"int literals", "@add(1 -2 0x10 1_000)"},
+		{"real literals", "@add(1.5 -2.5e-3 1e300 .5)"},
+		{"string literals", "@echo(`a\\n\\`b` \"é\\u{1F600}\" ```raw `` \\n```)"},
+		{"bool literals", "@same(!t !f)"},
+		{"variables", "@define(x 1)@echo(x)"},
+		{"nested calls", "@echo(add(strlen(`ab`) add(1 2)))"},
+		{"include", "@include(`lib.cm`)"},
+		{"define with body", "@define(greet name echo(add(`hi ` name)))@greet(`you`)"},
+		{"define with static data", "@define(a 1)@define(b 2.5)@define(c `s`)@define(d !t)"},
+		{"define without parameters", "@define(f echo(`f`))"},
+		{"mixed", "head\n@define(row a b echo(a))\n@row(`1` `2`) tail"},
+	}
+
+	for _, test := range tests {
+		head := NewParser().DoParse(lexer.NewLexerWithFile("page.cm").DoLex(test.source))
+
+		var buf bytes.Buffer
+		if err := EncodeJSON(&buf, "page.cm", head); err != nil {
+			t.Fatalf("%s: EncodeJSON: %v", test.name, err)
+		}
+		decoded, file, err := DecodeJSON(bytes.NewReader(buf.Bytes()))
+		if err != nil {
+			t.Errorf("%s: DecodeJSON: %v\n%s", test.name, err, buf.String())
+			continue
+		}
+		if file != "page.cm" {
+			t.Errorf("%s: file %q, want page.cm", test.name, file)
+		}
+		if !reflect.DeepEqual(decoded, head) {
+			t.Errorf("%s: tree changed in a round trip\nparsed:  %+v\ndecoded: %+v", test.name, head, decoded)
+		}
+
+		var again bytes.Buffer
+		if err := EncodeJSON(&again, file, decoded); err != nil {
+			t.Fatalf("%s: EncodeJSON: %v", test.name, err)
+		}
+		if again.String() != buf.String() {
+			t.Errorf("%s: document changed in a round trip\nfirst:\n%s\nsecond:\n%s", test.name, buf.String(), again.String())
+		}
+	}
+}
+
+func TestDecodeJSONErrors(t *testing.T) {
+	call := func(args string) string {
+		return `{"schema": 1, "file": "a.cm", "body": [{"kind": "call", "name": "echo", "args": [` + args + `]}]}`
+	}
+	tests := []struct {
+		name  string
+		input string
+		err   string
+	}{
+		{"old schema", `{"schema": 0, "file": "a.cm", "body": []}`, "unsupported AST schema 0, expected 1"},
+		{"newer schema", `{"schema": 2, "file": "a.cm", "body": []}`, "unsupported AST schema 2, expected 1"},
+		{"unknown field", `{"schema": 1, "file": "a.cm", "body": [], "extra": 1}`, "unknown field"},
+		{"not json", `schema`, "invalid character"},
+		{"unknown node kind", `{"schema": 1, "file": "a.cm", "body": [{"kind": "macro"}]}`, `body[0]: unexpected node kind "macro"`},
+		{"literal at the top", `{"schema": 1, "file": "a.cm", "body": [{"kind": "literal", "type": "int", "value": 1}]}`, `body[0]: unexpected node kind "literal"`},
+		{"unknown argument kind", call(`{"kind": "text", "text": "x"}`), `body[0].args[0]: unexpected argument kind "text"`},
+		{"call without a name", `{"schema": 1, "file": "a.cm", "body": [{"kind": "call"}]}`, "body[0]: call without a name"},
+		{"variable without a name", call(`{"kind": "variable"}`), "body[0].args[0]: variable without a name"},
+		{"define without a name", `{"schema": 1, "file": "a.cm", "body": [{"kind": "define"}]}`, "body[0]: define without a name"},
+		{"define body not a call", `{"schema": 1, "file": "a.cm", "body": [{"kind": "define", "name": "f", "body": {"kind": "variable", "name": "x"}}]}`, `body[0].body: expected a call, got "variable"`},
+		{"static not a literal", `{"schema": 1, "file": "a.cm", "body": [{"kind": "define", "name": "f", "static": {"kind": "call", "name": "g"}}]}`, `body[0].static: expected a literal, got "call"`},
+		{"unknown literal type", call(`{"kind": "literal", "type": "float", "value": 1}`), `body[0].args[0]: unknown literal type "float"`},
+		{"missing literal type", call(`{"kind": "literal", "value": 1}`), `body[0].args[0]: unknown literal type ""`},
+		{"int holding a real", call(`{"kind": "literal", "type": "int", "value": 1.5}`), "body[0].args[0]: invalid int value 1.5"},
+		{"real holding a string", call(`{"kind": "literal", "type": "real", "value": "x"}`), `body[0].args[0]: invalid real value "x"`},
+		{"string holding a number", call(`{"kind": "literal", "type": "string", "value": 1}`), "body[0].args[0]: invalid string value 1"},
+		{"bool holding a string", call(`{"kind": "literal", "type": "bool", "value": "true"}`), `body[0].args[0]: invalid bool value "true"`},
+		{"nested call", call(`{"kind": "call", "name": "add", "args": [{"kind": "literal", "type": "int"}]}`), "body[0].args[0].args[0]: invalid int value"},
+	}
+
+	for _, test := range tests {
+		_, _, err := DecodeJSON(strings.NewReader(test.input))
+		if err == nil || !strings.Contains(err.Error(), test.err) {
+			t.Errorf("%s: error %v, want %q", test.name, err, test.err)
+		}
+	}
+}
@@ -16,13 +16,13 @@ func NewParser() *Parser {
 }
 
 func (p *Parser) makeTokenError(expected lexer.TokenType, err lexer.LexerToken) {
-	d := fmt.Sprintf("invalid token: %#v, expected was: %d", err, expected)
-	panic("unexpected syntax error - " + d)
+	d := fmt.Sprintf("%s: unexpected %s, expected %s", err.Pos, err.Describe(), err.Name(expected))
+	panic(d)
 }
 
-func (p *Parser) makeDataError(expected lexer.LexerTokenDataType) {
-	d := fmt.Sprintf("invalid data: %d, expected was: %d", p.targets.Seek().Data.Type, expected)
-	panic("unexpected syntax error - " + d)
+func (p *Parser) makeDataError(expected lexer.LexerTokenDataType, got lexer.LexerToken) {
+	d := fmt.Sprintf("%s: unexpected %s, expected %s", got.Pos, got.Describe(), expected)
+	panic(d)
 }
 
 func (p *Parser) validCheckPop(target_token lexer.TokenType) lexer.LexerToken {
@@ -35,10 +35,16 @@ func (p *Parser) validCheckPop(target_token lexer.TokenType) lexer.LexerToken {
 	}
 }
 
+// DoParse parses tokens lexed in advance.
 func (p *Parser) DoParse(tokens []lexer.LexerToken) HeadNode {
+	return p.ParseStream(&sliceSource{tokens: tokens})
+}
+
+// ParseStream parses the tokens of source as it produces them.
+func (p *Parser) ParseStream(source TokenSource) HeadNode {
 	head := HeadNode{}
 	head.Bodys = make([]BodyObject, 0)
-	p.targets = NewParserQueue(tokens, int64(len(tokens)))
+	p.targets = NewParserQueue(source)
 
 	for !p.targets.IsEmpty() {
 		c_token, _ := p.targets.Pop()
@@ -51,47 +57,26 @@ func (p *Parser) DoParse(tokens []lexer.LexerToken) HeadNode {
 				Call: call,
 			})
 
-			if !p.targets.IsEmpty() {
-				next, _ := p.targets.Pop()
-				p.targets.Pushback()
-				if next.Type == lexer.NEWLINE {
-					p.targets.Pop()
-				}
-			}
-
 		case lexer.KEYWORD_DEFINE:
 			fun := p.doDefineParse()
+			fun.Pos = c_token.Pos
 			head.Bodys = append(head.Bodys, BodyObject{
 				Type: FUCNTION_DEFINITION,
 				Func: fun,
 			})
 
-			if !p.targets.IsEmpty() {
-				next, _ := p.targets.Pop()
-				p.targets.Pushback()
-				if next.Type == lexer.NEWLINE {
-					p.targets.Pop()
-				}
-			}
 		case lexer.KEYWORD_INCLUDE:
 			call := p.doIncludeParse()
+			call.Pos = c_token.Pos
 			head.Bodys = append(head.Bodys, BodyObject{
 				Type: FUNCTION_CALL,
 				Call: call,
 			})
 
-			if !p.targets.IsEmpty() {
-				next, _ := p.targets.Pop()
-				p.targets.Pushback()
-				if next.Type == lexer.NEWLINE {
-					p.targets.Pop()
-				}
-			}
-
 		case lexer.NORM_STRINGS:
 			head.Bodys = append(head.Bodys, BodyObject{
 				Type: NORM_STRINGS,
-				Norm: NormStringObject{Data: c_token.Data.NormData},
+				Norm: NormStringObject{Data: c_token.Data.NormData, Pos: c_token.Pos, End: textEnd(c_token.Pos, c_token.Data.NormData)},
 			})
 
 		default:
@@ -112,47 +97,53 @@ func (p *Parser) doIncludeParse() CallObject {
 
 	object, ok := p.targets.Pop()
 	if !ok {
-		panic("unexpected end of token stream, expected ')'")
+		panic(fmt.Sprintf("unexpected end of token stream, expected %s", p.targets.Last().Name(lexer.KEYWORD_BRACKET_CLOSE)))
 	}
 
 	if object.Data.Type != lexer.DATA_STR {
-		p.makeDataError(lexer.DATA_STR)
+		p.makeDataError(lexer.DATA_STR, object)
 	}
-	call.Arguments = append(call.Arguments, Argument{Type: ARG_LITERAL, Literal: makeStrValueObj(object.Data.StrData)})
+	call.Arguments = append(call.Arguments, Argument{Type: ARG_LITERAL, Literal: makeStrValueObj(object.Data.StrData), Pos: object.Pos})
 
-	p.validCheckPop(lexer.KEYWORD_BRACKET_CLOSE)
+	call.End = p.validCheckPop(lexer.KEYWORD_BRACKET_CLOSE).Pos
 
 	return call
 }
 
 func (p *Parser) doCallParse() CallObject {
-	var call CallObject = CallObject{}
-	call.Arguments = make([]Argument, 0)
-
 	object := p.validCheckPop(lexer.VALUE)
 	if object.Data.Type != lexer.DATA_OBJNAME {
-		p.makeDataError(lexer.DATA_OBJNAME)
+		p.makeDataError(lexer.DATA_OBJNAME, object)
 	}
-	call.Name = object.Data.ObjNameData
+	return p.doCallArgumentsParse(object)
+}
+
+// doCallArgumentsParse parses the bracketed arguments of a call whose name was
+// already consumed.
+func (p *Parser) doCallArgumentsParse(name lexer.LexerToken) CallObject {
+	var call CallObject = CallObject{}
+	call.Arguments = make([]Argument, 0)
+	call.Name = name.Data.ObjNameData
+	call.Pos = name.Pos
 
 	p.validCheckPop(lexer.KEYWORD_BRACKET_OPEN)
 
 	for {
 		// Peek at the next token to see if it's the end
-		next, ok := p.targets.Pop()
-		if !ok {
-			panic("unexpected end of token stream, expected ')'")
+		if p.targets.IsEmpty() {
+			panic(fmt.Sprintf("unexpected end of token stream, expected %s", p.targets.Last().Name(lexer.KEYWORD_BRACKET_CLOSE)))
 		}
-		p.targets.Pushback()
+		next := p.targets.Peek()
 
 		if next.Type == lexer.KEYWORD_BRACKET_CLOSE {
+			call.End = next.Pos
 			p.targets.Pop() // Consume the closing bracket
 			break
 		}
 
 		object, ok := p.targets.Pop()
 		if !ok {
-			panic("unexpected end of token stream, expected ')'")
+			panic(fmt.Sprintf("unexpected end of token stream, expected %s", p.targets.Last().Name(lexer.KEYWORD_BRACKET_CLOSE)))
 		}
 
 		if object.Type == lexer.WHITESPACE || object.Type == lexer.NEWLINE {
@@ -161,29 +152,28 @@ func (p *Parser) doCallParse() CallObject {
 
 		switch object.Data.Type {
 		case lexer.DATA_INT:
-			call.Arguments = append(call.Arguments, Argument{Type: ARG_LITERAL, Literal: makeIntValueObj(object.Data.IntData)})
+			call.Arguments = append(call.Arguments, Argument{Type: ARG_LITERAL, Literal: makeIntValueObj(object.Data.IntData), Pos: object.Pos})
 		case lexer.DATA_REAL:
-			call.Arguments = append(call.Arguments, Argument{Type: ARG_LITERAL, Literal: makeRealValueObj(object.Data.RealData)})
+			call.Arguments = append(call.Arguments, Argument{Type: ARG_LITERAL, Literal: makeRealValueObj(object.Data.RealData), Pos: object.Pos})
 		case lexer.DATA_STR:
-			call.Arguments = append(call.Arguments, Argument{Type: ARG_LITERAL, Literal: makeStrValueObj(object.Data.StrData)})
+			call.Arguments = append(call.Arguments, Argument{Type: ARG_LITERAL, Literal: makeStrValueObj(object.Data.StrData), Pos: object.Pos})
 		case lexer.DATA_BOOL:
-			call.Arguments = append(call.Arguments, Argument{Type: ARG_LITERAL, Literal: makeBoolValueObj(object.Data.BoolData)})
+			call.Arguments = append(call.Arguments, Argument{Type: ARG_LITERAL, Literal: makeBoolValueObj(object.Data.BoolData), Pos: object.Pos})
 
 		case lexer.DATA_OBJNAME:
-			next, _ := p.targets.Pop()
-			p.targets.Pushback()
-
-			if next.Type != lexer.KEYWORD_BRACKET_OPEN {
-				call.Arguments = append(call.Arguments, Argument{Type: ARG_VARIABLE, VarName: object.Data.ObjNameData})
+			if p.targets.Peek().Type != lexer.KEYWORD_BRACKET_OPEN {
+				call.Arguments = append(call.Arguments, Argument{Type: ARG_VARIABLE, VarName: object.Data.ObjNameData, Pos: object.Pos})
 			} else {
-				p.targets.Pushback()
-				subcall := p.doCallParse()
+				subcall := p.doCallArgumentsParse(object)
 
-				call.Arguments = append(call.Arguments, Argument{Type: ARG_CALLABLE, Callable: subcall})
+				call.Arguments = append(call.Arguments, Argument{Type: ARG_CALLABLE, Callable: subcall, Pos: subcall.Pos})
 			}
 		default:
+			if object.Type == lexer.TERMINATOR {
+				panic(fmt.Sprintf("%s: unexpected end of input, expected %s", object.Pos, object.Name(lexer.KEYWORD_BRACKET_CLOSE)))
+			}
 			if object.Type != lexer.KEYWORD_BRACKET_CLOSE {
-				panic(fmt.Sprintf("unexpected token in argument list: %#v", object))
+				panic(fmt.Sprintf("%s: unexpected %s in argument list", object.Pos, object.Describe()))
 			}
 		}
 	}
@@ -199,7 +189,7 @@ func (p *Parser) doDefineParse() FunctionObject {
 	p.validCheckPop(lexer.KEYWORD_BRACKET_OPEN)
 	object := p.validCheckPop(lexer.VALUE)
 	if object.Data.Type != lexer.DATA_OBJNAME {
-		p.makeDataError(lexer.DATA_OBJNAME)
+		p.makeDataError(lexer.DATA_OBJNAME, object)
 	}
 	fun.Name = object.Data.ObjNameData
 
@@ -207,13 +197,13 @@ func (p *Parser) doDefineParse() FunctionObject {
 
 	for {
 		// Peek at the next token to see if it's the end
-		next, ok := p.targets.Pop()
-		if !ok {
-			panic("unexpected end of token stream, expected ')'")
+		if p.targets.IsEmpty() {
+			panic(fmt.Sprintf("unexpected end of token stream, expected %s", p.targets.Last().Name(lexer.KEYWORD_BRACKET_CLOSE)))
 		}
-		p.targets.Pushback()
+		next := p.targets.Peek()
 
 		if next.Type == lexer.KEYWORD_BRACKET_CLOSE {
+			fun.End = next.Pos
 			p.targets.Pop() // Consume the closing bracket
 			break
 		}
@@ -226,14 +216,10 @@ func (p *Parser) doDefineParse() FunctionObject {
 
 		switch object.Data.Type {
 		case lexer.DATA_OBJNAME:
-			next, _ := p.targets.Pop()
-			p.targets.Pushback()
-
-			if next.Type != lexer.KEYWORD_BRACKET_OPEN {
-				tempArgs = append(tempArgs, CallObject{Name: object.Data.ObjNameData})
+			if p.targets.Peek().Type != lexer.KEYWORD_BRACKET_OPEN {
+				tempArgs = append(tempArgs, CallObject{Name: object.Data.ObjNameData, Pos: object.Pos})
 			} else {
-				p.targets.Pushback()
-				tempArgs = append(tempArgs, p.doCallParse())
+				tempArgs = append(tempArgs, p.doCallArgumentsParse(object))
 			}
 
 		case lexer.DATA_INT:
@@ -245,7 +231,10 @@ func (p *Parser) doDefineParse() FunctionObject {
 		case lexer.DATA_BOOL:
 			fun.StaticData = makeBoolValueObj(object.Data.BoolData)
 		default:
-			panic(fmt.Sprintf("unexpected token in function definition: %#v", object))
+			if object.Type == lexer.TERMINATOR {
+				panic(fmt.Sprintf("%s: unexpected end of input, expected %s", object.Pos, object.Name(lexer.KEYWORD_BRACKET_CLOSE)))
+			}
+			panic(fmt.Sprintf("%s: unexpected %s in function definition", object.Pos, object.Describe()))
 		}
 	}
 
@@ -258,7 +247,7 @@ func (p *Parser) doDefineParse() FunctionObject {
 		for i := 0; i < len(tempArgs)-1; i++ {
 			// Check that parameters are just names and not calls
 			if len(tempArgs[i].Arguments) > 0 {
-				panic(fmt.Sprintf("callable object is not allowed as a parameter name: %#v", tempArgs[i]))
+				panic(fmt.Sprintf("%s: callable object is not allowed as a parameter name: %s", tempArgs[i].Pos, tempArgs[i].Name))
 			}
 			fun.Parameters = append(fun.Parameters, tempArgs[i].Name)
 		}
@@ -266,3 +255,20 @@ func (p *Parser) doDefineParse() FunctionObject {
 
 	return fun
 }
+
+// textEnd returns the position of the last character of text starting at pos.
+func textEnd(pos lexer.Position, text string) lexer.Position {
+	end := pos
+	previous := rune(-1)
+	for _, r := range text {
+		switch {
+		case previous == '\n':
+			end.Line++
+			end.Column = 1
+		case previous >= 0:
+			end.Column++
+		}
+		previous = r
+	}
+	return end
+}
@@ -0,0 +1,48 @@
+package parser
+
+import (
+	"cutter/lexer"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// parseError parses source and returns the error it panics with.
+func parseError(source string, options lexer.Options) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("%v", r)
+		}
+	}()
+
+	lex := lexer.NewLexerWithOptions("test.cm", options)
+	lex.SetInput(strings.NewReader(source))
+	NewParser().ParseStream(lex)
+	return nil
+}
+
+func TestErrorsUseDelimiters(t *testing.T) {
+	custom := lexer.Options{Delimiters: lexer.Delimiters{Call: "$", Open: "[", Close: "]", Quote: "'"}}
+	tests := []struct {
+		source  string
+		options lexer.Options
+		want    string
+	}{
+		{"@echo(1", lexer.Options{}, "test.cm:1:8: unexpected end of input, expected ')'"},
+		{"@echo 1)", lexer.Options{}, "test.cm:1:7: unexpected integer 1, expected '('"},
+		{"$echo[1", custom, "test.cm:1:8: unexpected end of input, expected ']'"},
+		{"$echo 1]", custom, "test.cm:1:7: unexpected integer 1, expected '['"},
+		{"$define[$x]", custom, "test.cm:1:9: unexpected '$', expected value"},
+		{"$define[f 1 $include]", custom, "test.cm:1:13: unexpected '$include' in function definition"},
+		{"@delimiters(`$` `[` `]`)$echo[1", lexer.Options{}, "test.cm:1:32: unexpected end of input, expected ']'"},
+		{"@delimiters(`$` `[` `]`)$echo 1]", lexer.Options{}, "test.cm:1:31: unexpected integer 1, expected '['"},
+		{"@delimiters(`$` `[` `]`)$delimiters[]@echo(1", lexer.Options{}, "test.cm:1:45: unexpected end of input, expected ')'"},
+	}
+
+	for _, test := range tests {
+		err := parseError(test.source, test.options)
+		if err == nil || err.Error() != test.want {
+			t.Errorf("%q: error %v, want %q", test.source, err, test.want)
+		}
+	}
+}
@@ -2,43 +2,71 @@ package parser
 
 import "cutter/lexer"
 
+// TokenSource yields lexer tokens one at a time. After the last token it keeps
+// returning TERMINATOR; *lexer.Lexer is one.
+type TokenSource interface {
+	Next() lexer.LexerToken
+}
+
+// sliceSource is a TokenSource over tokens lexed in advance.
+type sliceSource struct {
+	tokens []lexer.LexerToken
+	next   int
+}
+
+func (s *sliceSource) Next() lexer.LexerToken {
+	if s.next >= len(s.tokens) {
+		return lexer.NewLexerToken(lexer.TERMINATOR, lexer.NewData(), lexer.Position{})
+	}
+	token := s.tokens[s.next]
+	s.next++
+	return token
+}
+
+// ParserQueue pulls tokens from a TokenSource with a lookahead of one token.
 type ParserQueue struct {
-	contents []lexer.LexerToken
-	size     int64
-	pointer  int64
+	source TokenSource
+
+	peeked    lexer.LexerToken
+	hasPeeked bool
+	done      bool
 }
 
-func NewParserQueue(c []lexer.LexerToken, s int64) *ParserQueue {
+func NewParserQueue(source TokenSource) *ParserQueue {
 	q := new(ParserQueue)
-	q.contents = c
-	q.size = s
-	q.pointer = -1
+	q.source = source
 
 	return q
 }
 
+// Pop consumes the next token. It fails once the TERMINATOR has been consumed.
 func (q *ParserQueue) Pop() (lexer.LexerToken, bool) {
-	if q.pointer+1 >= q.size {
+	if q.done {
 		return lexer.LexerToken{}, false
 	}
 
-	q.pointer += 1
-	return q.contents[q.pointer], true
+	token := q.Peek()
+	q.hasPeeked = false
+	if token.Type == lexer.TERMINATOR {
+		q.done = true
+	}
+	return token, true
 }
 
-func (q *ParserQueue) Pushback() (lexer.LexerToken, bool) {
-	if q.pointer <= -1 { // Changed condition to q.pointer <= -1
-		return lexer.LexerToken{}, false
+// Peek returns the next token without consuming it.
+func (q *ParserQueue) Peek() lexer.LexerToken {
+	if !q.hasPeeked {
+		q.peeked = q.source.Next()
+		q.hasPeeked = true
 	}
-
-	q.pointer -= 1
-	return q.contents[q.pointer], true
+	return q.peeked
 }
 
-func (q *ParserQueue) Seek() lexer.LexerToken {
-	return q.contents[q.pointer]
+// Last returns the token Pop or Peek returned last.
+func (q *ParserQueue) Last() lexer.LexerToken {
+	return q.peeked
 }
 
 func (q *ParserQueue) IsEmpty() bool {
-	return (q.pointer+1 >= q.size)
+	return q.done
 }
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"bufio"
+	"cutter/etc"
+	"cutter/lexer"
+	"cutter/parser"
+	"cutter/runtime"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+const replHelp = `Enter Cutter source; definitions persist between inputs.
+Input that ends inside a call, string, comment or verbatim region
+continues on the next line.
+  :objects   list defined objects
+  :mem       dump VM registers and memory
+  :instr     show the instructions compiled for the last input
+  :help      show this help
+  :quit      leave the REPL`
+
+// replSession keeps one compiler and one VM alive across inputs.
+type replSession struct {
+	com *runtime.Compiler
+	vm  *runtime.VM
+	out io.Writer
+
+	lastInstrStart int
+	lastInstr      []runtime.VMInstr
+	inputCount     int
+}
+
+func newReplSession(out io.Writer) *replSession {
+	com := runtime.NewCompiler()
+	com.SetIncludePath(etc.IncludePathFromEnv())
+	return &replSession{
+		com: com,
+		vm:  runtime.NewVM([]runtime.VMInstr{}),
+		out: out,
+	}
+}
+
+// inputComplete reports whether source can be evaluated, or ends inside a
+// call, string, comment or verbatim region and needs more lines. It lexes and
+// parses source as eval will; other syntax errors complete the input so that
+// eval reports them.
+func (s *replSession) inputComplete(source string) (complete bool) {
+	defer func() {
+		if r := recover(); r != nil {
+			msg := fmt.Sprint(r)
+			complete = !strings.Contains(msg, "unexpected end of") && !strings.Contains(msg, "unterminated")
+		}
+	}()
+
+	lex := lexer.NewLexerWithOptions(fmt.Sprintf("<repl:%d>", s.inputCount+1), s.com.LexerOptions())
+	lex.SetInput(strings.NewReader(source))
+	parser.NewParser().ParseStream(lex)
+	return true
+}
+
+// eval compiles one input, runs it on the session VM and prints its output and value.
+func (s *replSession) eval(source string) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("%v", r)
+			s.vm.Reg.ClearRegisters()
+			s.vm.IO.EndAllCaptures()
+			s.vm.ResetCaptures()
+			s.vm.IO.FlushIO()
+		}
+	}()
+
+	s.inputCount++
+	lex := lexer.NewLexerWithOptions(fmt.Sprintf("<repl:%d>", s.inputCount), s.com.LexerOptions())
+	lex.SetInput(strings.NewReader(source))
+	ast := parser.NewParser().ParseStream(lex)
+
+	hasCall := false
+	for _, body := range ast.Bodys {
+		if body.Type == parser.FUNCTION_CALL && body.Call.Name != "include" {
+			hasCall = true
+		}
+	}
+
+	s.lastInstrStart = len(s.vm.Program)
+	s.lastInstr = s.com.CompileASTToVMInstrAt(ast, s.lastInstrStart)
+
+	s.vm.Reg.InsertResult(runtime.VMDataObject{})
+	s.vm.Extend(s.lastInstr)
+
+	output := s.vm.IO.ReadBuffer()
+	s.vm.IO.FlushIO()
+	if output != "" {
+		fmt.Fprintln(s.out, output)
+	}
+	if hasCall {
+		fmt.Fprintln(s.out, "=>", runtime.FormatVMDataObject(s.vm.Reg.GetResult()))
+	}
+	return nil
+}
+
+func (s *replSession) listObjects() {
+	for _, fnc := range s.com.DefinedFunctions() {
+		fmt.Fprintf(s.out, "%s(%s)\n", fnc.Name, strings.Join(fnc.Parameters, " "))
+	}
+	for name := range s.com.DefinedVariables() {
+		if s.vm.Mem.HasObj(name) {
+			fmt.Fprintf(s.out, "%s = %s\n", name, runtime.FormatVMDataObject(*s.vm.Mem.GetObj(name)))
+		}
+	}
+}
+
+func (s *replSession) showInstructions() {
+	for i, instr := range s.lastInstr {
+		fmt.Fprintln(s.out, s.lastInstrStart+i, runtime.ResolveVMInstruction(instr))
+	}
+}
+
+// command runs a ':' command and reports whether the session should continue.
+func (s *replSession) command(line string) bool {
+	switch strings.TrimSpace(line) {
+	case ":quit", ":q":
+		return false
+	case ":objects":
+		s.listObjects()
+	case ":mem":
+		runtime.DumpRegisters(s.vm)
+		runtime.DumpMemory(s.vm)
+	case ":instr":
+		s.showInstructions()
+	case ":help":
+		fmt.Fprintln(s.out, replHelp)
+	default:
+		fmt.Fprintf(s.out, "unknown command %s, try :help\n", line)
+	}
+	return true
+}
+
+func runReplCommand(args []string) int {
+	if len(args) > 0 {
+		fmt.Fprintln(os.Stderr, "usage: cutter repl")
+		return ExitUsage
+	}
+
+	session := newReplSession(os.Stdout)
+	scanner := bufio.NewScanner(os.Stdin)
+
+	fmt.Println("Cutter Runtime Version: " + etc.RUNTIMEVERSION + " (:help for commands)")
+
+	pending := make([]string, 0)
+	for {
+		if len(pending) == 0 {
+			fmt.Print("cutter> ")
+		} else {
+			fmt.Print("...     ")
+		}
+		if !scanner.Scan() {
+			fmt.Println()
+			break
+		}
+		line := scanner.Text()
+
+		if len(pending) == 0 && strings.HasPrefix(line, ":") {
+			if !session.command(line) {
+				break
+			}
+			continue
+		}
+
+		pending = append(pending, line)
+		source := strings.Join(pending, "\n")
+		if !session.inputComplete(source) {
+			continue
+		}
+		pending = pending[:0]
+
+		if strings.TrimSpace(source) == "" {
+			continue
+		}
+		if err := session.eval(source); err != nil {
+			fmt.Println("error:", err)
+		}
+		if session.vm.Halted {
+			return session.vm.ExitCode
+		}
+	}
+
+	return ExitOK
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestReplInputComplete(t *testing.T) {
+	tests := []struct {
+		input    string
+		complete bool
+	}{
+		{"plain text", true},
+		{"@echo(1)", true},
+		{"@echo(1", false},
+		{"@echo(1\n2)", true},
+		{"@define(f a", false},
+		{"@echo(`abc", false},
+		{"@echo(`a)b`)", true},
+		{"@echo(`a\\`b`)", true},
+		{"@echo(`a\\`b", false},
+		{"@echo(```raw ( ```)", true},
+		{"@echo(```raw", false},
+		{"@echo(1 @# a comment with )", false},
+		{"@echo(1 @# a comment\n)", true},
+		{"@* a block (", false},
+		{"@* a block *@@echo(1)", true},
+		{"@verbatim @echo(", false},
+		{"@verbatim @echo( @endverbatim", true},
+		{"text (with) brackets )", true},
+		// Errors other than an early end complete the input, so they get reported.
+		{"@echo(@add(1", true},
+		{"@define(@x 1", true},
+	}
+
+	session := newReplSession(&bytes.Buffer{})
+	for _, test := range tests {
+		if got := session.inputComplete(test.input); got != test.complete {
+			t.Errorf("inputComplete(%q) = %t, want %t", test.input, got, test.complete)
+		}
+	}
+}
+
+func TestReplSession(t *testing.T) {
+	var out bytes.Buffer
+	session := newReplSession(&out)
+
+	inputs := []struct {
+		source string
+		want   string
+		err    string
+	}{
+		{"@define(greet name add(`Hi ` name))", "", ""},
+		{"@define(count 1)", "", ""},
+		{"@greet(`kim`)", "Hi kim\n=> STR(Hi kim)\n", ""},
+		{"@set(count add(count 1))@count()", "!t2\n=> INT(2)\n", ""},
+		{"@nothing()", "", "undefined"},
+		{"@count()", "2\n=> INT(2)\n", ""},
+	}
+	for _, input := range inputs {
+		out.Reset()
+		err := session.eval(input.source)
+		if input.err != "" {
+			if err == nil || !strings.Contains(err.Error(), input.err) {
+				t.Errorf("%q: error %v, want %q", input.source, err, input.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: unexpected error %v", input.source, err)
+			continue
+		}
+		if out.String() != input.want {
+			t.Errorf("%q: printed %q, want %q", input.source, out.String(), input.want)
+		}
+	}
+}
@@ -5,6 +5,10 @@ import (
 	"cutter/lexer"
 	"cutter/parser"
 	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
 )
 
 type Compiler struct {
@@ -12,6 +16,11 @@ type Compiler struct {
 	funcInfo      map[string]parser.FunctionObject
 	variableFuncs map[string]parser.ValueObject
 	standardFuncs map[string][]VMInstr
+	predefined    map[string]bool
+
+	includeAnyExtension bool
+	includePath         []string
+	lexerOptions        lexer.Options
 }
 
 func NewCompiler() *Compiler {
@@ -20,9 +29,40 @@ func NewCompiler() *Compiler {
 		funcInfo:      make(map[string]parser.FunctionObject),
 		variableFuncs: make(map[string]parser.ValueObject),
 		standardFuncs: GetStandardFuncs(),
+		predefined:    make(map[string]bool),
 	}
 }
 
+// DefineVariable makes name known as a variable function before compiling, for
+// objects that the VM is given from outside the template (see VM.DefineObject).
+// A template @define of the same variable no longer overwrites the value, so it
+// acts as a default.
+func (c *Compiler) DefineVariable(name string, value parser.ValueObject) {
+	c.variableFuncs[name] = value
+	c.predefined[name] = true
+}
+
+// SetIncludeAnyExtension allows @include to pull in files without the .cm extension.
+func (c *Compiler) SetIncludeAnyExtension(allow bool) {
+	c.includeAnyExtension = allow
+}
+
+// SetIncludePath sets the directories searched for included files that are
+// not found next to the file that includes them.
+func (c *Compiler) SetIncludePath(dirs []string) {
+	c.includePath = dirs
+}
+
+// SetLexerOptions sets the options used to lex included files.
+func (c *Compiler) SetLexerOptions(options lexer.Options) {
+	c.lexerOptions = options
+}
+
+// LexerOptions returns the options set with SetLexerOptions.
+func (c *Compiler) LexerOptions() lexer.Options {
+	return c.lexerOptions
+}
+
 type regAlloc struct {
 	next int
 }
@@ -38,51 +78,20 @@ func (r *regAlloc) reset() {
 }
 
 func (c *Compiler) CompileASTToVMInstr(input parser.HeadNode) []VMInstr {
+	return c.CompileASTToVMInstrAt(input, 0)
+}
+
+// CompileASTToVMInstrAt compiles input as if it were loaded at program offset base,
+// so that it can be appended to an already running program (see VM.Extend).
+func (c *Compiler) CompileASTToVMInstrAt(input parser.HeadNode, base int) []VMInstr {
 	instructions := make([]VMInstr, 0)
 	c.reg.reset()
 
 	// Pre-pass: handle includes
-	newBodys := make([]parser.BodyObject, 0)
-	for _, item := range input.Bodys {
-		if item.Type == parser.FUNCTION_CALL && item.Call.Name == "include" {
-			if len(item.Call.Arguments) != 1 {
-				panic("'include' function requires 1 argument: a file path")
-			}
-			filePathArg := item.Call.Arguments[0]
-			if filePathArg.Type != parser.ARG_LITERAL || filePathArg.Literal.Type != parser.STRING {
-				panic("'include' function argument must be a string literal")
-			}
-			filePath := filePathArg.Literal.StringData
-			content, err := etc.ReadFile(filePath)
-			if err != nil {
-				panic(fmt.Sprintf("failed to read file: %s", err))
-			}
-			lex := lexer.NewLexer()
-			tokens := lex.DoLex(content)
-			p := parser.NewParser()
-			ast := p.DoParse(tokens)
-
-			newBodys = append(newBodys, ast.Bodys...)
-		} else {
-			newBodys = append(newBodys, item)
-		}
-	}
-	input.Bodys = newBodys
+	input = c.ExpandIncludes(input)
 
 	// First pass: gather all function definitions and variable functions
-	for _, items := range input.Bodys {
-		if items.Type == parser.FUCNTION_DEFINITION {
-			fnc := items.Func
-			if fnc.StaticData.Type != 0 && len(fnc.Parameters) == 0 {
-				// This is a variable function
-				c.variableFuncs[fnc.Name] = fnc.StaticData
-				instructions = append(instructions, VMInstr{Op: OpMemSet, Oprand1: makeStrValueObj(fnc.Name), Oprand2: transformToVMDataObject(fnc.StaticData)})
-			} else {
-				// This is a real function
-				c.funcInfo[fnc.Name] = fnc
-			}
-		}
-	}
+	instructions = append(instructions, c.gatherDefinitions(input.Bodys)...)
 
 	// Second pass: compile instructions
 	for _, items := range input.Bodys {
@@ -97,27 +106,182 @@ func (c *Compiler) CompileASTToVMInstr(input parser.HeadNode) []VMInstr {
 			if items.Call.Name == "include" {
 				continue
 			}
-			callInstructions := c.CompileFunctionCallToVMInstr(items.Call, []string{}, len(instructions))
+			callInstructions := c.CompileFunctionCallToVMInstr(items.Call, []string{}, base+len(instructions))
 			instructions = append(instructions, callInstructions...)
 			// After a top-level call, store the result in stdout
-			instructions = append(instructions, VMInstr{Op: OpRslStr, Oprand1: makeStrValueObj("stdout")})
-			instructions = append(instructions, VMInstr{Op: OpSyscall, Oprand1: makeIntValueObj(SYS_IO_FLUSH)})
+			instructions = append(instructions, VMInstr{Op: OpRslStr, Oprand1: makeStrValueObj("stdout"), Pos: items.Call.Pos})
+			instructions = append(instructions, VMInstr{Op: OpSyscall, Oprand1: makeIntValueObj(SYS_IO_FLUSH), Pos: items.Call.Pos})
 
 			c.reg.reset()
-			instructions = append(instructions, VMInstr{Op: OpClearReg})
+			instructions = append(instructions, VMInstr{Op: OpClearReg, Pos: items.Call.Pos})
 		case parser.NORM_STRINGS:
 			tmpReg := c.reg.alloc()
-			instructions = append(instructions, VMInstr{Op: OpRegSet, Oprand1: makeIntValueObj(int64(tmpReg)), Oprand2: makeStrValueObj(items.Norm.Data)})
-			instructions = append(instructions, VMInstr{Op: OpStr, Oprand1: makeStrValueObj("stdout"), Oprand2: makeIntValueObj(int64(tmpReg))})
-			instructions = append(instructions, VMInstr{Op: OpSyscall, Oprand1: makeIntValueObj(SYS_IO_FLUSH)})
+			pos := items.Norm.Pos
+			instructions = append(instructions, VMInstr{Op: OpRegSet, Oprand1: makeIntValueObj(int64(tmpReg)), Oprand2: makeStrValueObj(items.Norm.Data), Pos: pos})
+			instructions = append(instructions, VMInstr{Op: OpStr, Oprand1: makeStrValueObj("stdout"), Oprand2: makeIntValueObj(int64(tmpReg)), Pos: pos})
+			instructions = append(instructions, VMInstr{Op: OpSyscall, Oprand1: makeIntValueObj(SYS_IO_FLUSH), Pos: pos})
 
 			c.reg.reset()
-			instructions = append(instructions, VMInstr{Op: OpClearReg})
+			instructions = append(instructions, VMInstr{Op: OpClearReg, Pos: pos})
+		}
+	}
+	return instructions
+}
+
+// ExpandIncludes returns input with every @include replaced by the contents
+// of the included file, recursively. Each include is resolved against the file
+// it is written in, and a file that ends up including itself is an error. Like
+// the compiler, it panics when an include is malformed or can not be read.
+func (c *Compiler) ExpandIncludes(input parser.HeadNode) parser.HeadNode {
+	return parser.HeadNode{Bodys: c.expandIncludes(input.Bodys, nil)}
+}
+
+// expandIncludes expands the includes in bodys; chain lists the files that
+// are being included, starting with the template when it is a file.
+func (c *Compiler) expandIncludes(bodys []parser.BodyObject, chain []string) []parser.BodyObject {
+	result := make([]parser.BodyObject, 0, len(bodys))
+	for _, item := range bodys {
+		if item.Type != parser.FUNCTION_CALL || item.Call.Name != "include" {
+			result = append(result, item)
+			continue
+		}
+
+		includer := item.Call.Pos.File
+		if len(chain) == 0 && isSourceFile(includer) {
+			chain = []string{includer}
+		}
+
+		filePath := c.resolveIncludeCall(item.Call)
+		for _, file := range chain {
+			if sameFile(file, filePath) {
+				panic(fmt.Sprintf("%s: include cycle: %s -> %s", item.Call.Pos, strings.Join(chain, " -> "), filePath))
+			}
+		}
+
+		included := c.parseInclude(filePath)
+		result = append(result, c.expandIncludes(included.Bodys, append(chain[:len(chain):len(chain)], filePath))...)
+	}
+	return result
+}
+
+// resolveIncludeCall checks an @include call and returns the path of the file
+// it includes.
+func (c *Compiler) resolveIncludeCall(call parser.CallObject) string {
+	if len(call.Arguments) != 1 {
+		panic("'include' function requires 1 argument: a file path")
+	}
+	filePathArg := call.Arguments[0]
+	if filePathArg.Type != parser.ARG_LITERAL || filePathArg.Literal.Type != parser.STRING {
+		panic("'include' function argument must be a string literal")
+	}
+	filePath, searched := c.resolveInclude(filePathArg.Literal.StringData, call.Pos.File)
+	if filePath == "" {
+		panic(fmt.Sprintf("%s: cannot find included file '%s', searched: %s", call.Pos, filePathArg.Literal.StringData, strings.Join(searched, ", ")))
+	}
+	return filePath
+}
+
+// parseInclude parses an included file; its positions name filePath.
+func (c *Compiler) parseInclude(filePath string) parser.HeadNode {
+	file, err := etc.OpenFile(filePath, c.includeAnyExtension)
+	if err != nil {
+		panic(fmt.Sprintf("failed to read file: %s", err))
+	}
+	lex := lexer.NewLexerWithOptions(filePath, c.lexerOptions)
+	lex.SetInput(file)
+	ast := func() parser.HeadNode {
+		defer file.Close()
+		return parser.NewParser().ParseStream(lex)
+	}()
+	if lex.Err() != nil {
+		panic(fmt.Sprintf("failed to read file: %s", lex.Err()))
+	}
+	return ast
+}
+
+// isSourceFile reports whether a position file name is a file on disk rather
+// than a name such as <stdin>.
+func isSourceFile(name string) bool {
+	return name != "" && !strings.HasPrefix(name, "<")
+}
+
+func sameFile(a string, b string) bool {
+	absA, errA := filepath.Abs(a)
+	absB, errB := filepath.Abs(b)
+	if errA != nil || errB != nil {
+		return filepath.Clean(a) == filepath.Clean(b)
+	}
+	return absA == absB
+}
+
+// resolveInclude finds the file an @include in includer refers to. Absolute
+// paths are taken as they are; relative ones are looked up next to includer,
+// or in the working directory when includer is not a file, and then in each
+// directory of the include path. It returns "" and the paths it tried when
+// there is no such file.
+func (c *Compiler) resolveInclude(name string, includer string) (string, []string) {
+	if filepath.IsAbs(name) {
+		return name, nil
+	}
+
+	dir := "."
+	if isSourceFile(includer) {
+		dir = filepath.Dir(includer)
+	}
+	candidates := []string{filepath.Join(dir, name)}
+	for _, searchDir := range c.includePath {
+		candidates = append(candidates, filepath.Join(searchDir, name))
+	}
+
+	for _, candidate := range candidates {
+		if info, err := os.Stat(candidate); err == nil && !info.IsDir() {
+			return candidate, candidates
+		}
+	}
+	return "", candidates
+}
+
+// gatherDefinitions records the definitions in bodys in funcInfo and
+// variableFuncs, and returns the instructions that initialize the variables.
+func (c *Compiler) gatherDefinitions(bodys []parser.BodyObject) []VMInstr {
+	instructions := make([]VMInstr, 0)
+	for _, items := range bodys {
+		if items.Type == parser.FUCNTION_DEFINITION {
+			fnc := items.Func
+			if c.predefined[fnc.Name] {
+				if fnc.StaticData.Type == 0 || len(fnc.Parameters) != 0 {
+					panic(fmt.Sprintf("%s: '%s' is predefined as a variable and cannot be redefined as a function", fnc.Pos, fnc.Name))
+				}
+				continue
+			}
+			if fnc.StaticData.Type != 0 && len(fnc.Parameters) == 0 {
+				// This is a variable function
+				c.variableFuncs[fnc.Name] = fnc.StaticData
+				instructions = append(instructions, VMInstr{Op: OpMemSet, Oprand1: makeStrValueObj(fnc.Name), Oprand2: transformToVMDataObject(fnc.StaticData), Pos: fnc.Pos})
+			} else {
+				// This is a real function
+				c.funcInfo[fnc.Name] = fnc
+			}
 		}
 	}
 	return instructions
 }
 
+// DefinedFunctions returns the callable objects known to the compiler, sorted by name.
+func (c *Compiler) DefinedFunctions() []parser.FunctionObject {
+	result := make([]parser.FunctionObject, 0, len(c.funcInfo))
+	for _, fnc := range c.funcInfo {
+		result = append(result, fnc)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Name < result[j].Name })
+	return result
+}
+
+// DefinedVariables returns the variable functions known to the compiler and their initial values.
+func (c *Compiler) DefinedVariables() map[string]parser.ValueObject {
+	return c.variableFuncs
+}
+
 func (c *Compiler) CompileFunctionDefToVMInstr(fnc parser.FunctionObject) []VMInstr {
 	if _, exists := c.standardFuncs[fnc.Name]; exists {
 		panic("Standard function already exists: " + fnc.Name)
@@ -153,7 +317,7 @@ func (c *Compiler) CompileFunctionDefToVMInstr(fnc parser.FunctionObject) []VMIn
 	}
 
 	instructions = append(instructions, VMInstr{Op: OpReturn})
-	return instructions
+	return stampPos(instructions, fnc.Pos)
 }
 
 func (c *Compiler) compileArgument(arg parser.Argument, argNames []string, targetReg int, currentOffset int) []VMInstr {
@@ -190,13 +354,27 @@ func (c *Compiler) compileArgument(arg parser.Argument, argNames []string, targe
 		nestedCallInstructions := c.CompileFunctionCallToVMInstr(arg.Callable, argNames, currentOffset+len(instructions))
 		instructions = append(instructions, nestedCallInstructions...)
 		instructions = append(instructions, VMInstr{Op: OpRslMov, Oprand1: makeIntValueObj(int64(targetReg))})
-		instructions = append(instructions, VMInstr{Op: OpStr, Oprand1: makeIntValueObj(int64(targetReg)), Oprand2: makeStrValueObj(arg.Callable.Name)})
 
 	}
 	return instructions
 }
 
 func (c *Compiler) CompileFunctionCallToVMInstr(call parser.CallObject, argNames []string, currentOffset int) []VMInstr {
+	return stampPos(c.compileFunctionCall(call, argNames, currentOffset), call.Pos)
+}
+
+// stampPos attributes every instruction that has no source position yet to pos.
+// Nested calls are compiled first, so they keep their own, more precise positions.
+func stampPos(instructions []VMInstr, pos lexer.Position) []VMInstr {
+	for i := range instructions {
+		if !instructions[i].Pos.IsValid() {
+			instructions[i].Pos = pos
+		}
+	}
+	return instructions
+}
+
+func (c *Compiler) compileFunctionCall(call parser.CallObject, argNames []string, currentOffset int) []VMInstr {
 	instructions := make([]VMInstr, 0)
 
 	if _, isVarFunc := c.variableFuncs[call.Name]; isVarFunc {
@@ -241,6 +419,22 @@ func (c *Compiler) CompileFunctionCallToVMInstr(call parser.CallObject, argNames
 		loopEndOffset := currentOffset + len(instructions)
 		instructions[len(condInstructions)].Oprand2 = makeIntValueObj(int64(loopEndOffset))
 
+		return instructions
+	case "capture":
+		if len(call.Arguments) == 0 {
+			panic("'capture' function requires at least 1 argument: the body to capture")
+		}
+
+		// Everything the body writes goes to a nested buffer instead of the output
+		instructions = append(instructions, VMInstr{Op: OpSyscall, Oprand1: makeIntValueObj(SYS_IO_CAPTURE)})
+		for _, arg := range call.Arguments {
+			bodyReg := c.reg.alloc()
+			bodyInstructions := c.compileArgument(arg, argNames, bodyReg, currentOffset+len(instructions))
+			instructions = append(instructions, bodyInstructions...)
+		}
+		// The captured text becomes the result
+		instructions = append(instructions, VMInstr{Op: OpSyscall, Oprand1: makeIntValueObj(SYS_IO_CAPTURED)})
+
 		return instructions
 	case "chain":
 		if len(call.Arguments) == 0 {
@@ -340,8 +534,15 @@ func (c *Compiler) CompileFunctionCallToVMInstr(call parser.CallObject, argNames
 		for i := range call.Arguments {
 			instructions = append(instructions, VMInstr{Op: OpRegMov, Oprand1: makeIntValueObj(int64(argRegs[i])), Oprand2: makeIntValueObj(int64(i))})
 		}
+		if call.Name == "exit" && len(call.Arguments) == 0 {
+			// Don't let a stale register 0 become the exit status.
+			instructions = append(instructions, VMInstr{Op: OpRegSet, Oprand1: makeIntValueObj(0), Oprand2: makeIntValueObj(0)})
+		}
 	} else { // User-defined function
-		userFunc, _ := c.funcInfo[call.Name]
+		userFunc, isUserFunc := c.funcInfo[call.Name]
+		if !isUserFunc {
+			panic(fmt.Sprintf("%s: undefined object '%s'", call.Pos, call.Name))
+		}
 		if len(call.Arguments) != len(userFunc.Parameters) {
 			panic(fmt.Sprintf("function '%s' expects %d arguments, but got %d", call.Name, len(userFunc.Parameters), len(call.Arguments)))
 		}
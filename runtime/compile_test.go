@@ -0,0 +1,128 @@
+package runtime
+
+import (
+	"cutter/lexer"
+	"cutter/parser"
+	"fmt"
+	"testing"
+)
+
+// runVM compiles and runs source, turning a panic in any stage into an error.
+func runVM(source string) (vm *VM, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("%v", r)
+		}
+	}()
+
+	tokens := lexer.NewLexerWithFile("test.cm").DoLex(source)
+	vm = NewVM(NewCompiler().CompileASTToVMInstr(parser.NewParser().DoParse(tokens)))
+	vm.Run()
+	return vm, nil
+}
+
+// runSource runs source and returns what it wrote to the main output.
+func runSource(source string) (string, error) {
+	vm, err := runVM(source)
+	if err != nil {
+		return "", err
+	}
+	return vm.IO.ReadBuffer(), nil
+}
+
+func TestNestedCallArguments(t *testing.T) {
+	tests := []struct {
+		source string
+		want   string
+	}{
+		{"@add(strlen(`ab`) 1)", "3"},
+		{"@same(add(1 1) 2)", "!t"},
+		{"@strsub(strrep(`a-b-c` `-` ``) 1 3)", "bc"},
+		// echo clears the argument registers; the result of the nested call
+		// must still reach the outer one.
+		{"@strlen(echo(`hi`))", "hi2"},
+		{"@define(shout text echo(add(text `!`)))@strlen(shout(`hey`))", "hey!4"},
+	}
+
+	for _, test := range tests {
+		got, err := runSource(test.source)
+		if err != nil {
+			t.Errorf("%s: %v", test.source, err)
+			continue
+		}
+		if got != test.want {
+			t.Errorf("%s: output %q, want %q", test.source, got, test.want)
+		}
+	}
+}
+
+func TestCapture(t *testing.T) {
+	tests := []struct {
+		name   string
+		source string
+		want   string
+	}{
+		{"result", "@define(x ``)@set(x capture(echo(`a`) echo(1)))[@get(`x`)]", "!t[a1]"},
+		{"values are dropped", "@define(x ``)@set(x capture(add(1 2)))[@get(`x`)]", "!t[]"},
+		{"nested", "@define(x ``)@set(x capture(echo(`a`) echo(capture(echo(`b`))) capture(echo(`c`)) echo(`d`)))[@get(`x`)]", "!t[abd]"},
+		{"arguments around a capture", "@add(capture(echo(`a`)) capture(echo(`b`)))", "ab"},
+		{"inside a diversion", "@define(x ``)A@divert(1)@set(x capture(echo(`in`)))B@divert(0)C@get(`x`)", "ACin!tB"},
+		{"diversion inside", "@define(x ``)@set(x capture(echo(`a`) divert(1) echo(`in`) divert(0) echo(`b`)))[@get(`x`)]", "!t[ainb]"},
+		{"output inside", "@define(x ``)@set(x capture(echo(`a`) output(`f.txt`) echo(`in`) output(``) echo(`b`)))[@get(`x`)]", "!t[ainb]"},
+	}
+
+	for _, test := range tests {
+		got, err := runSource(test.source)
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		if got != test.want {
+			t.Errorf("%s: output %q, want %q", test.name, got, test.want)
+		}
+	}
+}
+
+func TestCaptureInsideOutput(t *testing.T) {
+	vm, err := runVM("@define(x ``)@output(`f.txt`)@set(x capture(echo(`in`)))@output(``)[@get(`x`)]")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := vm.IO.ReadBuffer(); got != "[in]" {
+		t.Errorf("main output %q, want %q", got, "[in]")
+	}
+	files := vm.IO.Files()
+	if len(files) != 1 || files[0].Content != "!t" {
+		t.Errorf("output files %+v, want f.txt holding only the result of set", files)
+	}
+}
+
+func TestCaptureHalted(t *testing.T) {
+	tests := []struct {
+		source   string
+		want     string
+		exitCode int
+	}{
+		// Text captured before exit is passed on to the output below it.
+		{"a@capture(echo(`b`) exit(3) echo(`c`))d", "ab", 3},
+		{"a@capture(echo(`b`) capture(echo(`c`) exit()))d", "abc", 0},
+		{"@divert(1)a@capture(echo(`b`) exit())c", "ab", 0},
+	}
+
+	for _, test := range tests {
+		vm, err := runVM(test.source)
+		if err != nil {
+			t.Errorf("%s: %v", test.source, err)
+			continue
+		}
+		if !vm.Halted || vm.ExitCode != test.exitCode {
+			t.Errorf("%s: halted %t with %d, want exit code %d", test.source, vm.Halted, vm.ExitCode, test.exitCode)
+		}
+		if got := vm.IO.ReadBuffer(); got != test.want {
+			t.Errorf("%s: output %q, want %q", test.source, got, test.want)
+		}
+		if len(vm.IO.captures) != 0 {
+			t.Errorf("%s: %d captures left open", test.source, len(vm.IO.captures))
+		}
+	}
+}
@@ -0,0 +1,466 @@
+package runtime
+
+import (
+	"bufio"
+	"fmt"
+	"html"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// CoverageCounter records what a single VM run executed, indexed by program counter.
+type CoverageCounter struct {
+	Hits     []int
+	Branches map[int]*[2]int
+	Calls    map[string]int
+}
+
+// EnableCoverage makes the VM count executed instructions, taken branches and object calls.
+func (vm *VM) EnableCoverage() {
+	vm.Coverage = &CoverageCounter{
+		Hits:     make([]int, len(vm.Program)),
+		Branches: make(map[int]*[2]int),
+		Calls:    make(map[string]int),
+	}
+}
+
+func (cc *CoverageCounter) hitBranch(pc int, cond bool) {
+	taken, ok := cc.Branches[pc]
+	if !ok {
+		taken = new([2]int)
+		cc.Branches[pc] = taken
+	}
+	if cond {
+		taken[0]++
+	} else {
+		taken[1]++
+	}
+}
+
+// BranchPoint identifies a branching call (such as ifel) by its position in a file.
+type BranchPoint struct {
+	Line   int
+	Column int
+}
+
+type FuncCoverage struct {
+	Line int
+	Hits int
+}
+
+type FileCoverage struct {
+	Lines    map[int]int
+	Funcs    map[string]*FuncCoverage
+	Branches map[BranchPoint]*[2]int
+}
+
+// CoverageProfile accumulates coverage of one or more runs, mapped back to source files.
+type CoverageProfile struct {
+	Files map[string]*FileCoverage
+}
+
+func NewCoverageProfile() *CoverageProfile {
+	return &CoverageProfile{Files: make(map[string]*FileCoverage)}
+}
+
+func (p *CoverageProfile) file(name string) *FileCoverage {
+	fc, ok := p.Files[name]
+	if !ok {
+		fc = &FileCoverage{
+			Lines:    make(map[int]int),
+			Funcs:    make(map[string]*FuncCoverage),
+			Branches: make(map[BranchPoint]*[2]int),
+		}
+		p.Files[name] = fc
+	}
+	return fc
+}
+
+func (fc *FileCoverage) branch(bp BranchPoint) *[2]int {
+	taken, ok := fc.Branches[bp]
+	if !ok {
+		taken = new([2]int)
+		fc.Branches[bp] = taken
+	}
+	return taken
+}
+
+func (fc *FileCoverage) function(name string, line int) *FuncCoverage {
+	fn, ok := fc.Funcs[name]
+	if !ok {
+		fn = &FuncCoverage{Line: line}
+		fc.Funcs[name] = fn
+	}
+	return fn
+}
+
+// branchingFuncs returns the standard functions that choose between their arguments.
+func branchingFuncs() map[string]bool {
+	result := make(map[string]bool)
+	for name, instrs := range GetStandardFuncs() {
+		for _, instr := range instrs {
+			if instr.Op == OpBrch {
+				result[name] = true
+			}
+		}
+	}
+	return result
+}
+
+// AddRun adds the coverage collected by vm to the profile.
+func (p *CoverageProfile) AddRun(vm *VM) {
+	if vm.Coverage == nil {
+		return
+	}
+
+	branching := branchingFuncs()
+	type lineKey struct {
+		file string
+		line int
+	}
+	lineHits := make(map[lineKey]int)
+
+	for pc, instr := range vm.Program {
+		if !instr.Pos.IsValid() {
+			continue
+		}
+		fc := p.file(instr.Pos.File)
+
+		// Defining an object is not the same as running it; count calls instead.
+		if instr.Op == OpDefFunc {
+			name := instr.Oprand1.StringData
+			fc.function(name, instr.Pos.Line).Hits += vm.Coverage.Calls[name]
+			continue
+		}
+
+		key := lineKey{file: instr.Pos.File, line: instr.Pos.Line}
+		if hits := vm.Coverage.Hits[pc]; hits > lineHits[key] {
+			lineHits[key] = hits
+		} else if _, ok := lineHits[key]; !ok {
+			lineHits[key] = 0
+		}
+
+		if instr.Op == OpCall && branching[instr.Oprand1.StringData] {
+			taken := fc.branch(BranchPoint{Line: instr.Pos.Line, Column: instr.Pos.Column})
+			if counted, ok := vm.Coverage.Branches[pc]; ok {
+				taken[0] += counted[0]
+				taken[1] += counted[1]
+			}
+		}
+	}
+
+	for key, hits := range lineHits {
+		p.file(key.file).Lines[key.line] += hits
+	}
+}
+
+// Merge adds every count of other to the profile.
+func (p *CoverageProfile) Merge(other *CoverageProfile) {
+	for name, ofc := range other.Files {
+		fc := p.file(name)
+		for line, hits := range ofc.Lines {
+			fc.Lines[line] += hits
+		}
+		for fname, ofn := range ofc.Funcs {
+			fc.function(fname, ofn.Line).Hits += ofn.Hits
+		}
+		for bp, otaken := range ofc.Branches {
+			taken := fc.branch(bp)
+			taken[0] += otaken[0]
+			taken[1] += otaken[1]
+		}
+	}
+}
+
+func (p *CoverageProfile) fileNames() []string {
+	names := make([]string, 0, len(p.Files))
+	for name := range p.Files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func sortedLines(lines map[int]int) []int {
+	result := make([]int, 0, len(lines))
+	for line := range lines {
+		result = append(result, line)
+	}
+	sort.Ints(result)
+	return result
+}
+
+func sortedFuncNames(funcs map[string]*FuncCoverage) []string {
+	result := make([]string, 0, len(funcs))
+	for name := range funcs {
+		result = append(result, name)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		a, b := funcs[result[i]], funcs[result[j]]
+		if a.Line != b.Line {
+			return a.Line < b.Line
+		}
+		return result[i] < result[j]
+	})
+	return result
+}
+
+func sortedBranchPoints(branches map[BranchPoint]*[2]int) []BranchPoint {
+	result := make([]BranchPoint, 0, len(branches))
+	for bp := range branches {
+		result = append(result, bp)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].Line != result[j].Line {
+			return result[i].Line < result[j].Line
+		}
+		return result[i].Column < result[j].Column
+	})
+	return result
+}
+
+// WriteLCOV writes the profile in the LCOV tracefile format.
+func (p *CoverageProfile) WriteLCOV(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+
+	for _, name := range p.fileNames() {
+		fc := p.Files[name]
+		fmt.Fprintln(bw, "TN:")
+		fmt.Fprintf(bw, "SF:%s\n", name)
+
+		funcNames := sortedFuncNames(fc.Funcs)
+		fnHit := 0
+		for _, fname := range funcNames {
+			fmt.Fprintf(bw, "FN:%d,%s\n", fc.Funcs[fname].Line, fname)
+		}
+		for _, fname := range funcNames {
+			fmt.Fprintf(bw, "FNDA:%d,%s\n", fc.Funcs[fname].Hits, fname)
+			if fc.Funcs[fname].Hits > 0 {
+				fnHit++
+			}
+		}
+		fmt.Fprintf(bw, "FNF:%d\nFNH:%d\n", len(funcNames), fnHit)
+
+		brHit := 0
+		for _, bp := range sortedBranchPoints(fc.Branches) {
+			taken := fc.Branches[bp]
+			for branch, count := range taken {
+				if fc.Lines[bp.Line] == 0 {
+					fmt.Fprintf(bw, "BRDA:%d,%d,%d,-\n", bp.Line, bp.Column, branch)
+					continue
+				}
+				fmt.Fprintf(bw, "BRDA:%d,%d,%d,%d\n", bp.Line, bp.Column, branch, count)
+				if count > 0 {
+					brHit++
+				}
+			}
+		}
+		fmt.Fprintf(bw, "BRF:%d\nBRH:%d\n", len(fc.Branches)*2, brHit)
+
+		lineHit := 0
+		for _, line := range sortedLines(fc.Lines) {
+			fmt.Fprintf(bw, "DA:%d,%d\n", line, fc.Lines[line])
+			if fc.Lines[line] > 0 {
+				lineHit++
+			}
+		}
+		fmt.Fprintf(bw, "LF:%d\nLH:%d\n", len(fc.Lines), lineHit)
+		fmt.Fprintln(bw, "end_of_record")
+	}
+
+	return bw.Flush()
+}
+
+// ReadLCOV parses a tracefile written by WriteLCOV so that runs can be merged.
+func ReadLCOV(r io.Reader) (*CoverageProfile, error) {
+	p := NewCoverageProfile()
+	var fc *FileCoverage
+	funcLines := make(map[string]int)
+
+	scanner := bufio.NewScanner(r)
+	lineNo := 0
+	for scanner.Scan() {
+		lineNo++
+		record := strings.TrimSpace(scanner.Text())
+		kind, value, _ := strings.Cut(record, ":")
+
+		if kind == "SF" {
+			fc = p.file(value)
+			funcLines = make(map[string]int)
+			continue
+		}
+		if fc == nil {
+			continue
+		}
+
+		fields := strings.Split(value, ",")
+		var err error
+		switch kind {
+		case "DA":
+			var line, hits int
+			if len(fields) < 2 {
+				err = fmt.Errorf("malformed DA record")
+				break
+			}
+			if line, err = strconv.Atoi(fields[0]); err == nil {
+				if hits, err = strconv.Atoi(fields[1]); err == nil {
+					fc.Lines[line] += hits
+				}
+			}
+		case "FN":
+			if len(fields) != 2 {
+				err = fmt.Errorf("malformed FN record")
+				break
+			}
+			var line int
+			if line, err = strconv.Atoi(fields[0]); err == nil {
+				funcLines[fields[1]] = line
+				fc.function(fields[1], line)
+			}
+		case "FNDA":
+			if len(fields) != 2 {
+				err = fmt.Errorf("malformed FNDA record")
+				break
+			}
+			var hits int
+			if hits, err = strconv.Atoi(fields[0]); err == nil {
+				fc.function(fields[1], funcLines[fields[1]]).Hits += hits
+			}
+		case "BRDA":
+			if len(fields) != 4 {
+				err = fmt.Errorf("malformed BRDA record")
+				break
+			}
+			var line, column, branch int
+			if line, err = strconv.Atoi(fields[0]); err != nil {
+				break
+			}
+			if column, err = strconv.Atoi(fields[1]); err != nil {
+				break
+			}
+			if branch, err = strconv.Atoi(fields[2]); err != nil || branch < 0 || branch > 1 {
+				err = fmt.Errorf("malformed BRDA record")
+				break
+			}
+			taken := fc.branch(BranchPoint{Line: line, Column: column})
+			if fields[3] != "-" {
+				var count int
+				if count, err = strconv.Atoi(fields[3]); err == nil {
+					taken[branch] += count
+				}
+			}
+		case "end_of_record":
+			fc = nil
+		}
+
+		if err != nil {
+			return nil, fmt.Errorf("lcov line %d: %w", lineNo, err)
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// WriteHTML renders an annotated listing of every covered source file.
+func (p *CoverageProfile) WriteHTML(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+
+	fmt.Fprintln(bw, "<!DOCTYPE html>")
+	fmt.Fprintln(bw, "<html><head><meta charset=\"utf-8\"><title>Cutter Coverage</title>")
+	fmt.Fprintln(bw, "<style>body{font-family:sans-serif} pre{margin:0} table{border-collapse:collapse} td{padding:0 .5em;vertical-align:top}")
+	fmt.Fprintln(bw, ".hit{background:#dfd} .miss{background:#fdd} .partial{background:#ffd} .count{color:#888;text-align:right}</style>")
+	fmt.Fprintln(bw, "</head><body>")
+	fmt.Fprintln(bw, "<h1>Cutter Coverage</h1>")
+
+	names := p.fileNames()
+
+	fmt.Fprintln(bw, "<table><tr><th>File</th><th>Lines</th><th>Objects</th><th>Branches</th></tr>")
+	for i, name := range names {
+		fc := p.Files[name]
+		lineHit, fnHit, brHit := fc.hitCounts()
+		fmt.Fprintf(bw, "<tr><td><a href=\"#file%d\">%s</a></td><td>%d/%d</td><td>%d/%d</td><td>%d/%d</td></tr>\n",
+			i, html.EscapeString(name), lineHit, len(fc.Lines), fnHit, len(fc.Funcs), brHit, len(fc.Branches)*2)
+	}
+	fmt.Fprintln(bw, "</table>")
+
+	for i, name := range names {
+		fc := p.Files[name]
+		fmt.Fprintf(bw, "<h2 id=\"file%d\">%s</h2>\n", i, html.EscapeString(name))
+
+		if len(fc.Funcs) > 0 {
+			fmt.Fprintln(bw, "<ul>")
+			for _, fname := range sortedFuncNames(fc.Funcs) {
+				fn := fc.Funcs[fname]
+				class := "hit"
+				if fn.Hits == 0 {
+					class = "miss"
+				}
+				fmt.Fprintf(bw, "<li class=\"%s\">%s (line %d): %d calls</li>\n", class, html.EscapeString(fname), fn.Line, fn.Hits)
+			}
+			fmt.Fprintln(bw, "</ul>")
+		}
+
+		source, err := os.ReadFile(name)
+		if err != nil {
+			fmt.Fprintf(bw, "<p>source unavailable: %s</p>\n", html.EscapeString(err.Error()))
+			continue
+		}
+
+		branchesByLine := make(map[int][]*[2]int)
+		for _, bp := range sortedBranchPoints(fc.Branches) {
+			branchesByLine[bp.Line] = append(branchesByLine[bp.Line], fc.Branches[bp])
+		}
+
+		fmt.Fprintln(bw, "<table>")
+		for idx, text := range strings.Split(string(source), "\n") {
+			line := idx + 1
+			class, count := "", ""
+			if hits, ok := fc.Lines[line]; ok {
+				count = strconv.Itoa(hits)
+				class = "hit"
+				if hits == 0 {
+					class = "miss"
+				}
+			}
+			for _, taken := range branchesByLine[line] {
+				if class == "hit" && (taken[0] == 0 || taken[1] == 0) {
+					class = "partial"
+				}
+				count += fmt.Sprintf(" [T%d F%d]", taken[0], taken[1])
+			}
+			fmt.Fprintf(bw, "<tr class=\"%s\"><td class=\"count\">%d</td><td class=\"count\">%s</td><td><pre>%s</pre></td></tr>\n",
+				class, line, count, html.EscapeString(text))
+		}
+		fmt.Fprintln(bw, "</table>")
+	}
+
+	fmt.Fprintln(bw, "</body></html>")
+	return bw.Flush()
+}
+
+func (fc *FileCoverage) hitCounts() (lineHit int, fnHit int, brHit int) {
+	for _, hits := range fc.Lines {
+		if hits > 0 {
+			lineHit++
+		}
+	}
+	for _, fn := range fc.Funcs {
+		if fn.Hits > 0 {
+			fnHit++
+		}
+	}
+	for _, taken := range fc.Branches {
+		for _, count := range taken {
+			if count > 0 {
+				brHit++
+			}
+		}
+	}
+	return lineHit, fnHit, brHit
+}
@@ -0,0 +1,170 @@
+package runtime
+
+import (
+	"bytes"
+	"cutter/lexer"
+	"cutter/parser"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// coverageRun compiles and runs source with coverage enabled and returns its
+// profile.
+func coverageRun(t *testing.T, fileName string, source string) *CoverageProfile {
+	t.Helper()
+	lex := lexer.NewLexerWithFile(fileName)
+	lex.SetInput(strings.NewReader(source))
+	vm := NewVM(NewCompiler().CompileASTToVMInstr(parser.NewParser().ParseStream(lex)))
+	vm.IO = NewIOWithWriter(&bytes.Buffer{})
+	vm.EnableCoverage()
+	vm.Run()
+
+	profile := NewCoverageProfile()
+	profile.AddRun(vm)
+	return profile
+}
+
+func sampleProfile() *CoverageProfile {
+	p := NewCoverageProfile()
+	a := p.file("a.cm")
+	a.Lines[1] = 2
+	a.Lines[3] = 0
+	a.Lines[4] = 1
+	a.function("greet", 1).Hits = 2
+	a.function("unused", 3).Hits = 0
+	*a.branch(BranchPoint{Line: 4, Column: 7}) = [2]int{1, 0}
+	*a.branch(BranchPoint{Line: 3, Column: 2}) = [2]int{0, 0}
+
+	b := p.file("lib/b.cm")
+	b.Lines[10] = 5
+	return p
+}
+
+func TestLCOVRoundTrip(t *testing.T) {
+	run := coverageRun(t, "run.cm", "@define(pick x ifel(x `yes` `no`))\n@pick(!t)\n@pick(!t)\n@define(unused 1)\n")
+	if fc := run.Files["run.cm"]; fc == nil || fc.Funcs["pick"] == nil || fc.Funcs["pick"].Hits != 2 || len(fc.Branches) != 1 {
+		t.Fatalf("coverage of the run was not collected: %+v", fc)
+	}
+
+	for name, profile := range map[string]*CoverageProfile{
+		"sample": sampleProfile(),
+		"run":    run,
+		"empty":  NewCoverageProfile(),
+	} {
+		var first bytes.Buffer
+		if err := profile.WriteLCOV(&first); err != nil {
+			t.Fatalf("%s: WriteLCOV: %v", name, err)
+		}
+		read, err := ReadLCOV(bytes.NewReader(first.Bytes()))
+		if err != nil {
+			t.Fatalf("%s: ReadLCOV: %v\n%s", name, err, first.String())
+		}
+		if !reflect.DeepEqual(read, profile) {
+			t.Errorf("%s: profile changed in a round trip\nwrote:\n%s", name, first.String())
+		}
+
+		var second bytes.Buffer
+		if err := read.WriteLCOV(&second); err != nil {
+			t.Fatalf("%s: WriteLCOV: %v", name, err)
+		}
+		if first.String() != second.String() {
+			t.Errorf("%s: tracefile changed in a round trip\nfirst:\n%s\nsecond:\n%s", name, first.String(), second.String())
+		}
+	}
+}
+
+func TestLCOVRecords(t *testing.T) {
+	var out bytes.Buffer
+	if err := sampleProfile().WriteLCOV(&out); err != nil {
+		t.Fatal(err)
+	}
+	want := `TN:
+SF:a.cm
+FN:1,greet
+FN:3,unused
+FNDA:2,greet
+FNDA:0,unused
+FNF:2
+FNH:1
+BRDA:3,2,0,-
+BRDA:3,2,1,-
+BRDA:4,7,0,1
+BRDA:4,7,1,0
+BRF:4
+BRH:1
+DA:1,2
+DA:3,0
+DA:4,1
+LF:3
+LH:2
+end_of_record
+TN:
+SF:lib/b.cm
+FNF:0
+FNH:0
+BRF:0
+BRH:0
+DA:10,5
+LF:1
+LH:1
+end_of_record
+`
+	if out.String() != want {
+		t.Errorf("got:\n%s\nwant:\n%s", out.String(), want)
+	}
+}
+
+func TestLCOVMerge(t *testing.T) {
+	var out bytes.Buffer
+	if err := sampleProfile().WriteLCOV(&out); err != nil {
+		t.Fatal(err)
+	}
+	read, err := ReadLCOV(bytes.NewReader(out.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	other := NewCoverageProfile()
+	c := other.file("a.cm")
+	c.Lines[3] = 4
+	c.Lines[7] = 1
+	c.function("unused", 3).Hits = 1
+	*c.branch(BranchPoint{Line: 4, Column: 7}) = [2]int{0, 2}
+	read.Merge(other)
+
+	a := read.Files["a.cm"]
+	if want := map[int]int{1: 2, 3: 4, 4: 1, 7: 1}; !reflect.DeepEqual(a.Lines, want) {
+		t.Errorf("merged lines %v, want %v", a.Lines, want)
+	}
+	if a.Funcs["greet"].Hits != 2 || a.Funcs["unused"].Hits != 1 {
+		t.Errorf("merged function hits greet %d, unused %d", a.Funcs["greet"].Hits, a.Funcs["unused"].Hits)
+	}
+	if got := *a.Branches[BranchPoint{Line: 4, Column: 7}]; got != [2]int{1, 2} {
+		t.Errorf("merged branch %v, want [1 2]", got)
+	}
+	if read.Files["lib/b.cm"].Lines[10] != 5 {
+		t.Errorf("a file only in one profile lost its counts")
+	}
+}
+
+func TestReadLCOVErrors(t *testing.T) {
+	for _, input := range []string{
+		"SF:a.cm\nDA:1\n",
+		"SF:a.cm\nDA:x,1\n",
+		"SF:a.cm\nFN:1\n",
+		"SF:a.cm\nFNDA:x,f\n",
+		"SF:a.cm\nBRDA:1,2,3\n",
+		"SF:a.cm\nBRDA:1,2,2,0\n",
+		"SF:a.cm\nBRDA:1,2,0,x\n",
+	} {
+		if _, err := ReadLCOV(strings.NewReader(input)); err == nil || !strings.Contains(err.Error(), "lcov line 2") {
+			t.Errorf("%q: error %v, want one on line 2", input, err)
+		}
+	}
+
+	// Records outside of a source file are skipped, like other tools do.
+	if _, err := ReadLCOV(strings.NewReader("TN:\nDA:x\nend_of_record\n")); err != nil {
+		t.Errorf("records outside of a file: %v", err)
+	}
+}
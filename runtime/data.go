@@ -0,0 +1,271 @@
+package runtime
+
+import (
+	"bufio"
+	"cutter/parser"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// DataObject is one named value of a DataSet.
+type DataObject struct {
+	Name  string
+	Value parser.ValueObject
+}
+
+// DataArray is one named array of a DataSet.
+type DataArray struct {
+	Name  string
+	Items []parser.ValueObject
+}
+
+// DataSet is structured input flattened into Cutter objects and arrays.
+//
+// Scalars become objects named by their dotted path (user.name, rows.0.id).
+// A JSON array becomes an array of its items under its path, and a JSON object
+// an array of its keys, so both can be walked with arrlen/arrget. Items that
+// are themselves arrays or objects are stored as their path string, which can
+// be passed to get or arrget.
+type DataSet struct {
+	Objects []DataObject
+	Arrays  []DataArray
+}
+
+func NewDataSet() *DataSet {
+	return &DataSet{
+		Objects: make([]DataObject, 0),
+		Arrays:  make([]DataArray, 0),
+	}
+}
+
+func joinDataPath(prefix string, key string) string {
+	if prefix == "" {
+		return key
+	}
+	return prefix + "." + key
+}
+
+// LoadJSON decodes one JSON document and adds it to the data set under prefix.
+// An empty prefix binds the keys of a top-level JSON object directly.
+func (ds *DataSet) LoadJSON(r io.Reader, prefix string) error {
+	dec := json.NewDecoder(r)
+	dec.UseNumber()
+
+	first, err := dec.Token()
+	if err != nil {
+		return err
+	}
+	if delim, ok := first.(json.Delim); prefix == "" && (!ok || delim != '{') {
+		return fmt.Errorf("a JSON document without a prefix must be an object")
+	}
+
+	if _, err := ds.loadJSONValue(dec, first, prefix); err != nil {
+		return err
+	}
+	if _, err := dec.Token(); err != io.EOF {
+		return fmt.Errorf("unexpected data after the JSON document")
+	}
+	return nil
+}
+
+// loadJSONValue binds the value starting with tok at path and returns what an
+// enclosing array should hold for it.
+func (ds *DataSet) loadJSONValue(dec *json.Decoder, tok json.Token, path string) (parser.ValueObject, error) {
+	switch v := tok.(type) {
+	case json.Delim:
+		items := make([]parser.ValueObject, 0)
+
+		switch v {
+		case '[':
+			for i := 0; dec.More(); i++ {
+				next, err := dec.Token()
+				if err != nil {
+					return parser.ValueObject{}, err
+				}
+				item, err := ds.loadJSONValue(dec, next, joinDataPath(path, strconv.Itoa(i)))
+				if err != nil {
+					return parser.ValueObject{}, err
+				}
+				items = append(items, item)
+			}
+		case '{':
+			for dec.More() {
+				keyTok, err := dec.Token()
+				if err != nil {
+					return parser.ValueObject{}, err
+				}
+				key := keyTok.(string)
+				next, err := dec.Token()
+				if err != nil {
+					return parser.ValueObject{}, err
+				}
+				if _, err := ds.loadJSONValue(dec, next, joinDataPath(path, key)); err != nil {
+					return parser.ValueObject{}, err
+				}
+				items = append(items, parser.ValueObject{Type: parser.STRING, StringData: key})
+			}
+		}
+
+		// Consume the closing delimiter.
+		if _, err := dec.Token(); err != nil {
+			return parser.ValueObject{}, err
+		}
+		if path != "" {
+			ds.Arrays = append(ds.Arrays, DataArray{Name: path, Items: items})
+		}
+		return parser.ValueObject{Type: parser.STRING, StringData: path}, nil
+
+	case json.Number:
+		value := parser.ValueObject{Type: parser.REAL}
+		if i, err := v.Int64(); err == nil {
+			value = parser.ValueObject{Type: parser.INTGER, IntData: i}
+		} else if f, err := v.Float64(); err == nil {
+			value.FloatData = f
+		} else {
+			return parser.ValueObject{}, fmt.Errorf("%s: invalid number %s", path, v)
+		}
+		ds.addObject(path, value)
+		return value, nil
+
+	case string:
+		value := parser.ValueObject{Type: parser.STRING, StringData: v}
+		ds.addObject(path, value)
+		return value, nil
+
+	case bool:
+		value := parser.ValueObject{Type: parser.BOOLEAN, BoolData: v}
+		ds.addObject(path, value)
+		return value, nil
+
+	case nil:
+		// Cutter has no null; it renders as nothing.
+		value := parser.ValueObject{Type: parser.STRING}
+		ds.addObject(path, value)
+		return value, nil
+	}
+
+	return parser.ValueObject{}, fmt.Errorf("%s: unsupported JSON token %v", path, tok)
+}
+
+// CSVOptions controls how LoadCSV splits a file into records.
+type CSVOptions struct {
+	Delimiter rune
+	// Header takes column names from the first row; otherwise columns are numbered from 0.
+	Header bool
+	// Quoted enables RFC 4180 double quotes; when false every delimiter splits a field.
+	Quoted bool
+}
+
+// DefaultCSVOptions returns the options for path: tab separated for .tsv files,
+// comma separated otherwise, with a header row and quoting.
+func DefaultCSVOptions(path string) CSVOptions {
+	opts := CSVOptions{Delimiter: ',', Header: true, Quoted: true}
+	if strings.EqualFold(filepath.Ext(path), ".tsv") {
+		opts.Delimiter = '\t'
+	}
+	return opts
+}
+
+func readUnquotedRecords(r io.Reader, delimiter rune) ([][]string, error) {
+	records := make([][]string, 0)
+	// A bufio.Reader, unlike a Scanner, has no limit on the length of a row.
+	reader := bufio.NewReader(r)
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil && err != io.EOF {
+			return nil, err
+		}
+		line = strings.TrimSuffix(strings.TrimSuffix(line, "\n"), "\r")
+		if line != "" {
+			records = append(records, strings.Split(line, string(delimiter)))
+		}
+		if err == io.EOF {
+			return records, nil
+		}
+	}
+}
+
+// LoadCSV reads delimited rows and adds them to the data set under prefix, laid
+// out like a JSON array of objects: prefix holds the record paths, prefix.N the
+// column names of record N and prefix.N.column its fields, all as strings.
+func (ds *DataSet) LoadCSV(r io.Reader, prefix string, opts CSVOptions) error {
+	if prefix == "" {
+		return fmt.Errorf("CSV data needs a prefix")
+	}
+
+	var records [][]string
+	var err error
+	if opts.Quoted {
+		reader := csv.NewReader(r)
+		reader.Comma = opts.Delimiter
+		reader.FieldsPerRecord = -1
+		records, err = reader.ReadAll()
+	} else {
+		records, err = readUnquotedRecords(r, opts.Delimiter)
+	}
+	if err != nil {
+		return err
+	}
+
+	columns := make([]string, 0)
+	if opts.Header && len(records) > 0 {
+		columns = records[0]
+		records = records[1:]
+	}
+
+	rows := make([]parser.ValueObject, 0, len(records))
+	for i, record := range records {
+		rowPath := joinDataPath(prefix, strconv.Itoa(i))
+		names := make([]parser.ValueObject, 0, len(record))
+
+		for j, field := range record {
+			column := strconv.Itoa(j)
+			if j < len(columns) && columns[j] != "" {
+				column = columns[j]
+			}
+			ds.addObject(joinDataPath(rowPath, column), parser.ValueObject{Type: parser.STRING, StringData: field})
+			names = append(names, parser.ValueObject{Type: parser.STRING, StringData: column})
+		}
+		// Short rows still get every header column, empty.
+		for j := len(record); j < len(columns); j++ {
+			ds.addObject(joinDataPath(rowPath, columns[j]), parser.ValueObject{Type: parser.STRING})
+			names = append(names, parser.ValueObject{Type: parser.STRING, StringData: columns[j]})
+		}
+
+		ds.Arrays = append(ds.Arrays, DataArray{Name: rowPath, Items: names})
+		rows = append(rows, parser.ValueObject{Type: parser.STRING, StringData: rowPath})
+	}
+	ds.Arrays = append(ds.Arrays, DataArray{Name: prefix, Items: rows})
+
+	return nil
+}
+
+func (ds *DataSet) addObject(name string, value parser.ValueObject) {
+	ds.Objects = append(ds.Objects, DataObject{Name: name, Value: value})
+}
+
+// DefineIn makes every object of the data set known to the compiler, so that
+// templates can call them directly, e.g. @user.name().
+func (ds *DataSet) DefineIn(c *Compiler) {
+	for _, obj := range ds.Objects {
+		c.DefineVariable(obj.Name, obj.Value)
+	}
+}
+
+// BindTo stores the objects and arrays of the data set in VM memory.
+func (ds *DataSet) BindTo(vm *VM) {
+	for _, obj := range ds.Objects {
+		vm.DefineObject(obj.Name, obj.Value)
+	}
+	for _, arr := range ds.Arrays {
+		vm.Mem.MakeArray(arr.Name)
+		for _, item := range arr.Items {
+			vm.Mem.PushArrayItem(arr.Name, transformToVMDataObject(item))
+		}
+	}
+}
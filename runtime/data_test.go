@@ -0,0 +1,263 @@
+package runtime
+
+import (
+	"cutter/parser"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func describeValue(v parser.ValueObject) string {
+	switch v.Type {
+	case parser.INTGER:
+		return fmt.Sprintf("int %d", v.IntData)
+	case parser.REAL:
+		return fmt.Sprintf("real %v", v.FloatData)
+	case parser.BOOLEAN:
+		return fmt.Sprintf("bool %t", v.BoolData)
+	case parser.STRING:
+		return fmt.Sprintf("%q", v.StringData)
+	}
+	return fmt.Sprintf("type %d", v.Type)
+}
+
+// dumpDataSet lists the objects and arrays of ds one per line, in the order
+// they were added.
+func dumpDataSet(ds *DataSet) []string {
+	lines := make([]string, 0, len(ds.Objects)+len(ds.Arrays))
+	for _, obj := range ds.Objects {
+		lines = append(lines, obj.Name+" = "+describeValue(obj.Value))
+	}
+	for _, arr := range ds.Arrays {
+		items := make([]string, 0, len(arr.Items))
+		for _, item := range arr.Items {
+			items = append(items, describeValue(item))
+		}
+		lines = append(lines, arr.Name+" = ["+strings.Join(items, " ")+"]")
+	}
+	return lines
+}
+
+func TestLoadJSON(t *testing.T) {
+	tests := []struct {
+		name   string
+		input  string
+		prefix string
+		want   []string
+		err    string // a part of the expected error; "*" for any error
+	}{
+		{
+			name:  "scalars",
+			input: `{"n": 3, "big": 1e3, "pi": 3.5, "s": "x", "t": true, "none": null}`,
+			want: []string{
+				`n = int 3`, `big = real 1000`, `pi = real 3.5`, `s = "x"`, `t = bool true`, `none = ""`,
+			},
+		},
+		{
+			name:   "nested",
+			input:  `{"user": {"name": "kim", "tags": ["a", "b"]}, "rows": [{"id": 1}, [2]]}`,
+			prefix: "data",
+			want: []string{
+				`data.user.name = "kim"`,
+				`data.user.tags.0 = "a"`,
+				`data.user.tags.1 = "b"`,
+				`data.rows.0.id = int 1`,
+				`data.rows.1.0 = int 2`,
+				`data.user.tags = ["a" "b"]`,
+				`data.user = ["name" "tags"]`,
+				`data.rows.0 = ["id"]`,
+				`data.rows.1 = [int 2]`,
+				`data.rows = ["data.rows.0" "data.rows.1"]`,
+				`data = ["user" "rows"]`,
+			},
+		},
+		{
+			name:   "top-level array",
+			input:  `[1, "two"]`,
+			prefix: "items",
+			want:   []string{`items.0 = int 1`, `items.1 = "two"`, `items = [int 1 "two"]`},
+		},
+		{
+			name:   "top-level scalar",
+			input:  `42`,
+			prefix: "answer",
+			want:   []string{`answer = int 42`},
+		},
+		{name: "array without prefix", input: `[1]`, err: "must be an object"},
+		{name: "trailing data", input: `{} {}`, err: "unexpected data after the JSON document"},
+		{name: "malformed", input: `{"a": }`, err: "*"},
+		{name: "truncated", input: `{"a": [1`, err: "*"},
+	}
+
+	for _, test := range tests {
+		ds := NewDataSet()
+		err := ds.LoadJSON(strings.NewReader(test.input), test.prefix)
+		if test.err != "" {
+			if err == nil || (test.err != "*" && !strings.Contains(err.Error(), test.err)) {
+				t.Errorf("%s: error %v, want %q", test.name, err, test.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error %v", test.name, err)
+			continue
+		}
+		if got := dumpDataSet(ds); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s:\ngot  %q\nwant %q", test.name, got, test.want)
+		}
+	}
+}
+
+func TestLoadCSV(t *testing.T) {
+	comma := CSVOptions{Delimiter: ',', Header: true, Quoted: true}
+	tests := []struct {
+		name  string
+		input string
+		opts  CSVOptions
+		want  []string
+		err   string
+	}{
+		{
+			name:  "header",
+			input: "name,qty\nbolt,3\nnut,10\n",
+			opts:  comma,
+			want: []string{
+				`rows.0.name = "bolt"`, `rows.0.qty = "3"`,
+				`rows.1.name = "nut"`, `rows.1.qty = "10"`,
+				`rows.0 = ["name" "qty"]`, `rows.1 = ["name" "qty"]`, `rows = ["rows.0" "rows.1"]`,
+			},
+		},
+		{
+			name:  "quoting",
+			input: "name,note\n\"a, b\",\"say \"\"hi\"\"\"\n\"multi\nline\",x\r\n",
+			opts:  comma,
+			want: []string{
+				`rows.0.name = "a, b"`, `rows.0.note = "say \"hi\""`,
+				`rows.1.name = "multi\nline"`, `rows.1.note = "x"`,
+				`rows.0 = ["name" "note"]`, `rows.1 = ["name" "note"]`, `rows = ["rows.0" "rows.1"]`,
+			},
+		},
+		{
+			name:  "short and long rows",
+			input: "a,b,c\n1\n1,2,3,4\n",
+			opts:  comma,
+			want: []string{
+				`rows.0.a = "1"`, `rows.0.b = ""`, `rows.0.c = ""`,
+				`rows.1.a = "1"`, `rows.1.b = "2"`, `rows.1.c = "3"`, `rows.1.3 = "4"`,
+				`rows.0 = ["a" "b" "c"]`, `rows.1 = ["a" "b" "c" "3"]`, `rows = ["rows.0" "rows.1"]`,
+			},
+		},
+		{
+			name:  "no header",
+			input: "bolt,3\n",
+			opts:  CSVOptions{Delimiter: ',', Quoted: true},
+			want:  []string{`rows.0.0 = "bolt"`, `rows.0.1 = "3"`, `rows.0 = ["0" "1"]`, `rows = ["rows.0"]`},
+		},
+		{
+			name:  "no quoting",
+			input: "name;note\n\"a;b\";it's \"quoted\"\n\n",
+			opts:  CSVOptions{Delimiter: ';', Header: true},
+			want: []string{
+				`rows.0.name = "\"a"`, `rows.0.note = "b\""`, `rows.0.2 = "it's \"quoted\""`,
+				`rows.0 = ["name" "note" "2"]`, `rows = ["rows.0"]`,
+			},
+		},
+		{
+			name:  "no quoting, CRLF and no final newline",
+			input: "k,v\r\na,1\r\nb,2",
+			opts:  CSVOptions{Delimiter: ',', Header: true},
+			want: []string{
+				`rows.0.k = "a"`, `rows.0.v = "1"`, `rows.1.k = "b"`, `rows.1.v = "2"`,
+				`rows.0 = ["k" "v"]`, `rows.1 = ["k" "v"]`, `rows = ["rows.0" "rows.1"]`,
+			},
+		},
+		{
+			name:  "no quoting, row over 64KB",
+			input: "k,v\n" + strings.Repeat("x", 100000) + ",1\n",
+			opts:  CSVOptions{Delimiter: ',', Header: true},
+			want: []string{
+				`rows.0.k = "` + strings.Repeat("x", 100000) + `"`, `rows.0.v = "1"`,
+				`rows.0 = ["k" "v"]`, `rows = ["rows.0"]`,
+			},
+		},
+		{
+			name:  "tab separated",
+			input: "k\tv\nx y\t1\n",
+			opts:  DefaultCSVOptions("data.TSV"),
+			want:  []string{`rows.0.k = "x y"`, `rows.0.v = "1"`, `rows.0 = ["k" "v"]`, `rows = ["rows.0"]`},
+		},
+		{
+			name:  "header only",
+			input: "a,b\n",
+			opts:  comma,
+			want:  []string{`rows = []`},
+		},
+		{name: "bare quote", input: "a\nx\"y\n", opts: comma, err: "bare \" in non-quoted-field"},
+	}
+
+	for _, test := range tests {
+		ds := NewDataSet()
+		err := ds.LoadCSV(strings.NewReader(test.input), "rows", test.opts)
+		if test.err != "" {
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("%s: error %v, want %q", test.name, err, test.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error %v", test.name, err)
+			continue
+		}
+		if got := dumpDataSet(ds); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s:\ngot  %q\nwant %q", test.name, got, test.want)
+		}
+	}
+
+	if err := NewDataSet().LoadCSV(strings.NewReader("a\n1\n"), "", comma); err == nil {
+		t.Errorf("CSV data without a prefix was accepted")
+	}
+}
+
+func TestDefaultCSVOptions(t *testing.T) {
+	for path, delimiter := range map[string]rune{"a.csv": ',', "a.tsv": '\t', "a.TSV": '\t', "a.txt": ','} {
+		opts := DefaultCSVOptions(path)
+		if opts.Delimiter != delimiter || !opts.Header || !opts.Quoted {
+			t.Errorf("DefaultCSVOptions(%q) = %+v", path, opts)
+		}
+	}
+}
+
+// Data loaded while the template runs is bound after compilation, so only
+// get reaches it.
+func TestLoadAtRuntime(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{"u.json": `{"name": "ann"}`, "r.csv": "id\n7\n"})
+	t.Chdir(dir)
+
+	tests := []struct {
+		source string
+		want   string
+		err    string
+	}{
+		{"@jsonload(`u.json` `u`)[@get(`u.name`)]", "!t[ann]", ""},
+		{"@csvload(`r.csv` `r`)[@get(`r.0.id`)]", "1[7]", ""},
+		{"@jsonload(`u.json` `u`)@u.name()", "", "test.cm:1:25: undefined object 'u.name'"},
+		{"@csvload(`r.csv` `r`)@r.0.id()", "", "test.cm:1:23: undefined object 'r.0.id'"},
+	}
+
+	for _, test := range tests {
+		got, err := runSource(test.source)
+		if test.err != "" {
+			if err == nil || err.Error() != test.err {
+				t.Errorf("%s: error %v, want %q", test.source, err, test.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error %v", test.source, err)
+		} else if got != test.want {
+			t.Errorf("%s: output %q, want %q", test.source, got, test.want)
+		}
+	}
+}
@@ -11,9 +11,9 @@ func DumpRegisters(vm *VM) {
 	}
 
 	for k, reg := range vm.Reg.ArgumentRegisterMap {
-		fmt.Printf("R%d: %s ", k, formatVMDataObject(vm.Reg.GetRegister(reg)))
+		fmt.Printf("R%d: %s ", k, FormatVMDataObject(vm.Reg.GetRegister(reg)))
 	}
-	fmt.Println("\nValue Register: ", formatVMDataObject(vm.Reg.ReturnValueRegister))
+	fmt.Println("\nValue Register: ", FormatVMDataObject(vm.Reg.ReturnValueRegister))
 	fmt.Println("Register Clear Count: ", vm.Reg.register_cleared_count)
 }
 
@@ -99,14 +99,14 @@ func ResolveVMInstruction(instr VMInstr) string {
 	}
 
 	// Format operands
-	oprand1Str := formatVMDataObject(instr.Oprand1)
-	oprand2Str := formatVMDataObject(instr.Oprand2)
-	oprand3Str := formatVMDataObject(instr.Oprand3)
+	oprand1Str := FormatVMDataObject(instr.Oprand1)
+	oprand2Str := FormatVMDataObject(instr.Oprand2)
+	oprand3Str := FormatVMDataObject(instr.Oprand3)
 
 	return fmt.Sprintf("%s %s %s %s", opCode, oprand1Str, oprand2Str, oprand3Str)
 }
 
-func formatVMDataObject(obj VMDataObject) string {
+func FormatVMDataObject(obj VMDataObject) string {
 	switch obj.Type {
 	case INTGER:
 		return fmt.Sprintf("INT(%d)", obj.IntData)
@@ -0,0 +1,141 @@
+package runtime
+
+import (
+	"cutter/lexer"
+	"cutter/parser"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// includeRun compiles and runs source as the template fileName with com and
+// returns its output, turning a panic into an error.
+func includeRun(com *Compiler, fileName string, source string) (output string, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("%v", r)
+		}
+	}()
+
+	head := parser.NewParser().DoParse(lexer.NewLexerWithFile(fileName).DoLex(source))
+	vm := NewVM(com.CompileASTToVMInstr(head))
+	vm.Run()
+	return vm.IO.ReadBuffer(), nil
+}
+
+func TestIncludeSearchOrder(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{
+		"site/page.cm":       "",
+		"site/here.cm":       "site",
+		"site/sub/nested.cm": "@include(`here.cm`)",
+		"site/sub/here.cm":   "sub",
+		"first/here.cm":      "first",
+		"first/lib.cm":       "first",
+		"second/lib.cm":      "second",
+		"second/only.cm":     "second only",
+	})
+	page := filepath.Join(dir, "site", "page.cm")
+	searchPath := []string{filepath.Join(dir, "first"), filepath.Join(dir, "second")}
+
+	tests := []struct {
+		name   string
+		source string
+		want   string
+	}{
+		{"next to the including file", "@include(`here.cm`)", "site"},
+		{"next to a nested include", "@include(`sub/nested.cm`)", "sub"},
+		{"search path in order", "@include(`lib.cm`)", "first"},
+		{"later search directory", "@include(`only.cm`)", "second only"},
+		{"absolute path", "@include(`" + filepath.ToSlash(filepath.Join(dir, "second", "lib.cm")) + "`)", "second"},
+	}
+
+	for _, test := range tests {
+		com := NewCompiler()
+		com.SetIncludePath(searchPath)
+		got, err := includeRun(com, page, test.source)
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		if got != test.want {
+			t.Errorf("%s: output %q, want %q", test.name, got, test.want)
+		}
+	}
+}
+
+func TestIncludeFromStdin(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{"lib.cm": "cwd"})
+	t.Chdir(dir)
+
+	for _, name := range []string{"<stdin>", "<repl:1>"} {
+		got, err := includeRun(NewCompiler(), name, "@include(`lib.cm`)")
+		if err != nil || got != "cwd" {
+			t.Errorf("%s: output %q, error %v; want the file in the working directory", name, got, err)
+		}
+	}
+}
+
+func TestIncludeNotFound(t *testing.T) {
+	dir := t.TempDir()
+	page := filepath.Join(dir, "page.cm")
+	first, second := filepath.Join(dir, "first"), filepath.Join(dir, "second")
+
+	com := NewCompiler()
+	com.SetIncludePath([]string{first, second})
+	_, err := includeRun(com, page, "@include(`missing.cm`)")
+
+	want := fmt.Sprintf("%s:1:1: cannot find included file 'missing.cm', searched: %s, %s, %s", page,
+		filepath.Join(dir, "missing.cm"), filepath.Join(first, "missing.cm"), filepath.Join(second, "missing.cm"))
+	if err == nil || err.Error() != want {
+		t.Errorf("error %v\nwant %s", err, want)
+	}
+}
+
+func TestIncludeCycles(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{
+		"self.cm":    "@include(`self.cm`)",
+		"a.cm":       "@include(`b.cm`)",
+		"b.cm":       "@include(`sub/c.cm`)",
+		"sub/c.cm":   "@include(`../a.cm`)",
+		"top.cm":     "@include(`left.cm`)@include(`right.cm`)",
+		"left.cm":    "@include(`shared.cm`)",
+		"right.cm":   "@include(`shared.cm`)",
+		"shared.cm":  "x",
+		"loop.cm":    "@include(`a.cm`)",
+		"reenter.cm": "@include(`page.cm`)",
+		"page.cm":    "",
+	})
+	path := func(name string) string { return filepath.Join(dir, filepath.FromSlash(name)) }
+
+	tests := []struct {
+		name     string
+		template string
+		source   string
+		want     string // the cycle in the error, empty when there is none
+	}{
+		{"self", "page.cm", "@include(`self.cm`)", path("page.cm") + " -> " + path("self.cm") + " -> " + path("self.cm")},
+		{"template itself", "page.cm", "@include(`page.cm`)", path("page.cm") + " -> " + path("page.cm")},
+		{"through the template", "page.cm", "@include(`reenter.cm`)", path("page.cm") + " -> " + path("reenter.cm") + " -> " + path("page.cm")},
+		{"longer cycle", "page.cm", "@include(`loop.cm`)",
+			strings.Join([]string{path("page.cm"), path("loop.cm"), path("a.cm"), path("b.cm"), path("sub/c.cm"), path("a.cm")}, " -> ")},
+		{"shared include", "page.cm", "@include(`top.cm`)", ""},
+		{"same include twice", "page.cm", "@include(`shared.cm`)@include(`shared.cm`)", ""},
+	}
+
+	for _, test := range tests {
+		_, err := includeRun(NewCompiler(), path(test.template), test.source)
+		if test.want == "" {
+			if err != nil {
+				t.Errorf("%s: unexpected error %v", test.name, err)
+			}
+			continue
+		}
+		if err == nil || !strings.HasSuffix(err.Error(), "include cycle: "+test.want) {
+			t.Errorf("%s: error %v\nwant the cycle %s", test.name, err, test.want)
+		}
+	}
+}
@@ -3,51 +3,380 @@ package runtime
 import (
 	"fmt"
 	"io"
+	"os"
+	"path/filepath"
+	"sort"
 	"strconv"
 	"strings"
 )
 
-// TODO: File IO
+// FileSandbox resolves the paths used by the file functions. Relative paths are
+// taken from BaseDir (the template's directory), and every path must stay inside
+// one of Roots after symlinks are followed.
+type FileSandbox struct {
+	BaseDir string
+	Roots   []string
+}
+
+// NewFileSandbox creates a sandbox for templates in baseDir. Without roots,
+// baseDir itself is the only root.
+func NewFileSandbox(baseDir string, roots []string) *FileSandbox {
+	base, err := filepath.Abs(baseDir)
+	if err != nil {
+		base = filepath.Clean(baseDir)
+	}
+	if len(roots) == 0 {
+		roots = []string{base}
+	}
+
+	fs := &FileSandbox{BaseDir: base, Roots: make([]string, 0, len(roots))}
+	for _, root := range roots {
+		if abs, err := filepath.Abs(root); err == nil {
+			root = abs
+		}
+		fs.Roots = append(fs.Roots, evalExistingPrefix(filepath.Clean(root)))
+	}
+	return fs
+}
+
+// evalExistingPrefix follows symlinks in the longest existing prefix of path, so
+// that files which do not exist yet can still be checked against the roots.
+func evalExistingPrefix(path string) string {
+	if real, err := filepath.EvalSymlinks(path); err == nil {
+		return real
+	}
+	parent := filepath.Dir(path)
+	if parent == path {
+		return path
+	}
+	return filepath.Join(evalExistingPrefix(parent), filepath.Base(path))
+}
+
+func (fs *FileSandbox) allowed(path string) bool {
+	for _, root := range fs.Roots {
+		rel, err := filepath.Rel(root, path)
+		if err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			return true
+		}
+	}
+	return false
+}
+
+// Resolve returns the absolute path for path, or an error if it leaves the roots.
+func (fs *FileSandbox) Resolve(path string) (string, error) {
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(fs.BaseDir, path)
+	}
+	real := evalExistingPrefix(filepath.Clean(path))
+	if !fs.allowed(real) {
+		return "", fmt.Errorf("%s: outside of the allowed directories", path)
+	}
+	return real, nil
+}
+
+// Glob returns the files matching pattern inside the roots. Matches of a relative
+// pattern are relative to BaseDir, so they can be passed to the other functions.
+func (fs *FileSandbox) Glob(pattern string) ([]string, error) {
+	abs := pattern
+	if !filepath.IsAbs(abs) {
+		abs = filepath.Join(fs.BaseDir, abs)
+	}
+	matches, err := filepath.Glob(abs)
+	if err != nil {
+		return nil, err
+	}
+
+	result := make([]string, 0, len(matches))
+	for _, match := range matches {
+		if _, err := fs.Resolve(match); err != nil {
+			continue
+		}
+		if !filepath.IsAbs(pattern) {
+			if rel, err := filepath.Rel(fs.BaseDir, match); err == nil {
+				match = rel
+			}
+		}
+		result = append(result, filepath.ToSlash(match))
+	}
+	return result, nil
+}
+
+// ReadFile reads a whole file inside the sandbox.
+func (fs *FileSandbox) ReadFile(path string) (string, error) {
+	real, err := fs.Resolve(path)
+	if err != nil {
+		return "", err
+	}
+	data, err := os.ReadFile(real)
+	return string(data), err
+}
+
+// WriteFile replaces or, with appendData, extends a file inside the sandbox.
+func (fs *FileSandbox) WriteFile(path string, data string, appendData bool) error {
+	real, err := fs.Resolve(path)
+	if err != nil {
+		return err
+	}
+	flags := os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+	if appendData {
+		flags = os.O_WRONLY | os.O_CREATE | os.O_APPEND
+	}
+	f, err := os.OpenFile(real, flags, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := f.WriteString(data); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// Exists reports whether path names an existing file or directory in the sandbox.
+func (fs *FileSandbox) Exists(path string) bool {
+	real, err := fs.Resolve(path)
+	if err != nil {
+		return false
+	}
+	_, err = os.Stat(real)
+	return err == nil
+}
+
+// ListDir returns the sorted entry names of a directory in the sandbox.
+func (fs *FileSandbox) ListDir(path string) ([]string, error) {
+	real, err := fs.Resolve(path)
+	if err != nil {
+		return nil, err
+	}
+	entries, err := os.ReadDir(real)
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		names = append(names, entry.Name())
+	}
+	return names, nil
+}
+
+// OutputFile is the content a template sent to a named output file.
+type OutputFile struct {
+	Name    string
+	Content string
+}
 
 type RuntimeIO struct {
 	buffer []string
 	writer io.Writer // New field to write to
+
+	// target is the output file that receives writes; "" is the main output.
+	target    string
+	files     map[string]*[]string
+	fileOrder []string
+
+	// diversion collects output instead of the target while it is not "";
+	// like in M4, "0" is the normal output and negative numbers discard.
+	diversion  string
+	diversions map[string]*[]string
+	discarded  []string
+
+	// captures are the nested buffers of running capture forms, innermost last.
+	captures [][]string
 }
 
 func NewIO() RuntimeIO {
 	return RuntimeIO{
 		buffer: make([]string, 0),
 		writer: nil, // Default to nil, meaning no direct output
+		files:  make(map[string]*[]string),
+
+		diversions: make(map[string]*[]string),
 	}
 }
 
 // NewIOWithWriter creates a RuntimeIO that writes to the given writer.
 func NewIOWithWriter(w io.Writer) RuntimeIO {
-	return RuntimeIO{
-		buffer: make([]string, 0),
-		writer: w,
-	}
+	rio := NewIO()
+	rio.writer = w
+	return rio
 }
 
-func (io *RuntimeIO) WriteObjectToStream(data VMDataObject) {
+// outputString renders a value the way it appears in template output.
+func outputString(data VMDataObject) string {
 	switch data.Type {
 	case STRING:
-		io.buffer = append(io.buffer, data.StringData)
+		return data.StringData
 	case INTGER:
-		io.buffer = append(io.buffer, strconv.FormatInt(data.IntData, 10))
+		return strconv.FormatInt(data.IntData, 10)
 	case REAL:
-		io.buffer = append(io.buffer, strconv.FormatFloat(data.FloatData, 'f', -1, 64))
+		return strconv.FormatFloat(data.FloatData, 'f', -1, 64)
 	case BOOLEAN:
-		var d string
 		if data.BoolData {
-			d = "!t"
-		} else {
-			d = "!f"
+			return "!t"
 		}
+		return "!f"
+	}
+	return ""
+}
+
+// ValidOutputName reports whether name can be used as an output file: a
+// relative path below the output directory, not the directory itself.
+func ValidOutputName(name string) bool {
+	path := filepath.FromSlash(name)
+	return filepath.IsLocal(path) && filepath.Clean(path) != "."
+}
+
+// SetTarget sends further output to the named file, or back to the main output
+// for "". Writing to a file that was used before continues it.
+func (io *RuntimeIO) SetTarget(name string) {
+	if name != "" {
+		name = filepath.ToSlash(filepath.Clean(filepath.FromSlash(name)))
+		if _, ok := io.files[name]; !ok {
+			io.files[name] = new([]string)
+			io.fileOrder = append(io.fileOrder, name)
+		}
+	}
+	io.target = name
+}
+
+// Target returns the name of the current output file, "" for the main output.
+func (io *RuntimeIO) Target() string {
+	return io.target
+}
+
+// diversionName returns the name diversion functions use for name: numbers in
+// their plain decimal form, and "" for the normal output, which "0" selects.
+func diversionName(name string) string {
+	n, err := strconv.ParseInt(name, 10, 64)
+	switch {
+	case err != nil:
+		return name
+	case n == 0:
+		return ""
+	}
+	return strconv.FormatInt(n, 10)
+}
+
+// isDiscardDiversion reports whether name is a negative number.
+func isDiscardDiversion(name string) bool {
+	n, err := strconv.ParseInt(name, 10, 64)
+	return err == nil && n < 0
+}
+
+// Divert sends further output to the named diversion; "0" (or "") returns to
+// the current target and a negative number throws output away.
+func (io *RuntimeIO) Divert(name string) {
+	name = diversionName(name)
+	if name != "" && !isDiscardDiversion(name) {
+		if _, ok := io.diversions[name]; !ok {
+			io.diversions[name] = new([]string)
+		}
+	}
+	io.diversion = name
+}
+
+// Undivert inserts the content of a diversion at the current point and empties
+// it. Undiverting the active diversion into itself does nothing.
+func (io *RuntimeIO) Undivert(name string) {
+	name = diversionName(name)
+	div, ok := io.diversions[name]
+	if !ok || name == io.diversion {
+		return
+	}
+	content := *div
+	*div = make([]string, 0)
+	sink := io.sink()
+	*sink = append(*sink, content...)
+}
 
-		io.buffer = append(io.buffer, d)
+// DiscardDiversion empties a diversion without inserting it.
+func (io *RuntimeIO) DiscardDiversion(name string) {
+	name = diversionName(name)
+	if div, ok := io.diversions[name]; ok {
+		*div = make([]string, 0)
 	}
+}
 
+// diversionNames orders diversions like M4: numbers ascending, then names.
+func (io *RuntimeIO) diversionNames() []string {
+	names := make([]string, 0, len(io.diversions))
+	for name := range io.diversions {
+		names = append(names, name)
+	}
+	sort.Slice(names, func(i, j int) bool {
+		a, errA := strconv.ParseInt(names[i], 10, 64)
+		b, errB := strconv.ParseInt(names[j], 10, 64)
+		switch {
+		case errA == nil && errB == nil:
+			return a < b
+		case errA == nil || errB == nil:
+			return errA == nil
+		}
+		return names[i] < names[j]
+	})
+	return names
+}
+
+// UndivertAll appends every remaining diversion to the main output, as M4 does
+// when input ends, and makes the normal output active again.
+func (io *RuntimeIO) UndivertAll() {
+	io.diversion = ""
+	for _, name := range io.diversionNames() {
+		div := io.diversions[name]
+		io.buffer = append(io.buffer, *div...)
+		*div = make([]string, 0)
+	}
+}
+
+// BeginCapture starts collecting output in a new nested buffer.
+func (io *RuntimeIO) BeginCapture() {
+	io.captures = append(io.captures, make([]string, 0))
+}
+
+// EndCapture stops the innermost capture and returns the text it collected.
+func (io *RuntimeIO) EndCapture() string {
+	if len(io.captures) == 0 {
+		panic("EndCapture: no capture is active")
+	}
+	last := len(io.captures) - 1
+	captured := strings.Join(io.captures[last], "")
+	io.captures = io.captures[:last]
+	return captured
+}
+
+// EndAllCaptures closes captures left open by a halted run, passing their
+// text on to the output below them.
+func (io *RuntimeIO) EndAllCaptures() {
+	for len(io.captures) > 0 {
+		captured := io.EndCapture()
+		sink := io.sink()
+		*sink = append(*sink, captured)
+	}
+}
+
+func (io *RuntimeIO) sink() *[]string {
+	if len(io.captures) > 0 {
+		return &io.captures[len(io.captures)-1]
+	}
+	if io.diversion != "" {
+		if isDiscardDiversion(io.diversion) {
+			io.discarded = io.discarded[:0]
+			return &io.discarded
+		}
+		return io.diversions[io.diversion]
+	}
+	if io.target != "" {
+		return io.files[io.target]
+	}
+	return &io.buffer
+}
+
+func (io *RuntimeIO) WriteObjectToStream(data VMDataObject) {
+	switch data.Type {
+	case STRING, INTGER, REAL, BOOLEAN:
+		sink := io.sink()
+		*sink = append(*sink, outputString(data))
+	}
 }
 
 func (io *RuntimeIO) FlushIO() {
@@ -62,3 +391,29 @@ func (io *RuntimeIO) FlushIO() {
 func (io *RuntimeIO) ReadBuffer() string {
 	return strings.Join(io.buffer, "")
 }
+
+// Files returns the output files in the order they were first selected.
+func (io *RuntimeIO) Files() []OutputFile {
+	files := make([]OutputFile, 0, len(io.fileOrder))
+	for _, name := range io.fileOrder {
+		files = append(files, OutputFile{Name: name, Content: strings.Join(*io.files[name], "")})
+	}
+	return files
+}
+
+// WriteFiles writes every output file below dir, creating directories as
+// needed, and returns the paths written.
+func (io *RuntimeIO) WriteFiles(dir string) ([]string, error) {
+	written := make([]string, 0, len(io.fileOrder))
+	for _, file := range io.Files() {
+		path := filepath.Join(dir, filepath.FromSlash(file.Name))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			return written, err
+		}
+		if err := os.WriteFile(path, []byte(file.Content), 0644); err != nil {
+			return written, err
+		}
+		written = append(written, path)
+	}
+	return written, nil
+}
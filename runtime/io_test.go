@@ -0,0 +1,214 @@
+package runtime
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestFileSandboxResolve(t *testing.T) {
+	dir, err := filepath.EvalSymlinks(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	base := filepath.Join(dir, "templates")
+	outside := filepath.Join(dir, "outside")
+	for _, d := range []string{filepath.Join(base, "sub"), outside} {
+		if err := os.MkdirAll(d, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.WriteFile(filepath.Join(outside, "secret.txt"), []byte("secret"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	links := map[string]string{
+		"out":       outside,
+		"secret":    filepath.Join(outside, "secret.txt"),
+		"sub/inner": filepath.Join(base, "sub"),
+	}
+	for link, target := range links {
+		if err := os.Symlink(target, filepath.Join(base, filepath.FromSlash(link))); err != nil {
+			t.Skipf("symlinks not supported: %v", err)
+		}
+	}
+
+	fs := NewFileSandbox(base, nil)
+	tests := []struct {
+		path string
+		want string // empty when the path must be rejected
+	}{
+		{"data.json", filepath.Join(base, "data.json")},
+		{"sub/new/file.txt", filepath.Join(base, "sub", "new", "file.txt")},
+		{"sub/../data.json", filepath.Join(base, "data.json")},
+		{".", base},
+		{filepath.Join(base, "sub"), filepath.Join(base, "sub")},
+		{"sub/inner/x.txt", filepath.Join(base, "sub", "x.txt")},
+
+		{"..", ""},
+		{"../outside/secret.txt", ""},
+		{"sub/../../outside", ""},
+		{"../templates-other/x", ""},
+		{outside, ""},
+		{"out/secret.txt", ""},
+		{"out/new.txt", ""},
+		{"secret", ""},
+		{"/", ""},
+	}
+
+	for _, test := range tests {
+		got, err := fs.Resolve(test.path)
+		if test.want == "" {
+			if err == nil {
+				t.Errorf("Resolve(%q) = %q, want an error", test.path, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Resolve(%q): unexpected error %v", test.path, err)
+			continue
+		}
+		if got != test.want {
+			t.Errorf("Resolve(%q) = %q, want %q", test.path, got, test.want)
+		}
+	}
+}
+
+func TestFileSandboxRoots(t *testing.T) {
+	dir, err := filepath.EvalSymlinks(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	base := filepath.Join(dir, "templates")
+	shared := filepath.Join(dir, "shared")
+
+	fs := NewFileSandbox(base, []string{base, shared})
+	if _, err := fs.Resolve("../shared/lib.txt"); err != nil {
+		t.Errorf("a path in a second root was rejected: %v", err)
+	}
+	if _, err := fs.Resolve("../other/lib.txt"); err == nil {
+		t.Errorf("a path outside every root was accepted")
+	}
+}
+
+func TestDiversionNames(t *testing.T) {
+	tests := []struct {
+		name   string
+		divert func(io *RuntimeIO)
+		want   string
+	}{
+		{"zero is the normal output", func(io *RuntimeIO) {
+			io.Divert("0")
+			io.WriteObjectToStream(VMDataObject{Type: STRING, StringData: "a"})
+			io.Undivert("0")
+			io.DiscardDiversion("0")
+		}, "a"},
+		{"numbers in any spelling", func(io *RuntimeIO) {
+			io.Divert("01")
+			io.WriteObjectToStream(VMDataObject{Type: STRING, StringData: "later"})
+			io.Divert("+0")
+			io.WriteObjectToStream(VMDataObject{Type: STRING, StringData: "now "})
+			io.Undivert("1")
+		}, "now later"},
+		{"discard by number", func(io *RuntimeIO) {
+			io.Divert("2")
+			io.WriteObjectToStream(VMDataObject{Type: STRING, StringData: "gone"})
+			io.Divert("0")
+			io.DiscardDiversion("02")
+			io.Undivert("2")
+		}, ""},
+		{"names are kept", func(io *RuntimeIO) {
+			io.Divert("toc")
+			io.WriteObjectToStream(VMDataObject{Type: STRING, StringData: "toc"})
+			io.Divert("")
+			io.Undivert("toc")
+		}, "toc"},
+	}
+
+	for _, test := range tests {
+		io := NewIO()
+		test.divert(&io)
+		io.UndivertAll()
+		if got := io.ReadBuffer(); got != test.want {
+			t.Errorf("%s: output %q, want %q", test.name, got, test.want)
+		}
+	}
+}
+
+func TestOutputTargets(t *testing.T) {
+	vm, err := runVM("a@output(`x.txt`)b@output(`sub/y.txt`)c@output(``)d@output(`x.txt`)e@output(`./sub//y.txt`)f")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got := vm.IO.ReadBuffer(); got != "ad" {
+		t.Errorf("main output %q, want %q", got, "ad")
+	}
+	if got := vm.IO.Target(); got != "sub/y.txt" {
+		t.Errorf("target %q after the run, want %q", got, "sub/y.txt")
+	}
+	want := []OutputFile{{Name: "x.txt", Content: "be"}, {Name: "sub/y.txt", Content: "cf"}}
+	if got := vm.IO.Files(); !reflect.DeepEqual(got, want) {
+		t.Errorf("files %+v, want %+v", got, want)
+	}
+}
+
+func TestValidOutputName(t *testing.T) {
+	tests := []struct {
+		name string
+		want bool
+	}{
+		{"a.txt", true},
+		{"sub/dir/a.txt", true},
+		{"sub/../a.txt", true},
+		{"", false},
+		{".", false},
+		{"sub/..", false},
+		{"..", false},
+		{"../x", false},
+		{"sub/../../x", false},
+		{"/etc/passwd", false},
+		{filepath.Join(os.TempDir(), "x"), false},
+	}
+
+	for _, test := range tests {
+		if got := ValidOutputName(test.name); got != test.want {
+			t.Errorf("ValidOutputName(%q) = %t, want %t", test.name, got, test.want)
+		}
+	}
+}
+
+func TestOutputRejectsNames(t *testing.T) {
+	for _, name := range []string{"../x", "/tmp/x", "a/../../x"} {
+		_, err := runVM("@output(`" + name + "`)x")
+		want := "SYS_IO_OUTPUT: Output file must be a relative path inside the output directory: " + name
+		if err == nil || err.Error() != want {
+			t.Errorf("%q: error %v, want %q", name, err, want)
+		}
+	}
+}
+
+func TestWriteFiles(t *testing.T) {
+	dir := t.TempDir()
+	io := NewIO()
+	for _, file := range []OutputFile{{"top.txt", "top"}, {"a/b/c.txt", "deep"}, {"a/d.txt", "mid"}} {
+		io.SetTarget(file.Name)
+		io.WriteObjectToStream(VMDataObject{Type: STRING, StringData: file.Content})
+	}
+	io.SetTarget("")
+
+	written, err := io.WriteFiles(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{filepath.Join(dir, "top.txt"), filepath.Join(dir, "a", "b", "c.txt"), filepath.Join(dir, "a", "d.txt")}
+	if !reflect.DeepEqual(written, want) {
+		t.Errorf("written %q, want %q", written, want)
+	}
+	for path, content := range map[string]string{want[0]: "top", want[1]: "deep", want[2]: "mid"} {
+		data, err := os.ReadFile(path)
+		if err != nil || string(data) != content {
+			t.Errorf("%s: %q, %v, want %q", path, data, err, content)
+		}
+	}
+}
@@ -0,0 +1,277 @@
+package runtime
+
+import (
+	"cutter/lexer"
+	"cutter/parser"
+	"fmt"
+	"sort"
+)
+
+// IDs of the lint rules.
+const (
+	LintShadowedParam   = "shadowed-param"
+	LintUndefinedSet    = "undefined-set"
+	LintLoopCondition   = "loop-condition"
+	LintUnusedDefine    = "unused-define"
+	LintIncludeRedefine = "include-redefine"
+)
+
+// LintRule describes a rule of Lint.
+type LintRule struct {
+	ID          string
+	Description string
+}
+
+// LintRules lists every rule of Lint.
+var LintRules = []LintRule{
+	{LintShadowedParam, "a parameter has the name of a variable function, which wins when the parameter is passed on"},
+	{LintUndefinedSet, "set assigns to a name that is neither defined nor a parameter"},
+	{LintLoopCondition, "the condition of a for loop references nothing its body sets"},
+	{LintUnusedDefine, "an object defined in the template is never used"},
+	{LintIncludeRedefine, "an included file defines an object that is also defined elsewhere"},
+}
+
+// LintDiagnostic is a finding of Lint.
+type LintDiagnostic struct {
+	Rule    string
+	Pos     lexer.Position
+	Message string
+}
+
+func (d LintDiagnostic) String() string {
+	return fmt.Sprintf("%s: %s [%s]", d.Pos, d.Message, d.Rule)
+}
+
+// mutators are the standard functions that assign to the object named by
+// their first argument.
+var mutators = map[string]bool{"set": true, "arrmake": true, "arrpush": true, "arrset": true}
+
+type linter struct {
+	c       *Compiler
+	enabled map[string]bool
+	used    map[string]bool
+	found   []LintDiagnostic
+}
+
+// Lint reports code in input that compiles but is likely a mistake, for the
+// rules set in enabled (every rule when enabled is nil), sorted by position.
+// It resolves includes and fills the symbol tables like CompileASTToVMInstr,
+// so it panics on the same include errors and wants a fresh Compiler.
+func (c *Compiler) Lint(input parser.HeadNode, enabled map[string]bool) []LintDiagnostic {
+	l := &linter{c: c, enabled: enabled, used: make(map[string]bool)}
+
+	// The template's own definitions; every other one comes from an include.
+	own := make([]parser.FunctionObject, 0)
+	isOwn := make(map[lexer.Position]bool)
+	for _, item := range input.Bodys {
+		if item.Type == parser.FUCNTION_DEFINITION {
+			own = append(own, item.Func)
+			isOwn[item.Func.Pos] = true
+		}
+	}
+
+	bodys := c.ExpandIncludes(input).Bodys
+
+	definitions := make(map[string][]parser.FunctionObject)
+	for _, item := range bodys {
+		if item.Type == parser.FUCNTION_DEFINITION {
+			definitions[item.Func.Name] = append(definitions[item.Func.Name], item.Func)
+		}
+	}
+	for _, item := range bodys {
+		if item.Type != parser.FUCNTION_DEFINITION || isOwn[item.Func.Pos] {
+			continue
+		}
+		for _, other := range definitions[item.Func.Name] {
+			if other.Pos != item.Func.Pos {
+				l.report(LintIncludeRedefine, item.Func.Pos, "'%s' is also defined at %s", item.Func.Name, other.Pos)
+				break
+			}
+		}
+	}
+
+	c.gatherDefinitions(bodys)
+
+	for _, item := range bodys {
+		switch item.Type {
+		case parser.FUCNTION_DEFINITION:
+			fnc := item.Func
+			if _, isUserFunc := c.funcInfo[fnc.Name]; !isUserFunc {
+				continue
+			}
+			for _, param := range fnc.Parameters {
+				if _, isVarFunc := c.variableFuncs[param]; isVarFunc {
+					l.report(LintShadowedParam, fnc.Pos, "parameter '%s' of '%s' has the name of a variable", param, fnc.Name)
+				}
+			}
+			l.walkCall(fnc.Body, fnc.Parameters)
+		case parser.FUNCTION_CALL:
+			if item.Call.Name != "include" {
+				l.walkCall(item.Call, nil)
+			}
+		}
+	}
+
+	for _, fnc := range own {
+		if !l.used[fnc.Name] && !c.predefined[fnc.Name] {
+			l.report(LintUnusedDefine, fnc.Pos, "'%s' is defined but never used", fnc.Name)
+		}
+	}
+
+	sort.SliceStable(l.found, func(i, j int) bool {
+		a, b := l.found[i].Pos, l.found[j].Pos
+		if a.File != b.File {
+			return a.File < b.File
+		}
+		if a.Line != b.Line {
+			return a.Line < b.Line
+		}
+		return a.Column < b.Column
+	})
+	return l.found
+}
+
+func (l *linter) report(rule string, pos lexer.Position, format string, args ...interface{}) {
+	if l.enabled != nil && !l.enabled[rule] {
+		return
+	}
+	l.found = append(l.found, LintDiagnostic{Rule: rule, Pos: pos, Message: fmt.Sprintf(format, args...)})
+}
+
+// walkCall checks call and the calls nested in it; params are the parameters
+// of the function it belongs to.
+func (l *linter) walkCall(call parser.CallObject, params []string) {
+	if !contains(params, call.Name) {
+		l.used[call.Name] = true
+	}
+
+	switch call.Name {
+	case "set":
+		if len(call.Arguments) > 0 && call.Arguments[0].Type == parser.ARG_VARIABLE {
+			arg := call.Arguments[0]
+			_, isVarFunc := l.c.variableFuncs[arg.VarName]
+			if !isVarFunc && !contains(params, arg.VarName) {
+				pos := arg.Pos
+				if !pos.IsValid() {
+					pos = call.Pos
+				}
+				l.report(LintUndefinedSet, pos, "'set' of undefined object '%s'", arg.VarName)
+			}
+		}
+	case "for":
+		if len(call.Arguments) == 2 {
+			l.checkLoop(call)
+		}
+	}
+
+	for _, arg := range call.Arguments {
+		switch arg.Type {
+		case parser.ARG_VARIABLE:
+			if !contains(params, arg.VarName) {
+				l.used[arg.VarName] = true
+			}
+		case parser.ARG_LITERAL:
+			// Objects can be named by strings, as in get(`name`).
+			if arg.Literal.Type == parser.STRING {
+				l.used[arg.Literal.StringData] = true
+			}
+		case parser.ARG_CALLABLE:
+			l.walkCall(arg.Callable, params)
+		}
+	}
+}
+
+// checkLoop reports a for loop whose condition can not change, unless its
+// body exits.
+func (l *linter) checkLoop(call parser.CallObject) {
+	referenced := make(map[string]bool)
+	l.references(call.Arguments[0], referenced, make(map[string]bool))
+
+	mutated := make(map[string]bool)
+	if l.mutations(call.Arguments[1], mutated, make(map[string]bool)) {
+		return
+	}
+
+	for name := range referenced {
+		if mutated[name] {
+			return
+		}
+	}
+	l.report(LintLoopCondition, call.Pos, "condition of 'for' references no object set in its body")
+}
+
+// references adds the names arg reads to names, following the bodies of the
+// functions it calls.
+func (l *linter) references(arg parser.Argument, names map[string]bool, visited map[string]bool) {
+	switch arg.Type {
+	case parser.ARG_LITERAL:
+		if arg.Literal.Type == parser.STRING {
+			names[arg.Literal.StringData] = true
+		}
+	case parser.ARG_VARIABLE:
+		names[arg.VarName] = true
+		l.referencesIn(arg.VarName, names, visited)
+	case parser.ARG_CALLABLE:
+		names[arg.Callable.Name] = true
+		for _, sub := range arg.Callable.Arguments {
+			l.references(sub, names, visited)
+		}
+		l.referencesIn(arg.Callable.Name, names, visited)
+	}
+}
+
+func (l *linter) referencesIn(name string, names map[string]bool, visited map[string]bool) {
+	fnc, isUserFunc := l.c.funcInfo[name]
+	if !isUserFunc || visited[name] {
+		return
+	}
+	visited[name] = true
+	l.references(parser.Argument{Type: parser.ARG_CALLABLE, Callable: fnc.Body}, names, visited)
+}
+
+// mutations adds the names arg assigns to names, following the bodies of the
+// functions it calls, and reports whether it calls exit.
+func (l *linter) mutations(arg parser.Argument, names map[string]bool, visited map[string]bool) bool {
+	var name string
+	switch arg.Type {
+	case parser.ARG_VARIABLE:
+		name = arg.VarName
+	case parser.ARG_CALLABLE:
+		call := arg.Callable
+		name = call.Name
+		if call.Name == "exit" {
+			return true
+		}
+		if mutators[call.Name] && len(call.Arguments) > 0 {
+			switch target := call.Arguments[0]; {
+			case target.Type == parser.ARG_VARIABLE:
+				names[target.VarName] = true
+			case target.Type == parser.ARG_LITERAL && target.Literal.Type == parser.STRING:
+				names[target.Literal.StringData] = true
+			}
+		}
+		for _, sub := range call.Arguments {
+			if l.mutations(sub, names, visited) {
+				return true
+			}
+		}
+	default:
+		return false
+	}
+
+	fnc, isUserFunc := l.c.funcInfo[name]
+	if !isUserFunc || visited[name] {
+		return false
+	}
+	visited[name] = true
+	return l.mutations(parser.Argument{Type: parser.ARG_CALLABLE, Callable: fnc.Body}, names, visited)
+}
+
+func contains(names []string, name string) bool {
+	for _, n := range names {
+		if n == name {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,129 @@
+package runtime
+
+import (
+	"cutter/lexer"
+	"cutter/parser"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// lint lints the template file in dir with source and returns its findings
+// as strings, with dir left out of the positions.
+func lint(t *testing.T, dir string, file string, source string, enabled map[string]bool) []string {
+	t.Helper()
+	path := filepath.Join(dir, file)
+	head := parser.NewParser().DoParse(lexer.NewLexerWithFile(path).DoLex(source))
+
+	found := make([]string, 0)
+	for _, diagnostic := range NewCompiler().Lint(head, enabled) {
+		found = append(found, strings.ReplaceAll(diagnostic.String(), dir+string(filepath.Separator), ""))
+	}
+	return found
+}
+
+func writeFiles(t *testing.T, dir string, files map[string]string) {
+	t.Helper()
+	for name, content := range files {
+		path := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestLintRules(t *testing.T) {
+	tests := []struct {
+		name   string
+		source string
+		want   []string
+	}{
+		{"clean", "@define(g 1)@echo(g)", nil},
+		{LintShadowedParam, "@define(x 1)@define(f x echo(x))@f(2)@echo(x)",
+			[]string{"t.cm:1:13: parameter 'x' of 'f' has the name of a variable [shadowed-param]"}},
+		{LintUndefinedSet, "@set(y 1)",
+			[]string{"t.cm:1:6: 'set' of undefined object 'y' [undefined-set]"}},
+		{"set of a parameter", "@define(f y set(y 1))@f(2)", nil},
+		{LintLoopCondition, "@define(n 1)@for(same(n 1) echo(n))",
+			[]string{"t.cm:1:14: condition of 'for' references no object set in its body [loop-condition]"}},
+		{"loop that sets its condition", "@define(n 1)@for(same(n 1) set(n 2))", nil},
+		{"loop that sets it in a function", "@define(n 1)@define(step set(`n` 2))@for(same(n 1) step())", nil},
+		{"loop that exits", "@define(n 1)@for(same(n 1) exit())", nil},
+		{LintUnusedDefine, "@define(unused 1)@define(used 2)@echo(used)",
+			[]string{"t.cm:1:1: 'unused' is defined but never used [unused-define]"}},
+		{"used by name", "@define(named 1)@echo(get(`named`))", nil},
+	}
+
+	for _, test := range tests {
+		got := lint(t, t.TempDir(), "t.cm", test.source, nil)
+		if strings.Join(got, "\n") != strings.Join(test.want, "\n") {
+			t.Errorf("%s: got %q, want %q", test.name, got, test.want)
+		}
+	}
+}
+
+func TestLintIncludeRedefine(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{
+		"lib.cm":       "@define(a 1)\n@define(b 2)",
+		"other.cm":     "@define(b 3)",
+		"sub/inner.cm": "@include(`../lib.cm`)",
+	})
+
+	tests := []struct {
+		name   string
+		source string
+		want   []string
+	}{
+		{"template and include", "@define(a 3)@include(`lib.cm`)@echo(a b)",
+			[]string{"lib.cm:1:1: 'a' is also defined at t.cm:1:1 [include-redefine]"}},
+		{"two includes", "@include(`lib.cm`)@include(`other.cm`)@echo(a b)",
+			[]string{
+				"lib.cm:2:1: 'b' is also defined at other.cm:1:1 [include-redefine]",
+				"other.cm:1:1: 'b' is also defined at lib.cm:2:1 [include-redefine]",
+			}},
+		{"nested include", "@define(a 3)@include(`sub/inner.cm`)@echo(a b)",
+			[]string{"lib.cm:1:1: 'a' is also defined at t.cm:1:1 [include-redefine]"}},
+		// Definitions of an include are not reported as unused.
+		{"unused in an include", "@include(`lib.cm`)", nil},
+	}
+
+	for _, test := range tests {
+		got := lint(t, dir, "t.cm", test.source, nil)
+		if strings.Join(got, "\n") != strings.Join(test.want, "\n") {
+			t.Errorf("%s: got %q, want %q", test.name, got, test.want)
+		}
+	}
+}
+
+func TestLintEnabledRules(t *testing.T) {
+	source := "@define(unused 1)@set(y 1)@define(n 1)@for(same(n 1) echo(n))"
+	all := lint(t, t.TempDir(), "t.cm", source, nil)
+	if len(all) != 3 {
+		t.Fatalf("got %q, want three findings", all)
+	}
+
+	for _, rule := range []string{LintUndefinedSet, LintLoopCondition, LintUnusedDefine} {
+		enabled := make(map[string]bool)
+		for _, r := range LintRules {
+			enabled[r.ID] = r.ID != rule
+		}
+		got := lint(t, t.TempDir(), "t.cm", source, enabled)
+		if len(got) != 2 {
+			t.Errorf("without %s: got %q, want two findings", rule, got)
+		}
+		for _, finding := range got {
+			if strings.HasSuffix(finding, "["+rule+"]") {
+				t.Errorf("without %s: got %q", rule, finding)
+			}
+		}
+	}
+
+	if got := lint(t, t.TempDir(), "t.cm", source, map[string]bool{}); len(got) != 0 {
+		t.Errorf("with no rules: got %q", got)
+	}
+}
@@ -91,6 +91,11 @@ func GetStandardFuncs() map[string][]VMInstr {
 		{Op: OpSyscall, Oprand1: makeIntValueObj(SYS_MEM_SET)},
 	}
 
+	StandardFuncs["get"] = []VMInstr{
+		// Reg 0: object name (string), e.g. a dotted path of loaded data
+		{Op: OpSyscall, Oprand1: makeIntValueObj(SYS_MEM_GET)},
+	}
+
 	StandardFuncs["echo"] = []VMInstr{
 		{Op: OpStr, Oprand1: makeStrValueObj("stdout"), Oprand2: makeIntValueObj(int64(0))},
 		{Op: OpSyscall, Oprand1: makeIntValueObj(SYS_IO_FLUSH)},
@@ -99,8 +104,22 @@ func GetStandardFuncs() map[string][]VMInstr {
 	}
 
 	// System Functions
+	StandardFuncs["output"] = []VMInstr{
+		{Op: OpSyscall, Oprand1: makeIntValueObj(SYS_IO_OUTPUT)},
+	}
+	StandardFuncs["divert"] = []VMInstr{
+		{Op: OpSyscall, Oprand1: makeIntValueObj(SYS_IO_DIVERT)},
+	}
+	StandardFuncs["undivert"] = []VMInstr{
+		{Op: OpSyscall, Oprand1: makeIntValueObj(SYS_IO_UNDIVERT)},
+	}
+	StandardFuncs["divdiscard"] = []VMInstr{
+		{Op: OpSyscall, Oprand1: makeIntValueObj(SYS_IO_DISCARD)},
+	}
 	StandardFuncs["exit"] = []VMInstr{
+		// Reg 0: exit status (the compiler passes 0 when exit is called without arguments)
 		{Op: OpSyscall, Oprand1: makeIntValueObj(SYS_IO_FLUSH)},
+		{Op: OpSyscall, Oprand1: makeIntValueObj(SYS_EXIT)},
 		{Op: OpHlt}, // Stop execution
 	}
 
@@ -131,6 +150,42 @@ func GetStandardFuncs() map[string][]VMInstr {
 		{Op: OpSyscall, Oprand1: makeIntValueObj(SYS_GET_OS_TYPE)}, // SYS_GET
 	}
 
+	// Data Functions
+	StandardFuncs["jsonload"] = []VMInstr{
+		{Op: OpSyscall, Oprand1: makeIntValueObj(SYS_JSON_LOAD)},
+	}
+	StandardFuncs["csvload"] = []VMInstr{
+		// Default options: delimiter chosen by extension, header row, quoting
+		{Op: OpRegSet, Oprand1: makeIntValueObj(2), Oprand2: makeStrValueObj("")},
+		{Op: OpRegSet, Oprand1: makeIntValueObj(3), Oprand2: makeBoolValueObj(true)},
+		{Op: OpRegSet, Oprand1: makeIntValueObj(4), Oprand2: makeBoolValueObj(true)},
+		{Op: OpSyscall, Oprand1: makeIntValueObj(SYS_CSV_LOAD)},
+	}
+	StandardFuncs["csvloadopt"] = []VMInstr{
+		// Reg 2: delimiter, Reg 3: header row (bool), Reg 4: quoting (bool)
+		{Op: OpSyscall, Oprand1: makeIntValueObj(SYS_CSV_LOAD)},
+	}
+
+	// File Functions
+	StandardFuncs["fileread"] = []VMInstr{
+		{Op: OpSyscall, Oprand1: makeIntValueObj(SYS_FILE_READ)},
+	}
+	StandardFuncs["filewrite"] = []VMInstr{
+		{Op: OpSyscall, Oprand1: makeIntValueObj(SYS_FILE_WRITE)},
+	}
+	StandardFuncs["fileappend"] = []VMInstr{
+		{Op: OpSyscall, Oprand1: makeIntValueObj(SYS_FILE_APPEND)},
+	}
+	StandardFuncs["fileexists"] = []VMInstr{
+		{Op: OpSyscall, Oprand1: makeIntValueObj(SYS_FILE_EXISTS)},
+	}
+	StandardFuncs["filelist"] = []VMInstr{
+		{Op: OpSyscall, Oprand1: makeIntValueObj(SYS_FILE_LIST)},
+	}
+	StandardFuncs["fileglob"] = []VMInstr{
+		{Op: OpSyscall, Oprand1: makeIntValueObj(SYS_FILE_GLOB)},
+	}
+
 	// Conversion Functions
 	StandardFuncs["convint"] = []VMInstr{
 		{Op: OpCstInt, Oprand1: makeIntValueObj(0)},
@@ -1,5 +1,7 @@
 package runtime
 
+import "cutter/parser"
+
 type VM struct {
 	Stack   *CallStack
 	Program []VMInstr
@@ -7,8 +9,22 @@ type VM struct {
 	Mem     VMMEMObjectTable
 	IO      RuntimeIO
 
+	// Files confines the file functions; by default to the working directory.
+	Files *FileSandbox
+
+	// Coverage is nil unless EnableCoverage has been called.
+	Coverage *CoverageCounter
+
+	// Halted is set once OpHlt runs; ExitCode is the status requested by exit.
+	Halted   bool
+	ExitCode int
+
 	PC int
 
+	// captureRegs saves the registers of the calls around each running capture,
+	// since its body may clear them (echo does).
+	captureRegs []VMArgumentRegisters
+
 	isFuncDefineState bool
 }
 
@@ -17,8 +33,9 @@ func NewVM(input []VMInstr) *VM {
 		Stack:   NewCallStack(),
 		Program: input,
 		Reg:     NewRegister(), Mem: NewVMMEMObjTable(),
-		IO: NewIO(),
-		PC: 0,
+		IO:    NewIO(),
+		Files: NewFileSandbox(".", nil),
+		PC:    0,
 
 		isFuncDefineState: false,
 	}
@@ -35,13 +52,54 @@ func NewVM(input []VMInstr) *VM {
 	return vm
 }
 
+// DefineObject stores a value in data memory before the program runs.
+func (vm *VM) DefineObject(name string, value parser.ValueObject) {
+	if !vm.Mem.HasObj(name) {
+		vm.Mem.MakeObj(name)
+	}
+	vm.Mem.SetObj(name, transformToVMDataObject(value))
+}
+
 func (vm *VM) Run() {
 	vm.Mem.MakeObj("stdout")
 
 	vm.PC = 0
+	vm.execute()
+	vm.IO.EndAllCaptures()
+	vm.IO.UndivertAll()
+}
+
+// ResetCaptures forgets the register snapshots of captures a failed run left open.
+func (vm *VM) ResetCaptures() {
+	vm.captureRegs = vm.captureRegs[:0]
+}
+
+// Extend appends instructions to the loaded program and runs only the new part,
+// keeping memory and previously defined functions. It is used to feed a long-lived
+// VM one compiled input at a time.
+func (vm *VM) Extend(instrs []VMInstr) {
+	if !vm.Mem.HasObj("stdout") {
+		vm.Mem.MakeObj("stdout")
+	}
+
+	start := len(vm.Program)
+	vm.Program = append(vm.Program, instrs...)
+	if vm.Coverage != nil {
+		vm.Coverage.Hits = append(vm.Coverage.Hits, make([]int, len(instrs))...)
+	}
+
+	vm.PC = start
+	vm.execute()
+}
+
+func (vm *VM) execute() {
 	for vm.PC < len(vm.Program) {
 		instr := vm.Program[vm.PC]
 
+		if vm.Coverage != nil {
+			vm.Coverage.Hits[vm.PC]++
+		}
+
 		switch instr.Op {
 		case OpDefFunc:
 			funcName := instr.Oprand1.StringData
@@ -60,10 +118,17 @@ func (vm *VM) Run() {
 			funcName := instr.Oprand1.StringData
 			funcObj := vm.Mem.GetFunc(funcName)
 
+			if vm.Coverage != nil {
+				vm.Coverage.Calls[funcName]++
+			}
+
 			if funcObj.IsStandard {
 				// Execute standard function instructions
 				for _, stdInstr := range funcObj.Instructions {
 					vm.executeInstruction(stdInstr)
+					if vm.Halted {
+						return
+					}
 				}
 				// After executing standard function, continue with the next instruction
 				// in the main program.
@@ -219,6 +284,9 @@ func (vm *VM) Run() {
 			if condition.Type != BOOLEAN {
 				panic("Branch condition must be BOOLEAN type")
 			}
+			if vm.Coverage != nil {
+				vm.Coverage.hitBranch(vm.PC, condition.BoolData)
+			}
 
 			if condition.BoolData {
 				vm.Reg.InsertResult(vm.Reg.GetRegister(int(instr.Oprand2.IntData)))
@@ -254,6 +322,7 @@ func (vm *VM) Run() {
 
 		case OpHlt:
 			// Stop execution
+			vm.Halted = true
 			return
 		}
 		vm.PC++
@@ -364,6 +433,9 @@ func (vm *VM) executeInstruction(instr VMInstr) {
 		if condition.Type != BOOLEAN {
 			panic("Branch condition must be BOOLEAN type")
 		}
+		if vm.Coverage != nil {
+			vm.Coverage.hitBranch(vm.PC, condition.BoolData)
+		}
 
 		if condition.BoolData {
 			vm.Reg.InsertResult(vm.Reg.GetRegister(int(instr.Oprand2.IntData)))
@@ -395,7 +467,8 @@ func (vm *VM) executeInstruction(instr VMInstr) {
 		vm.Reg.ClearRegisters()
 
 	case OpHlt:
-		// Stop execution
+		// Stop execution; the Run loop checks Halted after every standard function instruction.
+		vm.Halted = true
 		return
 	}
 }
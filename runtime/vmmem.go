@@ -51,6 +51,24 @@ func (rg *VMArgumentRegisters) ClearRegisters() {
 	rg.register_cleared_count++
 }
 
+// Snapshot copies the argument registers so they can be restored later.
+func (rg *VMArgumentRegisters) Snapshot() VMArgumentRegisters {
+	snap := *rg
+	snap.ArgumentRegisterMemory = append([]VMDataObject(nil), rg.ArgumentRegisterMemory...)
+	snap.ArgumentRegisterMap = make(map[int]int, len(rg.ArgumentRegisterMap))
+	for k, v := range rg.ArgumentRegisterMap {
+		snap.ArgumentRegisterMap[k] = v
+	}
+	return snap
+}
+
+// Restore puts back the argument registers of a snapshot, keeping the current result.
+func (rg *VMArgumentRegisters) Restore(snap VMArgumentRegisters) {
+	result := rg.ReturnValueRegister
+	*rg = snap
+	rg.ReturnValueRegister = result
+}
+
 func (rg *VMArgumentRegisters) InsertRegister(idx int, val VMDataObject) {
 	rg.ArgumentRegisterMap[idx] = rg.last_allocated_area
 	rg.ArgumentRegisterMemory = append(rg.ArgumentRegisterMemory, val)
@@ -1,6 +1,7 @@
 package runtime
 
 import (
+	"cutter/lexer"
 	"strconv"
 )
 
@@ -151,7 +152,7 @@ func (obj *VMDataObject) CastTo(d_type ValueType) VMDataObject {
 			return makeIntValueObj(val)
 
 		default:
-			panic("Object cannot be converted to " + string(d_type))
+			panic("Object cannot be converted to " + strconv.Itoa(int(d_type)))
 
 		}
 
@@ -168,7 +169,7 @@ func (obj *VMDataObject) CastTo(d_type ValueType) VMDataObject {
 			return makeRealValueObj(val)
 
 		default:
-			panic("Object cannot be converted to " + string(d_type))
+			panic("Object cannot be converted to " + strconv.Itoa(int(d_type)))
 
 		}
 
@@ -187,12 +188,12 @@ func (obj *VMDataObject) CastTo(d_type ValueType) VMDataObject {
 			}
 
 		default:
-			panic("Object cannot be converted to " + string(d_type))
+			panic("Object cannot be converted to " + strconv.Itoa(int(d_type)))
 
 		}
 
 	default:
-		panic("Object cannot be converted to " + string(d_type))
+		panic("Object cannot be converted to " + strconv.Itoa(int(d_type)))
 	}
 }
 
@@ -255,4 +256,7 @@ type VMInstr struct {
 	Oprand1 VMDataObject
 	Oprand2 VMDataObject
 	Oprand3 VMDataObject
+
+	// Pos is the source position of the call or text that produced the instruction.
+	Pos lexer.Position
 }
@@ -1,6 +1,7 @@
 package runtime
 
 import (
+	"fmt"
 	"os"
 	"os/exec"
 	"regexp"
@@ -25,8 +26,41 @@ const (
 	SYS_GET_ENV     = 14
 	SYS_EXEC_CMD    = 15
 	SYS_GET_OS_TYPE = 16
+	SYS_EXIT        = 17
+	SYS_MEM_GET     = 18
+	SYS_JSON_LOAD   = 19
+	SYS_CSV_LOAD    = 20
+	SYS_FILE_READ   = 21
+	SYS_FILE_WRITE  = 22
+	SYS_FILE_APPEND = 23
+	SYS_FILE_EXISTS = 24
+	SYS_FILE_LIST   = 25
+	SYS_FILE_GLOB   = 26
+	SYS_IO_OUTPUT   = 27
+	SYS_IO_DIVERT   = 28
+	SYS_IO_UNDIVERT = 29
+	SYS_IO_DISCARD  = 30
+	SYS_IO_CAPTURE  = 31
+	SYS_IO_CAPTURED = 32
 )
 
+// fileSyscallString returns register n as a string argument of a file syscall.
+func fileSyscallString(vm *VM, name string, n int) string {
+	arg := vm.Reg.GetRegister(n)
+	if arg.Type != STRING {
+		panic(fmt.Sprintf("%s: Argument %d must be a string", name, n+1))
+	}
+	return arg.StringData
+}
+
+// fillArray replaces the contents of array arrName with items.
+func fillArray(vm *VM, arrName string, items []string) {
+	vm.Mem.MakeArray(arrName)
+	for _, item := range items {
+		vm.Mem.PushArrayItem(arrName, VMDataObject{Type: STRING, StringData: item})
+	}
+}
+
 func doSyscall(vm *VM, instr VMInstr) {
 	switch instr.Oprand1.IntData {
 	case SYS_MEM_SET:
@@ -58,6 +92,42 @@ func doSyscall(vm *VM, instr VMInstr) {
 		stdout := vm.Mem.GetObj("stdout")
 		vm.IO.WriteObjectToStream(*stdout)
 		vm.Mem.SetObj("stdout", VMDataObject{})
+	case SYS_IO_OUTPUT:
+		name := vm.Reg.GetRegister(0)
+		if name.Type != STRING {
+			panic("SYS_IO_OUTPUT: First argument must be a string (file name)")
+		}
+		if name.StringData != "" && !ValidOutputName(name.StringData) {
+			panic("SYS_IO_OUTPUT: Output file must be a relative path inside the output directory: " + name.StringData)
+		}
+		vm.IO.SetTarget(name.StringData)
+		vm.Reg.InsertResult(VMDataObject{Type: STRING, StringData: ""})
+
+	case SYS_IO_DIVERT, SYS_IO_UNDIVERT, SYS_IO_DISCARD:
+		name := vm.Reg.GetRegister(0)
+		if name.Type != STRING && name.Type != INTGER {
+			panic("SYS_IO_DIVERT: First argument must be a diversion number or name")
+		}
+		switch instr.Oprand1.IntData {
+		case SYS_IO_DIVERT:
+			vm.IO.Divert(outputString(name))
+		case SYS_IO_UNDIVERT:
+			vm.IO.Undivert(outputString(name))
+		case SYS_IO_DISCARD:
+			vm.IO.DiscardDiversion(outputString(name))
+		}
+		vm.Reg.InsertResult(VMDataObject{Type: STRING, StringData: ""})
+
+	case SYS_IO_CAPTURE:
+		vm.captureRegs = append(vm.captureRegs, vm.Reg.Snapshot())
+		vm.IO.BeginCapture()
+
+	case SYS_IO_CAPTURED:
+		last := len(vm.captureRegs) - 1
+		vm.Reg.Restore(vm.captureRegs[last])
+		vm.captureRegs = vm.captureRegs[:last]
+		vm.Reg.InsertResult(VMDataObject{Type: STRING, StringData: vm.IO.EndCapture()})
+
 	case SYS_STR_LEN:
 		str := vm.Reg.GetRegister(0)
 		if str.Type != STRING {
@@ -179,5 +249,127 @@ func doSyscall(vm *VM, instr VMInstr) {
 			osName = "other"
 		}
 		vm.Reg.InsertResult(makeStrValueObj(osName))
+
+	case SYS_EXIT:
+		status := vm.Reg.GetRegister(0)
+		if status.Type != INTGER {
+			panic("SYS_EXIT: First argument must be an integer (exit status)")
+		}
+		vm.ExitCode = int(status.IntData)
+
+	case SYS_MEM_GET:
+		objName := vm.Reg.GetRegister(0)
+		if objName.Type != STRING {
+			panic("SYS_MEM_GET: First argument must be a string (object name)")
+		}
+		if !vm.Mem.HasObj(objName.StringData) {
+			panic("SYS_MEM_GET: Object not found: " + objName.StringData)
+		}
+		vm.Reg.InsertResult(*vm.Mem.GetObj(objName.StringData))
+
+	case SYS_JSON_LOAD:
+		path := vm.Reg.GetRegister(0)
+		prefix := vm.Reg.GetRegister(1)
+		if path.Type != STRING || prefix.Type != STRING {
+			panic("SYS_JSON_LOAD: Invalid arguments")
+		}
+		real, err := vm.Files.Resolve(path.StringData)
+		if err != nil {
+			panic("SYS_JSON_LOAD: " + err.Error())
+		}
+		f, err := os.Open(real)
+		if err != nil {
+			panic("SYS_JSON_LOAD: Error Occur - " + err.Error())
+		}
+		defer f.Close()
+
+		ds := NewDataSet()
+		if err := ds.LoadJSON(f, prefix.StringData); err != nil {
+			panic("SYS_JSON_LOAD: " + path.StringData + ": " + err.Error())
+		}
+		ds.BindTo(vm)
+		vm.Reg.InsertResult(VMDataObject{Type: BOOLEAN, BoolData: true})
+
+	case SYS_CSV_LOAD:
+		path := vm.Reg.GetRegister(0)
+		prefix := vm.Reg.GetRegister(1)
+		delimiter := vm.Reg.GetRegister(2)
+		header := vm.Reg.GetRegister(3)
+		quoted := vm.Reg.GetRegister(4)
+		if path.Type != STRING || prefix.Type != STRING || delimiter.Type != STRING || header.Type != BOOLEAN || quoted.Type != BOOLEAN {
+			panic("SYS_CSV_LOAD: Invalid arguments")
+		}
+
+		opts := DefaultCSVOptions(path.StringData)
+		if delimiter.StringData != "" {
+			delim := []rune(delimiter.StringData)
+			if len(delim) != 1 {
+				panic("SYS_CSV_LOAD: Delimiter must be a single character")
+			}
+			opts.Delimiter = delim[0]
+		}
+		opts.Header = header.BoolData
+		opts.Quoted = quoted.BoolData
+
+		real, err := vm.Files.Resolve(path.StringData)
+		if err != nil {
+			panic("SYS_CSV_LOAD: " + err.Error())
+		}
+		f, err := os.Open(real)
+		if err != nil {
+			panic("SYS_CSV_LOAD: Error Occur - " + err.Error())
+		}
+		defer f.Close()
+
+		ds := NewDataSet()
+		if err := ds.LoadCSV(f, prefix.StringData, opts); err != nil {
+			panic("SYS_CSV_LOAD: " + path.StringData + ": " + err.Error())
+		}
+		ds.BindTo(vm)
+		vm.Reg.InsertResult(VMDataObject{Type: INTGER, IntData: int64(len(vm.Mem.GetArray(prefix.StringData)))})
+
+	case SYS_FILE_READ:
+		path := fileSyscallString(vm, "SYS_FILE_READ", 0)
+		data, err := vm.Files.ReadFile(path)
+		if err != nil {
+			panic("SYS_FILE_READ: " + err.Error())
+		}
+		vm.Reg.InsertResult(VMDataObject{Type: STRING, StringData: data})
+
+	case SYS_FILE_WRITE, SYS_FILE_APPEND:
+		name := "SYS_FILE_WRITE"
+		if instr.Oprand1.IntData == SYS_FILE_APPEND {
+			name = "SYS_FILE_APPEND"
+		}
+		path := fileSyscallString(vm, name, 0)
+		data := outputString(vm.Reg.GetRegister(1))
+		if err := vm.Files.WriteFile(path, data, instr.Oprand1.IntData == SYS_FILE_APPEND); err != nil {
+			panic(name + ": " + err.Error())
+		}
+		vm.Reg.InsertResult(VMDataObject{Type: BOOLEAN, BoolData: true})
+
+	case SYS_FILE_EXISTS:
+		path := fileSyscallString(vm, "SYS_FILE_EXISTS", 0)
+		vm.Reg.InsertResult(VMDataObject{Type: BOOLEAN, BoolData: vm.Files.Exists(path)})
+
+	case SYS_FILE_LIST:
+		path := fileSyscallString(vm, "SYS_FILE_LIST", 0)
+		arrName := fileSyscallString(vm, "SYS_FILE_LIST", 1)
+		names, err := vm.Files.ListDir(path)
+		if err != nil {
+			panic("SYS_FILE_LIST: " + err.Error())
+		}
+		fillArray(vm, arrName, names)
+		vm.Reg.InsertResult(VMDataObject{Type: INTGER, IntData: int64(len(names))})
+
+	case SYS_FILE_GLOB:
+		pattern := fileSyscallString(vm, "SYS_FILE_GLOB", 0)
+		arrName := fileSyscallString(vm, "SYS_FILE_GLOB", 1)
+		matches, err := vm.Files.Glob(pattern)
+		if err != nil {
+			panic("SYS_FILE_GLOB: " + err.Error())
+		}
+		fillArray(vm, arrName, matches)
+		vm.Reg.InsertResult(VMDataObject{Type: INTGER, IntData: int64(len(matches))})
 	}
 }
@@ -0,0 +1,416 @@
+package main
+
+import (
+	"bufio"
+	"cutter/etc"
+	"cutter/lexer"
+	"cutter/runtime"
+	"errors"
+	"flag"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	goldenExtension = ".out"
+	filesExtension  = ".files"
+	exitExtension   = ".exit"
+	envExtension    = ".env"
+	dataExtension   = ".json"
+	csvExtension    = ".csv"
+)
+
+// goldenTest is a template together with its expected output and fixtures:
+// environment variables from a .env file, data bound from a .json file and
+// rows bound from a .csv file under the template's base name. The expected
+// standard output is the .out file, the expected @output files are below the
+// .files directory and a non-zero exit code is expected only when the .exit
+// file holds it.
+type goldenTest struct {
+	Template string
+	Golden   string
+	Files    string
+	Exit     string
+	Env      string
+	Data     string
+	CSV      string
+}
+
+func newGoldenTest(template string) goldenTest {
+	base := strings.TrimSuffix(template, filepath.Ext(template))
+	test := goldenTest{
+		Template: template,
+		Golden:   base + goldenExtension,
+		Files:    base + filesExtension,
+		Exit:     base + exitExtension,
+	}
+	if _, err := os.Stat(base + envExtension); err == nil {
+		test.Env = base + envExtension
+	}
+	if _, err := os.Stat(base + dataExtension); err == nil {
+		test.Data = base + dataExtension
+	}
+	if _, err := os.Stat(base + csvExtension); err == nil {
+		test.CSV = base + csvExtension
+	}
+	return test
+}
+
+// discoverGoldenTests finds templates under the given paths. Templates found by
+// walking a directory are only tests when a golden file sits next to them, so
+// that shared libraries pulled in by @include are skipped.
+func discoverGoldenTests(paths []string) ([]goldenTest, error) {
+	tests := make([]goldenTest, 0)
+
+	for _, path := range paths {
+		info, err := os.Stat(path)
+		if err != nil {
+			return nil, err
+		}
+
+		if !info.IsDir() {
+			tests = append(tests, newGoldenTest(path))
+			continue
+		}
+
+		err = filepath.WalkDir(path, func(p string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			if d.IsDir() && p != path && filepath.Ext(p) == filesExtension {
+				// Expected @output files, not tests.
+				return filepath.SkipDir
+			}
+			if d.IsDir() || filepath.Ext(p) != etc.SourceExtension {
+				return nil
+			}
+			test := newGoldenTest(p)
+			if _, err := os.Stat(test.Golden); err == nil {
+				tests = append(tests, test)
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	sort.Slice(tests, func(i, j int) bool { return tests[i].Template < tests[j].Template })
+	return tests, nil
+}
+
+// loadEnvFixture reads KEY=VALUE lines, ignoring blank lines and # comments.
+func loadEnvFixture(path string) (map[string]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	env := make(map[string]string)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		key, value, ok := strings.Cut(line, "=")
+		if !ok {
+			return nil, fmt.Errorf("%s: expected KEY=VALUE, got %q", path, line)
+		}
+		env[strings.TrimSpace(key)] = value
+	}
+	return env, scanner.Err()
+}
+
+// withEnv sets the given variables while fn runs and restores them afterwards.
+func withEnv(env map[string]string, fn func()) {
+	type saved struct {
+		value string
+		set   bool
+	}
+	previous := make(map[string]saved)
+	for key, value := range env {
+		old, set := os.LookupEnv(key)
+		previous[key] = saved{value: old, set: set}
+		os.Setenv(key, value)
+	}
+	defer func() {
+		for key, old := range previous {
+			if old.set {
+				os.Setenv(key, old.value)
+			} else {
+				os.Unsetenv(key)
+			}
+		}
+	}()
+
+	fn()
+}
+
+// rendering is what a run of a template writes: its standard output as the
+// CLI prints it, the files selected with @output and the exit code.
+type rendering struct {
+	Output   string
+	Files    []runtime.OutputFile
+	ExitCode int
+}
+
+// renderTemplate compiles and runs a template, turning panics from any stage into an error.
+func renderTemplate(source string, fileName string, options lexer.Options, includeDirs []string, data *runtime.DataSet, profile *runtime.CoverageProfile) (result rendering, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("%v", r)
+		}
+	}()
+
+	com := runtime.NewCompiler()
+	com.SetLexerOptions(options)
+	com.SetIncludePath(includeDirs)
+	data.DefineIn(com)
+
+	vm := runtime.NewVM(compileTemplate(com, source, fileName))
+	vm.Files = runtime.NewFileSandbox(templateDir(fileName), nil)
+	data.BindTo(vm)
+	if profile != nil {
+		vm.EnableCoverage()
+	}
+	vm.Run()
+
+	if profile != nil {
+		profile.AddRun(vm)
+	}
+	// The CLI ends the output with a line break.
+	return rendering{Output: vm.IO.ReadBuffer() + "\n", Files: vm.IO.Files(), ExitCode: vm.ExitCode}, nil
+}
+
+func (t goldenTest) run(update bool, options lexer.Options, includeDirs []string, profile *runtime.CoverageProfile) (bool, string) {
+	source, err := etc.ReadFile(t.Template, false)
+	if err != nil {
+		return false, err.Error()
+	}
+
+	env := map[string]string{}
+	if t.Env != "" {
+		env, err = loadEnvFixture(t.Env)
+		if err != nil {
+			return false, err.Error()
+		}
+	}
+
+	data := runtime.NewDataSet()
+	if t.Data != "" {
+		if err := loadDataFile(data, dataSource{Path: t.Data, Format: dataFormatJSON}, csvSettings{}); err != nil {
+			return false, err.Error()
+		}
+	}
+	if t.CSV != "" {
+		if err := loadDataFile(data, dataSource{Path: t.CSV, Format: dataFormatCSV}, csvSettings{}); err != nil {
+			return false, err.Error()
+		}
+	}
+
+	var result rendering
+	withEnv(env, func() {
+		result, err = renderTemplate(source, t.Template, options, includeDirs, data, profile)
+	})
+	if err != nil {
+		return false, err.Error()
+	}
+
+	if update {
+		if err := t.update(result); err != nil {
+			return false, err.Error()
+		}
+		return true, ""
+	}
+
+	var failures strings.Builder
+	if expected, err := t.expectedExitCode(); err != nil {
+		return false, err.Error()
+	} else if result.ExitCode != expected {
+		fmt.Fprintf(&failures, "exit code %d, expected %d\n", result.ExitCode, expected)
+	}
+
+	expected, err := os.ReadFile(t.Golden)
+	if err != nil {
+		return false, err.Error()
+	}
+	failures.WriteString(etc.UnifiedDiff(t.Golden, t.Template, string(expected), result.Output))
+
+	expectedFiles, err := t.expectedFiles()
+	if err != nil {
+		return false, err.Error()
+	}
+	for _, file := range result.Files {
+		golden := filepath.Join(t.Files, filepath.FromSlash(file.Name))
+		content, ok := expectedFiles[file.Name]
+		if !ok {
+			fmt.Fprintf(&failures, "unexpected output file %s\n", golden)
+			continue
+		}
+		delete(expectedFiles, file.Name)
+		failures.WriteString(etc.UnifiedDiff(golden, t.Template+" @output "+file.Name, content, file.Content))
+	}
+	for _, name := range sortedKeys(expectedFiles) {
+		fmt.Fprintf(&failures, "missing output file %s\n", filepath.Join(t.Files, filepath.FromSlash(name)))
+	}
+
+	if failures.Len() > 0 {
+		return false, failures.String()
+	}
+	return true, ""
+}
+
+// expectedExitCode reads the .exit file, 0 when there is none.
+func (t goldenTest) expectedExitCode() (int, error) {
+	content, err := os.ReadFile(t.Exit)
+	if errors.Is(err, fs.ErrNotExist) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	code, err := strconv.Atoi(strings.TrimSpace(string(content)))
+	if err != nil {
+		return 0, fmt.Errorf("%s: expected an exit code, got %q", t.Exit, strings.TrimSpace(string(content)))
+	}
+	return code, nil
+}
+
+// expectedFiles reads the files below the .files directory by their @output
+// names.
+func (t goldenTest) expectedFiles() (map[string]string, error) {
+	files := make(map[string]string)
+	err := filepath.WalkDir(t.Files, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			return nil
+		}
+		content, err := os.ReadFile(p)
+		if err != nil {
+			return err
+		}
+		name, err := filepath.Rel(t.Files, p)
+		if err != nil {
+			return err
+		}
+		files[filepath.ToSlash(name)] = string(content)
+		return nil
+	})
+	if errors.Is(err, fs.ErrNotExist) {
+		return files, nil
+	}
+	return files, err
+}
+
+// update rewrites the golden files with the result, removing the .exit file
+// and the .files directory when the run no longer needs them.
+func (t goldenTest) update(result rendering) error {
+	if err := etc.WriteFile(t.Golden, result.Output); err != nil {
+		return err
+	}
+
+	if result.ExitCode != 0 {
+		if err := etc.WriteFile(t.Exit, strconv.Itoa(result.ExitCode)+"\n"); err != nil {
+			return err
+		}
+	} else if err := os.Remove(t.Exit); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+
+	if err := os.RemoveAll(t.Files); err != nil {
+		return err
+	}
+	for _, file := range result.Files {
+		path := filepath.Join(t.Files, filepath.FromSlash(file.Name))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			return err
+		}
+		if err := etc.WriteFile(path, file.Content); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func runTestCommand(args []string) int {
+	flags := flag.NewFlagSet("test", flag.ExitOnError)
+	updateFlag := flags.Bool("update", false, "Rewrite golden files with the current output")
+	verboseFlag := flags.Bool("v", false, "Report passing templates too")
+	coverFlag := flags.String("cover", "", "Write an LCOV coverage profile of all runs to file")
+	coverHTMLFlag := flags.String("coverhtml", "", "Write an HTML coverage report of all runs to file")
+	trimLinesFlag := flags.Bool("trimlines", false, "Remove lines that contain only directives and whitespace")
+	delimiters := lexer.DefaultDelimiters()
+	flags.Var(delimitersFlag{&delimiters}, "delims", "Replace the call, open, close and quote delimiters, e.g. '$ [ ] \"'")
+	var includeDirs pathListFlag
+	flags.Var(&includeDirs, "I", "Search dir for included files after the including file's directory (repeatable)")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "usage: cutter test [flags] [paths...]")
+		fmt.Fprintf(flags.Output(), "Renders every .cm template that has a sibling %s file and compares the output, %s files and exit code.\n", goldenExtension, filesExtension)
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	paths := flags.Args()
+	if len(paths) == 0 {
+		paths = []string{"."}
+	}
+
+	tests, err := discoverGoldenTests(paths)
+	if err != nil {
+		return reportError(newCLIError(ExitIO, "i/o error", err))
+	}
+
+	var profile *runtime.CoverageProfile
+	if *coverFlag != "" || *coverHTMLFlag != "" {
+		profile = runtime.NewCoverageProfile()
+	}
+
+	failed := 0
+	for _, test := range tests {
+		ok, detail := test.run(*updateFlag, lexer.Options{TrimLines: *trimLinesFlag, Delimiters: delimiters}, includePath(includeDirs), profile)
+		switch {
+		case !ok:
+			failed++
+			fmt.Printf("--- FAIL: %s\n", test.Template)
+			fmt.Print(detail)
+			if !strings.HasSuffix(detail, "\n") {
+				fmt.Println()
+			}
+		case *updateFlag:
+			fmt.Printf("updated: %s\n", test.Golden)
+		case *verboseFlag:
+			fmt.Printf("ok: %s\n", test.Template)
+		}
+	}
+
+	if profile != nil {
+		if err := writeCoverage(profile, *coverFlag, *coverHTMLFlag, false); err != nil {
+			return reportError(newCLIError(ExitIO, "i/o error", err))
+		}
+	}
+
+	if failed > 0 {
+		fmt.Printf("FAIL: %d of %d templates failed\n", failed, len(tests))
+		return ExitFailure
+	}
+	fmt.Printf("PASS: %d templates\n", len(tests))
+	return ExitOK
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"cutter/lexer"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+var goldenOptions = lexer.Options{Delimiters: lexer.DefaultDelimiters()}
+
+// writeTree writes files below dir by their slash-separated names.
+func writeTree(t *testing.T, dir string, files map[string]string) {
+	t.Helper()
+	for name, content := range files {
+		path := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func readFile(t *testing.T, path string) string {
+	t.Helper()
+	content, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(content)
+}
+
+func TestDiscoverGoldenTests(t *testing.T) {
+	tests, err := discoverGoldenTests([]string{filepath.Join("testdata", "golden")})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fixtures := make([]string, 0)
+	for _, test := range tests {
+		name := filepath.ToSlash(test.Template)
+		if test.Env != "" {
+			name += " env"
+		}
+		if test.Data != "" {
+			name += " json"
+		}
+		if test.CSV != "" {
+			name += " csv"
+		}
+		fixtures = append(fixtures, name)
+	}
+	want := []string{
+		"testdata/golden/data.cm json",
+		"testdata/golden/env.cm env",
+		"testdata/golden/exit.cm",
+		"testdata/golden/files.cm",
+		"testdata/golden/hello.cm",
+		"testdata/golden/rows.cm csv",
+	}
+	if strings.Join(fixtures, "\n") != strings.Join(want, "\n") {
+		t.Errorf("found %q, want %q", fixtures, want)
+	}
+}
+
+func TestDiscoverGoldenTestsSkips(t *testing.T) {
+	dir := t.TempDir()
+	writeTree(t, dir, map[string]string{
+		"page.cm":             "page",
+		"page.out":            "page\n",
+		"page.files/copy.cm":  "an expected @output file",
+		"page.files/copy.out": "",
+		"lib/shared.cm":       "no golden file",
+		"notes.txt":           "",
+	})
+
+	tests, err := discoverGoldenTests([]string{dir, filepath.Join(dir, "lib", "shared.cm")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	templates := make([]string, 0)
+	for _, test := range tests {
+		rel, _ := filepath.Rel(dir, test.Template)
+		templates = append(templates, filepath.ToSlash(rel))
+	}
+	// A template named on the command line is a test even without a golden file.
+	if want := []string{"lib/shared.cm", "page.cm"}; strings.Join(templates, " ") != strings.Join(want, " ") {
+		t.Errorf("found %q, want %q", templates, want)
+	}
+
+	if _, err := discoverGoldenTests([]string{filepath.Join(dir, "missing")}); err == nil {
+		t.Errorf("a missing path was accepted")
+	}
+}
+
+func TestGoldenExamples(t *testing.T) {
+	tests, err := discoverGoldenTests([]string{filepath.Join("testdata", "golden")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range tests {
+		if ok, detail := test.run(false, goldenOptions, nil, nil); !ok {
+			t.Errorf("%s failed:\n%s", test.Template, detail)
+		}
+	}
+	if _, set := os.LookupEnv("GOLDEN_USER"); set {
+		t.Errorf("the .env fixture was left in the environment")
+	}
+}
+
+func TestGoldenFailures(t *testing.T) {
+	tests := []struct {
+		name  string
+		files map[string]string
+		want  []string
+	}{
+		{"output", map[string]string{"t.cm": "got", "t.out": "want\n"},
+			[]string{"-want\n+got\n"}},
+		{"exit code", map[string]string{"t.cm": "@exit(2)", "t.out": "\n"},
+			[]string{"exit code 2, expected 0"}},
+		{"expected exit code", map[string]string{"t.cm": "", "t.out": "\n", "t.exit": "4\n"},
+			[]string{"exit code 0, expected 4"}},
+		{"bad exit file", map[string]string{"t.cm": "", "t.out": "\n", "t.exit": "four"},
+			[]string{`expected an exit code, got "four"`}},
+		{"output file content", map[string]string{"t.cm": "@output(`a.txt`)new", "t.out": "\n", "t.files/a.txt": "old"},
+			[]string{"-old", "+new"}},
+		{"unexpected output file", map[string]string{"t.cm": "@output(`a.txt`)a", "t.out": "\n"},
+			[]string{"unexpected output file ", filepath.Join("t.files", "a.txt")}},
+		{"missing output file", map[string]string{"t.cm": "", "t.out": "\n", "t.files/sub/b.txt": "b"},
+			[]string{"missing output file ", filepath.Join("t.files", "sub", "b.txt")}},
+		{"runtime error", map[string]string{"t.cm": "@nosuchfunction()", "t.out": "\n"},
+			[]string{"nosuchfunction"}},
+		{"bad env file", map[string]string{"t.cm": "", "t.out": "\n", "t.env": "NOVALUE"},
+			[]string{`expected KEY=VALUE, got "NOVALUE"`}},
+	}
+
+	for _, test := range tests {
+		dir := t.TempDir()
+		writeTree(t, dir, test.files)
+		ok, detail := newGoldenTest(filepath.Join(dir, "t.cm")).run(false, goldenOptions, nil, nil)
+		if ok {
+			t.Errorf("%s: passed", test.name)
+			continue
+		}
+		for _, want := range test.want {
+			if !strings.Contains(detail, want) {
+				t.Errorf("%s: failure does not mention %q:\n%s", test.name, want, detail)
+			}
+		}
+	}
+}
+
+func TestGoldenUpdate(t *testing.T) {
+	dir := t.TempDir()
+	template := filepath.Join(dir, "t.cm")
+	writeTree(t, dir, map[string]string{
+		"t.cm":              "main@output(`a.txt`)a@output(`sub/b.txt`)b@exit(5)",
+		"t.out":             "stale\n",
+		"t.files/stale.txt": "stale",
+	})
+	test := newGoldenTest(template)
+
+	if ok, detail := test.run(true, goldenOptions, nil, nil); !ok {
+		t.Fatalf("update failed: %s", detail)
+	}
+	if got := readFile(t, test.Golden); got != "main\n" {
+		t.Errorf(".out is %q", got)
+	}
+	if got := readFile(t, test.Exit); got != "5\n" {
+		t.Errorf(".exit is %q", got)
+	}
+	if got := readFile(t, filepath.Join(test.Files, "a.txt")); got != "a" {
+		t.Errorf("a.txt is %q", got)
+	}
+	if got := readFile(t, filepath.Join(test.Files, "sub", "b.txt")); got != "b" {
+		t.Errorf("sub/b.txt is %q", got)
+	}
+	if _, err := os.Stat(filepath.Join(test.Files, "stale.txt")); err == nil {
+		t.Errorf("an output file the run no longer writes was kept")
+	}
+	if ok, detail := test.run(false, goldenOptions, nil, nil); !ok {
+		t.Errorf("the updated test fails:\n%s", detail)
+	}
+
+	// Without an exit code or output files, .exit and .files go away.
+	writeTree(t, dir, map[string]string{"t.cm": "plain"})
+	if ok, detail := test.run(true, goldenOptions, nil, nil); !ok {
+		t.Fatalf("update failed: %s", detail)
+	}
+	for _, path := range []string{test.Exit, test.Files} {
+		if _, err := os.Stat(path); err == nil {
+			t.Errorf("%s was kept", path)
+		}
+	}
+	if ok, detail := test.run(false, goldenOptions, nil, nil); !ok {
+		t.Errorf("the updated test fails:\n%s", detail)
+	}
+}
+
+func TestLoadEnvFixture(t *testing.T) {
+	dir := t.TempDir()
+	writeTree(t, dir, map[string]string{"t.env": "# comment\n\nA=1\n B = two words\nC=x=y\n"})
+	env, err := loadEnvFixture(filepath.Join(dir, "t.env"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(env) != 3 || env["A"] != "1" || env["B"] != " two words" || env["C"] != "x=y" {
+		t.Errorf("got %q", env)
+	}
+}